@@ -2,8 +2,13 @@
 package main
 
 import (
+	"crypto/md5"
+	"encoding/hex"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"os"
 	"strings"
 
 	"github.com/10XGenomics/rules_conda/buildutil"
@@ -19,6 +24,29 @@ func maybeSplit(s, sep string) []string {
 	return strings.Split(s, sep)
 }
 
+// checkArchive verifies the md5 checksum and size of a downloaded package
+// archive, where they are given.
+func checkArchive(fn, md5sum string, size int64) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := md5.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if size != 0 && n != size {
+		return fmt.Errorf("%s has size %d, but %d was expected", fn, n, size)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); md5sum != "" &&
+		!strings.EqualFold(sum, md5sum) {
+		return fmt.Errorf("%s has md5 %s, but %s was expected", fn, sum, md5sum)
+	}
+	return nil
+}
+
 func main() {
 	var dir, distName, extraDeps, excludeDeps,
 		licenses, licenseFile, ccInclude, url, condaRepo string
@@ -46,7 +74,29 @@ func main() {
 		"The URL from which the package was downloaded")
 	flag.StringVar(&condaRepo, "conda", buildutil.DefaultCondaRepo,
 		"The repo used to refer to dependencies.")
+	var offline bool
+	flag.BoolVar(&offline, "offline", false,
+		"Do not download the license for packages which only give a license URL.")
+	var shared bool
+	flag.BoolVar(&shared, "shared", false,
+		"Make the targets visible to every conda environment repository, "+
+			"not only the one used to refer to dependencies.")
+	var archive, md5sum string
+	var size int64
+	flag.StringVar(&archive, "archive", "",
+		"If set, only verify the md5 checksum and size of this downloaded "+
+			"package archive, and exit.")
+	flag.StringVar(&md5sum, "md5", "",
+		"The expected md5 checksum of the archive.")
+	flag.Int64Var(&size, "size", 0,
+		"The expected size of the archive, in bytes.")
 	flag.Parse()
+	if archive != "" {
+		if err := checkArchive(archive, md5sum, size); err != nil {
+			log.Fatal("Archive verification failed: ", err)
+		}
+		return
+	}
 	var pkg conda.Package
 	if err := pkg.Load(dir, nil, flag.Args(), true); err != nil {
 		log.Fatal("Could not load package metadata:", err)
@@ -56,6 +106,8 @@ func main() {
 		q.Channel = channel
 		q.Type = pkgType
 	}
+	pkg.License.Offline = offline
+	pkg.Shared = shared
 	if len(pkg.Paths.Paths) > 0 {
 		if err := pkg.License.CanonicalizeConda(dir, pkg.Index.License,
 			strings.Fields(licenses), licenseFile); err != nil {
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The package archive format to lock.
+type archiveFormat string
+
+const (
+	// Use whichever archive the solver chose.
+	formatAny archiveFormat = ""
+	// Only use .conda archives.
+	formatConda archiveFormat = "conda"
+	// Only use .tar.bz2 archives.
+	formatTarBz2 archiveFormat = "tar.bz2"
+	// Use .conda archives where they are available, and otherwise .tar.bz2.
+	formatPreferConda archiveFormat = "prefer-conda"
+)
+
+const (
+	extConda  = ".conda"
+	extTarBz2 = ".tar.bz2"
+)
+
+func parseArchiveFormat(s string) (archiveFormat, error) {
+	switch f := archiveFormat(s); f {
+	case formatAny, formatConda, formatTarBz2, formatPreferConda:
+		return f, nil
+	}
+	return formatAny, fmt.Errorf(
+		"unknown archive format %q: expected conda, tar.bz2, or prefer-conda", s)
+}
+
+// archiveExt returns the archive extension of the package file name or URL,
+// or the empty string if it is not a known archive type.
+func archiveExt(fn string) string {
+	switch {
+	case strings.HasSuffix(fn, extConda):
+		return extConda
+	case strings.HasSuffix(fn, extTarBz2):
+		return extTarBz2
+	}
+	return ""
+}
+
+// choose returns the archive extension to use for a package, given the
+// extension the solver chose (if any) and the archives which are known to be
+// available.  If availability is unknown, has is nil.
+func (f archiveFormat) choose(dist, current string, has map[string]bool) (string, error) {
+	switch f {
+	case formatConda, formatTarBz2:
+		want := "." + string(f)
+		if current != want && has != nil && !has[want] {
+			return "", fmt.Errorf("no %s archive is available for %s", want, dist)
+		}
+		return want, nil
+	case formatPreferConda:
+		if has == nil {
+			if current != "" {
+				return current, nil
+			}
+		} else if has[extConda] {
+			return extConda, nil
+		}
+		return extTarBz2, nil
+	}
+	if current != "" {
+		return current, nil
+	}
+	if has[extConda] && !has[extTarBz2] {
+		return extConda, nil
+	}
+	return extTarBz2, nil
+}
+
+// useRecord returns true if a repodata record for an archive with the given
+// extension should be used with this format.  Where both are used, .conda
+// records take precedence.
+func (f archiveFormat) useRecord(ext string) bool {
+	switch f {
+	case formatConda:
+		return ext == extConda
+	case formatTarBz2:
+		return ext == extTarBz2
+	}
+	return true
+}
+
+// setArchive switches the package to the archive with the given extension.
+// The checksums for the previous archive, if any, are discarded.
+func (spec *PkgSpec) setArchive(ext string) {
+	if spec.Url != "" && archiveExt(spec.Url) == ext {
+		return
+	}
+	spec.Url = spec.BaseUrl + "/" + spec.DistName + ext
+	spec.Sha256 = ""
+	spec.Md5 = ""
+	spec.Size = 0
+	spec.hashSource = ""
+}
+
+// chooseArchives selects the archive for each package according to the
+// format, based on which archives are listed in the cached repodata.
+func chooseArchives(specs map[string]*PkgSpec, caches []*repodataCache,
+	format archiveFormat) error {
+	for _, pkg := range specs {
+		var has map[string]bool
+		for _, cache := range caches {
+			if pkg.BaseUrl != "" && cache.Url != pkg.BaseUrl {
+				continue
+			}
+			for _, ext := range [...]string{extConda, extTarBz2} {
+				if r, ok := cache.Packages[pkg.DistName+ext]; ok &&
+					r.Name == pkg.Name {
+					if has == nil {
+						has = make(map[string]bool, 2)
+					}
+					has[ext] = true
+				}
+			}
+			if has != nil {
+				if pkg.BaseUrl == "" {
+					pkg.BaseUrl = cache.Url
+				}
+				break
+			}
+		}
+		if pkg.BaseUrl == "" {
+			// It will be reported as incomplete later.
+			continue
+		}
+		ext, err := format.choose(pkg.DistName, archiveExt(pkg.Url), has)
+		if err != nil {
+			return err
+		}
+		pkg.setArchive(ext)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"path"
+	"testing"
+)
+
+func TestArchiveFormatChoose(t *testing.T) {
+	both := map[string]bool{extConda: true, extTarBz2: true}
+	bz2 := map[string]bool{extTarBz2: true}
+	for _, test := range [...]struct {
+		format  archiveFormat
+		current string
+		has     map[string]bool
+		want    string
+	}{
+		{formatAny, extConda, both, extConda},
+		{formatAny, "", both, extTarBz2},
+		{formatConda, extTarBz2, both, extConda},
+		{formatConda, extTarBz2, nil, extConda},
+		{formatTarBz2, extConda, both, extTarBz2},
+		{formatPreferConda, extTarBz2, both, extConda},
+		{formatPreferConda, extConda, bz2, extTarBz2},
+		{formatPreferConda, extConda, nil, extConda},
+	} {
+		if got, err := test.format.choose("pkg", test.current, test.has); err != nil {
+			t.Errorf("%q %s: %v", test.format, test.current, err)
+		} else if got != test.want {
+			t.Errorf("%q %s: got %s, want %s",
+				test.format, test.current, got, test.want)
+		}
+	}
+	if _, err := formatConda.choose("pkg", extTarBz2, bz2); err == nil {
+		t.Error("expected an error for a missing .conda archive")
+	}
+	if _, err := parseArchiveFormat("zip"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestChooseArchives(t *testing.T) {
+	const base = "https://conda.anaconda.org/conda-forge/noarch"
+	caches := []*repodataCache{{
+		Url: base,
+		Packages: map[string]PkgSpec{
+			"click-8.1.7-unix_pyh707e725_0.tar.bz2": {
+				Name: "click", Sha256: "aaa",
+			},
+			"click-8.1.7-unix_pyh707e725_0.conda": {
+				Name: "click", Sha256: "bbb",
+			},
+		},
+	}}
+	click := &PkgSpec{
+		Name:     "click",
+		DistName: "click-8.1.7-unix_pyh707e725_0",
+		BaseUrl:  base,
+		Url:      base + "/click-8.1.7-unix_pyh707e725_0.tar.bz2",
+		Sha256:   "aaa",
+	}
+	specs := map[string]*PkgSpec{"click": click}
+	if err := chooseArchives(specs, caches, formatPreferConda); err != nil {
+		t.Fatal(err)
+	}
+	if path.Base(click.Url) != "click-8.1.7-unix_pyh707e725_0.conda" {
+		t.Errorf("unexpected url %s", click.Url)
+	}
+	if click.Sha256 != "" {
+		t.Error("checksum for the old archive was kept")
+	}
+}
+
+func TestLoadIndexFormat(t *testing.T) {
+	index, err := loadIndex([]string{"testdata/channel"}, "linux-64", formatTarBz2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range index["click"] {
+		if archiveExt(r.fileName) != extTarBz2 {
+			t.Errorf("unexpected archive %s", r.fileName)
+		}
+	}
+	for _, r := range index["libzlib"] {
+		if r.Version == "1.3.1" {
+			t.Error("libzlib 1.3.1 is only available as .conda")
+		}
+	}
+}
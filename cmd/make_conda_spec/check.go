@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// checkLock returns an error showing the differences if the content of the
+// lock file does not match the expected content.
+func checkLock(outName string, content []byte) error {
+	existing, err := os.ReadFile(outName)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if bytes.Equal(existing, content) {
+		return nil
+	}
+	return fmt.Errorf("%s is out of date:\n%s", outName,
+		unifiedDiff(outName, string(existing), string(content)))
+}
+
+// The number of unchanged lines to show around each change.
+const diffContext = 3
+
+// unifiedDiff returns a unified diff between two texts.
+func unifiedDiff(name, a, b string) string {
+	aLines, bLines := splitLines(a), splitLines(b)
+	ops := diffLines(aLines, bLines)
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "--- %s\n+++ %s (expected)\n", name, name)
+	for start := 0; start < len(ops); {
+		// Find the next change.
+		for start < len(ops) && ops[start].kind == ' ' {
+			start++
+		}
+		if start == len(ops) {
+			break
+		}
+		// Extend the hunk until there are enough unchanged lines after
+		// the last change.
+		end, unchanged := start, 0
+		for end < len(ops) && unchanged <= 2*diffContext {
+			if ops[end].kind == ' ' {
+				unchanged++
+			} else {
+				unchanged = 0
+			}
+			end++
+		}
+		end -= max(unchanged-diffContext, 0)
+		start = max(start-diffContext, 0)
+		hunk := ops[start:end]
+		fmt.Fprintf(&buf, "@@ -%d,%d +%d,%d @@\n",
+			hunk[0].a+1, countLines(hunk, '-'),
+			hunk[0].b+1, countLines(hunk, '+'))
+		for _, op := range hunk {
+			buf.WriteByte(op.kind)
+			buf.WriteString(op.line)
+			buf.WriteByte('\n')
+		}
+		start = end
+	}
+	return buf.String()
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// A line in a diff, with the kind being ' ', '-', or '+', and a and b being
+// the line indexes in the old and new text.
+type diffOp struct {
+	kind byte
+	line string
+	a, b int
+}
+
+func countLines(ops []diffOp, kind byte) int {
+	n := 0
+	for _, op := range ops {
+		if op.kind == ' ' || op.kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// diffLines computes a minimal line diff using the longest common
+// subsequence.  Common prefixes and suffixes are trimmed first, since lock
+// file changes are usually small relative to the file.
+func diffLines(a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix &&
+		a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	ops := make([]diffOp, 0, len(a)+len(b)-prefix-suffix)
+	for i := 0; i < prefix; i++ {
+		ops = append(ops, diffOp{kind: ' ', line: a[i], a: i, b: i})
+	}
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	// lcs[i][j] is the length of the common subsequence of ma[i:] and mb[j:].
+	lcs := make([][]int32, len(ma)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(mb)+1)
+	}
+	for i := len(ma) - 1; i >= 0; i-- {
+		for j := len(mb) - 1; j >= 0; j-- {
+			if ma[i] == mb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(ma) || j < len(mb) {
+		switch {
+		case i < len(ma) && j < len(mb) && ma[i] == mb[j]:
+			ops = append(ops, diffOp{kind: ' ', line: ma[i],
+				a: prefix + i, b: prefix + j})
+			i++
+			j++
+		case j == len(mb) || i < len(ma) && lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{kind: '-', line: ma[i],
+				a: prefix + i, b: prefix + j})
+			i++
+		default:
+			ops = append(ops, diffOp{kind: '+', line: mb[j],
+				a: prefix + i, b: prefix + j})
+			j++
+		}
+	}
+	for k := 0; k < suffix; k++ {
+		ops = append(ops, diffOp{kind: ' ',
+			line: a[len(a)-suffix+k],
+			a:    len(a) - suffix + k,
+			b:    len(b) - suffix + k,
+		})
+	}
+	return ops
+}
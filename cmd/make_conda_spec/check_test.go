@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm\nn\n"
+	b := "a\nb\nc\nD\ne\nf\ng\nh\ni\nj\nk\nl\nm\nn\no\n"
+	expect := `--- x
++++ x (expected)
+@@ -1,7 +1,7 @@
+ a
+ b
+ c
+-d
++D
+ e
+ f
+ g
+@@ -12,3 +12,4 @@
+ l
+ m
+ n
++o
+`
+	if d := unifiedDiff("x", a, b); d != expect {
+		t.Errorf("unexpected diff:\n%s", d)
+	}
+}
+
+func TestCheckLock(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "lock.bzl")
+	if err := checkLock(fn, []byte("x = 1\n")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+	if err := os.WriteFile(fn, []byte("x = 1\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkLock(fn, []byte("x = 1\n")); err != nil {
+		t.Error(err)
+	}
+	if err := checkLock(fn, []byte("x = 2\n")); err == nil {
+		t.Error("expected an error for a stale file")
+	} else if !strings.Contains(err.Error(), "-x = 1\n+x = 2\n") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The number of packages to download concurrently to compute checksums.
+	hashWorkers = 8
+	// The number of attempts to make to download each package.
+	hashAttempts = 4
+)
+
+// The delay before the first retry.  It doubles after each attempt.
+var hashRetryDelay = 2 * time.Second
+
+// The client used for downloading packages to compute their checksums.
+// The timeout covers reading the whole package, so it must be generous.
+var hashClient = &http.Client{Timeout: 10 * time.Minute}
+
+// An error which should not be retried.
+type permanentError struct {
+	err error
+}
+
+func (err permanentError) Error() string {
+	return err.err.Error()
+}
+
+func (err permanentError) Unwrap() error {
+	return err.err
+}
+
+// The checksums and size of a package archive.
+type archiveHashes struct {
+	Sha256 string
+	Md5    string
+	Size   int64
+}
+
+func (spec *PkgSpec) hashes() archiveHashes {
+	return archiveHashes{
+		Sha256: spec.Sha256,
+		Md5:    spec.Md5,
+		Size:   spec.Size,
+	}
+}
+
+// checkHashes records the checksums and size of the package from the
+// given source, and returns an error if they do not match the values
+// already known from another source.
+func (spec *PkgSpec) checkHashes(h archiveHashes, source string) error {
+	mismatch := func(what string, old, new any) error {
+		oldSource := spec.hashSource
+		if oldSource == "" {
+			oldSource = "the solver"
+		}
+		return fmt.Errorf("%s mismatch for %s: %v from %s, but %v from %s",
+			what, spec.DistName, old, oldSource, new, source)
+	}
+	if h.Sha256 != "" && spec.Sha256 != "" && h.Sha256 != spec.Sha256 {
+		return mismatch("sha256", spec.Sha256, h.Sha256)
+	}
+	if h.Md5 != "" && spec.Md5 != "" && h.Md5 != spec.Md5 {
+		return mismatch("md5", spec.Md5, h.Md5)
+	}
+	if h.Size != 0 && spec.Size != 0 && h.Size != spec.Size {
+		return mismatch("size", spec.Size, h.Size)
+	}
+	if spec.hashSource == "" {
+		spec.hashSource = source
+	}
+	if spec.Sha256 == "" {
+		spec.Sha256 = h.Sha256
+	}
+	if spec.Md5 == "" {
+		spec.Md5 = h.Md5
+	}
+	if spec.Size == 0 {
+		spec.Size = h.Size
+	}
+	return nil
+}
+
+func computeHashes(f io.Reader) (archiveHashes, error) {
+	sha, md := sha256.New(), md5.New()
+	size, err := io.Copy(io.MultiWriter(sha, md), f)
+	if err != nil {
+		return archiveHashes{}, err
+	}
+	return archiveHashes{
+		Sha256: hex.EncodeToString(sha.Sum(nil)),
+		Md5:    hex.EncodeToString(md.Sum(nil)),
+		Size:   size,
+	}, nil
+}
+
+func computeFileHashes(filename string) (archiveHashes, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return archiveHashes{}, err
+	}
+	defer f.Close()
+	return computeHashes(f)
+}
+
+func computeHttpHashes(url string) (archiveHashes, error) {
+	r, err := hashClient.Get(url)
+	if err != nil {
+		return archiveHashes{}, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		err := fmt.Errorf("http status %s", r.Status)
+		if r.StatusCode >= 400 && r.StatusCode < 500 &&
+			r.StatusCode != http.StatusTooManyRequests &&
+			r.StatusCode != http.StatusRequestTimeout {
+			return archiveHashes{}, permanentError{err}
+		}
+		return archiveHashes{}, err
+	}
+	return computeHashes(r.Body)
+}
+
+// computeHttpHashesRetry downloads the url to compute its checksums,
+// retrying with exponential backoff on failure.
+func computeHttpHashesRetry(url string) (archiveHashes, error) {
+	delay := hashRetryDelay
+	for attempt := 1; ; attempt++ {
+		h, err := computeHttpHashes(url)
+		if err == nil {
+			return h, nil
+		}
+		var perm permanentError
+		if attempt >= hashAttempts || errors.As(err, &perm) {
+			return h, err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// fetchHashes downloads the package to compute its checksums, trying each
+// mirror in turn.  It returns the URL which was used.
+func (pkg *PkgSpec) fetchHashes() (archiveHashes, string, error) {
+	var errs []error
+	for _, url := range pkg.downloadUrls() {
+		h, err := computeHttpHashesRetry(url)
+		if err == nil {
+			return h, url, nil
+		}
+		errs = append(errs, fmt.Errorf(
+			"could not compute checksum for %s from %s: %w",
+			pkg.Name, url, err))
+	}
+	return archiveHashes{}, "", errors.Join(errs...)
+}
+
+// hashPackages downloads the given packages concurrently to compute their
+// checksums.
+func hashPackages(pkgs []*PkgSpec) error {
+	if len(pkgs) == 0 {
+		return nil
+	}
+	work := make(chan *PkgSpec)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	done := 0
+	progress := func() {
+		fmt.Fprintf(os.Stderr, "\rDownloading packages to compute checksums: %d/%d",
+			done, len(pkgs))
+	}
+	progress()
+	for i := 0; i < min(hashWorkers, len(pkgs)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pkg := range work {
+				h, url, err := pkg.fetchHashes()
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, err)
+				} else if err := pkg.checkHashes(h, url); err != nil {
+					errs = append(errs, err)
+				}
+				done++
+				progress()
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, pkg := range pkgs {
+		work <- pkg
+	}
+	close(work)
+	wg.Wait()
+	fmt.Fprintln(os.Stderr)
+	return errors.Join(errs...)
+}
+
+// hashLockInput computes the checksums of the packages read from a lock
+// input which do not record a sha256, for example explicit lists with only
+// md5 checksums.  Archives already in the package cache directory are hashed
+// in place, and the rest are downloaded unless offline.  An error is
+// returned for any package whose checksum could not be computed.
+func hashLockInput(specs map[string]*PkgSpec, pkgDir string, offline bool) error {
+	var fetch []*PkgSpec
+	var missing []string
+	for _, name := range sortedKeys(specs) {
+		pkg := specs[name]
+		if pkg.Sha256 != "" {
+			continue
+		}
+		if pkgDir != "" && pkg.Url != "" {
+			fn := filepath.Join(pkgDir, path.Base(pkg.Url))
+			if h, err := computeFileHashes(fn); err == nil {
+				if err := pkg.checkHashes(h, fn); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if offline || pkg.Url == "" {
+			missing = append(missing, pkg.DistName)
+		} else {
+			fetch = append(fetch, pkg)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("no sha256 for %d packages, and they could not be "+
+			"downloaded to compute it:\n  %s",
+			len(missing), strings.Join(missing, "\n  "))
+	}
+	return hashPackages(fetch)
+}
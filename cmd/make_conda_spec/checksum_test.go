@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHashPackages(t *testing.T) {
+	defer func(d time.Duration) { hashRetryDelay = d }(hashRetryDelay)
+	hashRetryDelay = time.Millisecond
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/flaky.conda":
+				// Fail the first attempt.
+				if requests.Add(1) == 1 {
+					http.Error(w, "unavailable", http.StatusServiceUnavailable)
+					return
+				}
+				w.Write([]byte("flaky"))
+			case "/ok.conda":
+				w.Write([]byte("ok"))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer server.Close()
+	pkgs := []*PkgSpec{
+		{Name: "ok", Url: server.URL + "/ok.conda"},
+		{Name: "flaky", Url: server.URL + "/flaky.conda"},
+	}
+	if err := hashPackages(pkgs); err != nil {
+		t.Fatal(err)
+	}
+	if pkgs[0].Sha256 != "2689367b205c16ce32ed4200942b8b8b1e262dfc70d9bc9fbc77c49699a4f1df" {
+		t.Errorf("wrong checksum %s", pkgs[0].Sha256)
+	}
+	if pkgs[0].Md5 != "444bcb3a3fcf8389296c49467f27e1d6" || pkgs[0].Size != 2 {
+		t.Errorf("wrong md5 %s or size %d", pkgs[0].Md5, pkgs[0].Size)
+	}
+	if pkgs[1].Sha256 == "" {
+		t.Error("flaky download was not retried")
+	}
+	missing := []*PkgSpec{{Name: "missing", Url: server.URL + "/missing.conda"}}
+	err := hashPackages(missing)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "missing from "+missing[0].Url) ||
+		!strings.Contains(msg, "404") {
+		t.Errorf("error did not name the package: %v", err)
+	}
+}
+
+func TestCheckHashes(t *testing.T) {
+	spec := PkgSpec{DistName: "ok-1.0-0", Md5: "abc"}
+	if err := spec.checkHashes(archiveHashes{
+		Sha256: "def",
+		Md5:    "abc",
+		Size:   10,
+	}, "repodata.json"); err != nil {
+		t.Fatal(err)
+	}
+	if spec.Sha256 != "def" || spec.Size != 10 {
+		t.Errorf("hashes not filled in: %+v", spec)
+	}
+	err := spec.checkHashes(archiveHashes{
+		Sha256: "def",
+		Md5:    "abc",
+		Size:   11,
+	}, "ok-1.0-0.conda")
+	if err == nil {
+		t.Fatal("expected a size mismatch")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "ok-1.0-0: 10 from repodata.json, but 11 from ok-1.0-0.conda") {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := spec.checkHashes(archiveHashes{Sha256: "xyz"}, "cache"); err == nil {
+		t.Error("expected a sha256 mismatch")
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The exit code used when the requirements cannot be satisfied.
+const exitConflict = 3
+
+// A problem reported by the solver.
+type solveProblem struct {
+	// The package which imposes the constraint, or empty if the
+	// constraint was requested directly.
+	Package string
+	// The constraint which could not be satisfied.
+	Constraint string
+	// The problem as reported by the solver.
+	Message string
+}
+
+// A structured explanation of why the requirements could not be solved.
+type conflictReport struct {
+	Platform string
+	// The channels which were searched.
+	Channels []string
+	// The requested specs which are involved in a problem.
+	Requested []string
+	Problems  []solveProblem
+}
+
+// The error payload from `micromamba create --json` or `conda create
+// --json`.
+type condaErrorOutput struct {
+	// micromamba
+	SolverProblems []string `json:"solver_problems"`
+	// conda
+	ExceptionName string   `json:"exception_name"`
+	Message       string   `json:"message"`
+	Error         string   `json:"error"`
+	Packages      []string `json:"packages"`
+}
+
+// isUnsatisfiable returns true if conda failed because the requirements
+// could not be satisfied, rather than for some other reason such as a
+// network or configuration error.
+func (payload *condaErrorOutput) isUnsatisfiable() bool {
+	switch payload.ExceptionName {
+	case "PackagesNotFoundError", "UnsatisfiableError":
+		return true
+	}
+	return false
+}
+
+var problemPatterns = [...]struct {
+	re *regexp.Regexp
+	// The submatch indices for the package and the constraint.
+	pkg, constraint int
+}{
+	{regexp.MustCompile(`^nothing provides requested (.+)$`), 0, 1},
+	{regexp.MustCompile(`^nothing provides (.+) needed by (\S+)$`), 2, 1},
+	{regexp.MustCompile(`^package (\S+) requires (.+), but none of the providers can be installed$`), 1, 2},
+	{regexp.MustCompile(`^package (\S+) conflicts with (.+) provided by \S+$`), 1, 2},
+	{regexp.MustCompile(`^cannot install both (\S+) and (\S+)$`), 1, 2},
+	{regexp.MustCompile(`^(\S+) is constrained by (.+)$`), 1, 2},
+}
+
+// parseProblem extracts the package and constraint from a solver problem
+// message, where the message is in one of the forms used by libsolv.
+func parseProblem(msg string) solveProblem {
+	msg = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(msg), "-│├└─ "))
+	p := solveProblem{Message: msg}
+	for _, pat := range problemPatterns {
+		if m := pat.re.FindStringSubmatch(msg); m != nil {
+			if pat.pkg > 0 {
+				p.Package = m[pat.pkg]
+			}
+			p.Constraint = m[pat.constraint]
+			break
+		}
+	}
+	return p
+}
+
+// parseConflicts builds a conflict report from the json output of a failed
+// solve.  It returns nil unless the output describes the requirements as
+// unsatisfiable, so that other failures are shown as conda reports them.
+func parseConflicts(out []byte, requirements string,
+	channels []string, arch string) *conflictReport {
+	var payload condaErrorOutput
+	if err := json.Unmarshal(out, &payload); err != nil {
+		return nil
+	}
+	report := conflictReport{
+		Platform: arch,
+		Channels: channels,
+	}
+	for _, msg := range payload.SolverProblems {
+		report.Problems = append(report.Problems, parseProblem(msg))
+	}
+	if len(report.Problems) == 0 && !payload.isUnsatisfiable() {
+		return nil
+	}
+	if len(report.Problems) == 0 {
+		for _, pkg := range payload.Packages {
+			report.Problems = append(report.Problems, solveProblem{
+				Constraint: pkg,
+				Message:    "nothing provides requested " + pkg,
+			})
+		}
+	}
+	if len(report.Problems) == 0 {
+		msg := payload.Message
+		if msg == "" {
+			msg = payload.Error
+		}
+		for _, line := range strings.Split(msg, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				report.Problems = append(report.Problems, parseProblem(line))
+			}
+		}
+	}
+	if len(report.Problems) == 0 {
+		return nil
+	}
+	report.Requested = requestedInvolved(requirements, report.Problems)
+	return &report
+}
+
+// requestedInvolved returns the requested specs for packages which are
+// named in any of the problems.
+func requestedInvolved(requirements string, problems []solveProblem) []string {
+	reqs, err := readRequirements(requirements)
+	if err != nil {
+		return nil
+	}
+	names := make(map[string]struct{}, len(problems)*2)
+	for _, p := range problems {
+		if p.Package != "" {
+			name, _, _ := splitDistName(p.Package)
+			names[name] = struct{}{}
+		}
+		if name, version, _ := splitDistName(p.Constraint); version != "" &&
+			!strings.ContainsAny(p.Constraint, " =<>") {
+			names[name] = struct{}{}
+		} else if spec, err := ParseMatchSpec(p.Constraint); err == nil {
+			names[spec.Name] = struct{}{}
+		}
+	}
+	var result []string
+	for _, req := range reqs {
+		if _, ok := names[req.Name]; ok {
+			result = append(result, req.String())
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// print writes the report as a tree, with the problems grouped by the
+// package which imposes the constraint.
+func (report *conflictReport) print(w io.Writer) error {
+	groups := make(map[string][]solveProblem)
+	var order []string
+	for _, p := range report.Problems {
+		key := p.Package
+		if key == "" {
+			key = "requested"
+		}
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], p)
+	}
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "Could not solve the environment for %s.\n", report.Platform)
+	if len(report.Requested) > 0 {
+		buf.WriteString("Requested specs involved:\n")
+		for _, r := range report.Requested {
+			fmt.Fprintf(&buf, "    %s\n", r)
+		}
+	}
+	buf.WriteString("Conflicts:\n")
+	for i, key := range order {
+		branch, indent := "├── ", "│   "
+		if i == len(order)-1 {
+			branch, indent = "└── ", "    "
+		}
+		buf.WriteString(branch + key + "\n")
+		for j, p := range groups[key] {
+			leaf := "├── "
+			if j == len(groups[key])-1 {
+				leaf = "└── "
+			}
+			buf.WriteString(indent + leaf + p.Message + "\n")
+		}
+	}
+	fmt.Fprintf(&buf, "Channels searched: %s\n", strings.Join(report.Channels, ", "))
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
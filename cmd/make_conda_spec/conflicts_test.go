@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseConflicts(t *testing.T) {
+	reqs := filepath.Join(t.TempDir(), "requirements.txt")
+	if err := os.WriteFile(reqs, []byte("numpy >=2\npython 3.9.*\nclick\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := []byte(`{
+    "dry_run": true,
+    "solver_problems": [
+        "package numpy-2.0.0-py312h22e1c76_0 requires python >=3.12,<3.13.0a0, but none of the providers can be installed",
+        "nothing provides requested foo >=3",
+        "cannot install both python-3.9.19-h0755675_0 and python-3.12.3-hab00c5b_0_cpython"
+    ],
+    "success": false
+}`)
+	report := parseConflicts(out, reqs, []string{"conda-forge", "bioconda"}, "linux-64")
+	if report == nil {
+		t.Fatal("no report")
+	}
+	if p := report.Problems[0]; p.Package != "numpy-2.0.0-py312h22e1c76_0" ||
+		p.Constraint != "python >=3.12,<3.13.0a0" {
+		t.Errorf("unexpected problem %+v", p)
+	}
+	if p := report.Problems[1]; p.Package != "" || p.Constraint != "foo >=3" {
+		t.Errorf("unexpected problem %+v", p)
+	}
+	if r := strings.Join(report.Requested, ", "); r != "numpy >=2, python 3.9.*" {
+		t.Errorf("unexpected requested specs %s", r)
+	}
+	var buf strings.Builder
+	if err := report.print(&buf); err != nil {
+		t.Fatal(err)
+	}
+	const want = `Could not solve the environment for linux-64.
+Requested specs involved:
+    numpy >=2
+    python 3.9.*
+Conflicts:
+├── numpy-2.0.0-py312h22e1c76_0
+│   └── package numpy-2.0.0-py312h22e1c76_0 requires python >=3.12,<3.13.0a0, but none of the providers can be installed
+├── requested
+│   └── nothing provides requested foo >=3
+└── python-3.9.19-h0755675_0
+    └── cannot install both python-3.9.19-h0755675_0 and python-3.12.3-hab00c5b_0_cpython
+Channels searched: conda-forge, bioconda
+`
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected report:\n%s", got)
+	}
+	if parseConflicts([]byte(`{"success": false}`), reqs, nil, "linux-64") != nil {
+		t.Error("expected no report without problems")
+	}
+}
+
+func TestParseConflictsCondaErrors(t *testing.T) {
+	reqs := filepath.Join(t.TempDir(), "requirements.txt")
+	if err := os.WriteFile(reqs, []byte("foo >=3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	notFound := []byte(`{
+    "exception_name": "PackagesNotFoundError",
+    "message": "The following packages are not available from current channels:\n\n  - foo >=3",
+    "packages": ["foo >=3"]
+}`)
+	if report := parseConflicts(notFound, reqs, nil, "linux-64"); report == nil {
+		t.Error("no report for missing packages")
+	} else if r := strings.Join(report.Requested, ", "); r != "foo >=3" {
+		t.Errorf("unexpected requested specs %s", r)
+	}
+	httpError := []byte(`{
+    "exception_name": "CondaHTTPError",
+    "message": "HTTP 000 CONNECTION FAILED for url <https://conda.anaconda.org/conda-forge/linux-64/repodata.json>",
+    "error": "CondaHTTPError: HTTP 000 CONNECTION FAILED"
+}`)
+	if report := parseConflicts(httpError, reqs, nil, "linux-64"); report != nil {
+		t.Errorf("unexpected report for a network error: %+v", report)
+	}
+}
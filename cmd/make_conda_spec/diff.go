@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/10XGenomics/rules_conda/buildutil"
+	"github.com/bazelbuild/buildtools/build"
+)
+
+// A package as recorded in an existing lock file.
+type lockedPackage struct {
+	DistName string
+	BaseUrls []string
+	Sha256   string
+}
+
+// The kinds of change reported by diffLock.
+const (
+	changeAdded      = "added"
+	changeRemoved    = "removed"
+	changeUpgraded   = "upgraded"
+	changeDowngraded = "downgraded"
+	changeRebuilt    = "rebuilt"
+	changeMoved      = "moved"
+)
+
+// A change to a single package in the lock.
+type lockChange struct {
+	Change   string `json:"change"`
+	Name     string `json:"name"`
+	Platform string `json:"platform,omitempty"`
+
+	OldVersion string `json:"old_version,omitempty"`
+	NewVersion string `json:"new_version,omitempty"`
+	OldBuild   string `json:"old_build,omitempty"`
+	NewBuild   string `json:"new_build,omitempty"`
+
+	// Only set if the channel changed.
+	OldChannel string `json:"old_channel,omitempty"`
+	NewChannel string `json:"new_channel,omitempty"`
+}
+
+// lockDiff is the set of changes between an existing lock file and a new
+// solution.
+type lockDiff struct {
+	Summary map[string]int `json:"summary"`
+	Changes []lockChange   `json:"changes"`
+}
+
+// splitDistName splits a dist name into the package name, version, and
+// build string.
+func splitDistName(dist string) (name, version, build string) {
+	i := strings.LastIndexByte(dist, '-')
+	if i < 0 {
+		return dist, "", ""
+	}
+	name, build = dist[:i], dist[i+1:]
+	if i = strings.LastIndexByte(name, '-'); i >= 0 {
+		name, version = name[:i], name[i+1:]
+	}
+	return name, version, build
+}
+
+// channelOf returns the channel URL for a subdir base URL.
+func channelOf(baseUrl string) string {
+	baseUrl = strings.TrimSuffix(baseUrl, "/")
+	if i := strings.LastIndexByte(baseUrl, '/'); i >= 0 {
+		return baseUrl[:i]
+	}
+	return baseUrl
+}
+
+func stringValue(e build.Expr) string {
+	if s, ok := e.(*build.StringExpr); ok {
+		return s.Value
+	}
+	return ""
+}
+
+func stringList(e build.Expr) []string {
+	list, ok := e.(*build.ListExpr)
+	if !ok {
+		return nil
+	}
+	result := make([]string, 0, len(list.List))
+	for _, item := range list.List {
+		if s, ok := item.(*build.StringExpr); ok {
+			result = append(result, s.Value)
+		}
+	}
+	return result
+}
+
+func attrValue(name string, c *build.CallExpr) build.Expr {
+	if attr := getAttr(name, c.List); attr != nil {
+		return attr.RHS
+	}
+	return nil
+}
+
+// lockedPackages finds the packages declared in the conda_environment
+// macros of an existing lock file.
+//
+// The result is keyed by package name and then by platform, where packages
+// shared between all platforms have an empty platform.
+func lockedPackages(file *build.File) map[string]map[string]*lockedPackage {
+	if file == nil {
+		return nil
+	}
+	var body []build.Expr
+	for _, expr := range file.Stmt {
+		if def, ok := expr.(*build.DefStmt); ok && isEnvironmentMacro(def.Name) {
+			body = append(body, def.Body...)
+		}
+	}
+	result := make(map[string]map[string]*lockedPackage)
+	add := func(platform string, pkg *lockedPackage) {
+		name, _, _ := splitDistName(pkg.DistName)
+		if result[name] == nil {
+			result[name] = make(map[string]*lockedPackage, 1)
+		}
+		result[name][platform] = pkg
+	}
+	for _, expr := range body {
+		c, ok := expr.(*build.CallExpr)
+		if !ok || buildutil.Ident(c.X) != "conda_package_repository" {
+			continue
+		}
+		if dist := stringValue(attrValue("dist_name", c)); dist != "" {
+			urls := stringList(attrValue("base_urls", c))
+			if len(urls) == 0 {
+				if url := stringValue(attrValue("base_url", c)); url != "" {
+					urls = []string{url}
+				}
+			}
+			add("", &lockedPackage{
+				DistName: dist,
+				BaseUrls: urls,
+				Sha256:   stringValue(attrValue("sha256", c)),
+			})
+		}
+		dists, _ := attrValue("platform_dist_names", c).(*build.DictExpr)
+		if dists == nil {
+			continue
+		}
+		urls, _ := attrValue("platform_base_urls", c).(*build.DictExpr)
+		shas, _ := attrValue("platform_sha256", c).(*build.DictExpr)
+		for _, kv := range dists.List {
+			p := stringValue(kv.Key)
+			if p == "" {
+				continue
+			}
+			add(p, &lockedPackage{
+				DistName: stringValue(kv.Value),
+				BaseUrls: stringList(dictValue(urls, p)),
+				Sha256:   stringValue(dictValue(shas, p)),
+			})
+		}
+	}
+	return result
+}
+
+// newPackages returns the packages for a spec, keyed by platform, in the
+// same form as lockedPackages.
+func (spec *PkgSpec) newPackages() map[string]*lockedPackage {
+	if len(spec.Platforms) == 0 {
+		return map[string]*lockedPackage{
+			"": {
+				DistName: spec.DistName,
+				BaseUrls: spec.baseUrls(),
+				Sha256:   spec.Sha256,
+			},
+		}
+	}
+	result := make(map[string]*lockedPackage, len(spec.Platforms))
+	for p, pspec := range spec.Platforms {
+		result[p] = &lockedPackage{
+			DistName: pspec.DistName,
+			BaseUrls: pspec.baseUrls(),
+			Sha256:   pspec.Sha256,
+		}
+	}
+	return result
+}
+
+// diffLock computes the changes between an existing lock and the new specs.
+func diffLock(old map[string]map[string]*lockedPackage,
+	specs map[string]*PkgSpec) *lockDiff {
+	names := make(map[string]struct{}, len(old)+len(specs))
+	for name := range old {
+		names[name] = struct{}{}
+	}
+	for name := range specs {
+		names[name] = struct{}{}
+	}
+	diff := lockDiff{
+		Summary: make(map[string]int),
+		Changes: []lockChange{},
+	}
+	for name := range names {
+		var newPkgs map[string]*lockedPackage
+		if spec := specs[name]; spec != nil {
+			newPkgs = spec.newPackages()
+		}
+		oldPkgs := old[name]
+		platforms := make(map[string]struct{}, len(oldPkgs)+len(newPkgs))
+		for p := range oldPkgs {
+			platforms[p] = struct{}{}
+		}
+		for p := range newPkgs {
+			platforms[p] = struct{}{}
+		}
+		if len(platforms) > 1 {
+			// Shared packages are compared against each platform.
+			delete(platforms, "")
+		}
+		for p := range platforms {
+			oldPkg, newPkg := oldPkgs[p], newPkgs[p]
+			if oldPkg == nil {
+				oldPkg = oldPkgs[""]
+			}
+			if newPkg == nil {
+				newPkg = newPkgs[""]
+			}
+			if change := comparePackages(name, p, oldPkg, newPkg); change != nil {
+				diff.Summary[change.Change]++
+				diff.Changes = append(diff.Changes, *change)
+			}
+		}
+	}
+	sort.Slice(diff.Changes, func(i, j int) bool {
+		a, b := &diff.Changes[i], &diff.Changes[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Platform < b.Platform
+	})
+	return &diff
+}
+
+// comparePackages returns the change between two versions of a package, or
+// nil if it is unchanged.
+func comparePackages(name, platform string, oldPkg, newPkg *lockedPackage) *lockChange {
+	change := lockChange{
+		Name:     name,
+		Platform: platform,
+	}
+	if oldPkg != nil {
+		_, change.OldVersion, change.OldBuild = splitDistName(oldPkg.DistName)
+	}
+	if newPkg != nil {
+		_, change.NewVersion, change.NewBuild = splitDistName(newPkg.DistName)
+	}
+	switch {
+	case oldPkg == nil && newPkg == nil:
+		return nil
+	case oldPkg == nil:
+		change.Change = changeAdded
+		return &change
+	case newPkg == nil:
+		change.Change = changeRemoved
+		return &change
+	}
+	if len(newPkg.BaseUrls) > 0 {
+		newChannel := channelOf(newPkg.BaseUrls[0])
+		moved := true
+		for _, url := range oldPkg.BaseUrls {
+			if channelOf(url) == newChannel {
+				moved = false
+				break
+			}
+		}
+		if moved && len(oldPkg.BaseUrls) > 0 {
+			change.OldChannel = channelOf(oldPkg.BaseUrls[0])
+			change.NewChannel = newChannel
+		}
+	}
+	oldVer, newVer := parseVersion(change.OldVersion), parseVersion(change.NewVersion)
+	switch c := oldVer.compare(&newVer); {
+	case c < 0:
+		change.Change = changeUpgraded
+	case c > 0:
+		change.Change = changeDowngraded
+	case change.OldBuild != change.NewBuild ||
+		oldPkg.Sha256 != "" && newPkg.Sha256 != "" && oldPkg.Sha256 != newPkg.Sha256:
+		change.Change = changeRebuilt
+	case change.NewChannel != "":
+		change.Change = changeMoved
+	default:
+		return nil
+	}
+	return &change
+}
+
+// print writes the changes as a table.
+func (diff *lockDiff) print(w io.Writer) error {
+	if len(diff.Changes) == 0 {
+		_, err := fmt.Fprintln(w, "No changes to locked packages.")
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHANGE\tPACKAGE\tOLD\tNEW\tCHANNEL")
+	for _, c := range diff.Changes {
+		name := c.Name
+		if c.Platform != "" {
+			name += " (" + c.Platform + ")"
+		}
+		var channel string
+		if c.NewChannel != "" {
+			channel = c.OldChannel + " -> " + c.NewChannel
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			c.Change, name,
+			versionBuild(c.OldVersion, c.OldBuild),
+			versionBuild(c.NewVersion, c.NewBuild),
+			channel)
+	}
+	return tw.Flush()
+}
+
+func versionBuild(version, build string) string {
+	if version == "" && build == "" {
+		return "-"
+	}
+	return version + " " + build
+}
+
+// writeJson writes the changes as json to the given file.
+func (diff *lockDiff) writeJson(fn string) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(diff); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
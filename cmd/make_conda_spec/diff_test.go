@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/10XGenomics/rules_conda/buildutil"
+	"github.com/bazelbuild/buildtools/build"
+)
+
+func lockFile(repos ...*build.CallExpr) *build.File {
+	body := make([]build.Expr, len(repos))
+	for i, r := range repos {
+		body[i] = r
+	}
+	return &build.File{
+		Stmt: []build.Expr{
+			&build.DefStmt{
+				Name:     "conda_environment",
+				Function: build.Function{Body: body},
+			},
+		},
+	}
+}
+
+func TestDiffLock(t *testing.T) {
+	const forge = "https://conda.anaconda.org/conda-forge"
+	old := lockedPackages(lockFile(
+		(&PkgSpec{
+			Name:     "click",
+			DistName: "click-8.1.6-unix_pyh707e725_0",
+			BaseUrl:  forge + "/noarch",
+		}).repoRule("conda_package_click", nil),
+		(&PkgSpec{
+			Name:     "libzlib",
+			DistName: "libzlib-1.3.1-h4ab18f5_1",
+			BaseUrl:  forge + "/linux-64",
+			Sha256:   "aaa",
+		}).repoRule("conda_package_libzlib", nil),
+		(&PkgSpec{
+			Name:     "numpy",
+			DistName: "numpy-1.26.4-py311h64a7726_0",
+			BaseUrl:  forge + "/linux-64",
+		}).repoRule("conda_package_numpy", nil),
+		(&PkgSpec{
+			Name:     "python",
+			DistName: "python-3.11.8-hab00c5b_0_cpython",
+			BaseUrl:  forge + "/linux-64",
+		}).repoRule("conda_package_python", nil),
+		&build.CallExpr{
+			X: &build.Ident{Name: "conda_package_repository"},
+			List: []build.Expr{
+				buildutil.StrAttr("name", "conda_package_zstd"),
+				buildutil.StrAttr("dist_name", "zstd-1.5.6-ha6fb4c9_0"),
+			},
+		},
+	))
+	specs := map[string]*PkgSpec{
+		"click": {
+			Name:     "click",
+			DistName: "click-8.1.7-unix_pyh707e725_0",
+			BaseUrl:  forge + "/noarch",
+		},
+		"libzlib": {
+			Name:     "libzlib",
+			DistName: "libzlib-1.3.1-h4ab18f5_1",
+			BaseUrl:  forge + "/linux-64",
+			Sha256:   "bbb",
+		},
+		"numpy": {
+			Name:     "numpy",
+			DistName: "numpy-1.26.4-py311h64a7726_0",
+			BaseUrl:  "https://repo.anaconda.com/pkgs/main/linux-64",
+		},
+		"python": {
+			Name:     "python",
+			DistName: "python-3.10.14-hd12c33a_0_cpython",
+			BaseUrl:  forge + "/linux-64",
+		},
+		"tzdata": {
+			Name:     "tzdata",
+			DistName: "tzdata-2024a-h0c530f3_0",
+			BaseUrl:  forge + "/noarch",
+		},
+	}
+	diff := diffLock(old, specs)
+	var changes []string
+	for _, c := range diff.Changes {
+		changes = append(changes, c.Name+":"+c.Change)
+	}
+	if s := strings.Join(changes, ","); s != "click:upgraded,"+
+		"libzlib:rebuilt,numpy:moved,python:downgraded,"+
+		"tzdata:added,zstd:removed" {
+		t.Errorf("unexpected changes %s", s)
+	}
+	if diff.Summary[changeAdded] != 1 || diff.Summary[changeUpgraded] != 1 {
+		t.Errorf("unexpected summary %v", diff.Summary)
+	}
+	if c := diff.Changes[2]; c.OldChannel != forge ||
+		c.NewChannel != "https://repo.anaconda.com/pkgs/main" {
+		t.Errorf("unexpected channel move %s -> %s", c.OldChannel, c.NewChannel)
+	}
+	var buf bytes.Buffer
+	if err := diff.print(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "8.1.6 unix_pyh707e725_0") {
+		t.Errorf("unexpected table:\n%s", buf.String())
+	}
+}
+
+func TestDiffLockPlatforms(t *testing.T) {
+	old := lockedPackages(lockFile(
+		(&PkgSpec{
+			Name:     "python",
+			DistName: "python-3.11.8-hab00c5b_0_cpython",
+			BaseUrl:  "https://conda.anaconda.org/conda-forge/linux-64",
+		}).repoRule("conda_package_python", nil),
+	))
+	specs := map[string]*PkgSpec{
+		"python": {
+			Name: "python",
+			Platforms: map[string]*PkgSpec{
+				"linux-64": {
+					DistName: "python-3.11.8-hab00c5b_0_cpython",
+					BaseUrl:  "https://conda.anaconda.org/conda-forge/linux-64",
+				},
+				"linux-aarch64": {
+					DistName: "python-3.11.8-h43d1f9e_0_cpython",
+					BaseUrl:  "https://conda.anaconda.org/conda-forge/linux-aarch64",
+				},
+			},
+		},
+	}
+	diff := diffLock(old, specs)
+	if len(diff.Changes) != 1 {
+		t.Fatalf("expected 1 change, got %v", diff.Changes)
+	}
+	if c := diff.Changes[0]; c.Platform != "linux-aarch64" || c.Change != changeRebuilt {
+		t.Errorf("unexpected change %v", c)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// The parts of a conda environment.yml file used for solving.
+type environmentFile struct {
+	// The channels listed by the file.
+	Channels []string
+	// The channels named by channel::package dependencies which are not
+	// listed in Channels.
+	PinChannels  []string
+	Dependencies []string
+}
+
+// readEnvironment reads a conda environment.yml file.  If the file is not
+// an environment file, nil is returned.
+func readEnvironment(fn string) (*environmentFile, error) {
+	switch filepath.Ext(fn) {
+	case ".yml", ".yaml":
+	default:
+		return nil, nil
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := parseYaml(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	top, _ := doc.(map[string]any)
+	deps, ok := top["dependencies"].([]any)
+	if !ok {
+		return nil, nil
+	}
+	var env environmentFile
+	channels, _ := top["channels"].([]any)
+	for _, c := range channels {
+		// nodefaults only has meaning to conda's channel configuration.
+		if c := yamlString(c); c != "" && c != "nodefaults" {
+			env.Channels = append(env.Channels, c)
+		}
+	}
+	for _, d := range deps {
+		switch d := d.(type) {
+		case string:
+			spec, err := ParseMatchSpec(d)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", fn, err)
+			}
+			if spec.Channel != "" {
+				env.addChannel(spec.Channel)
+			}
+			env.Dependencies = append(env.Dependencies, d)
+		case map[string]any:
+			for key, value := range d {
+				if key != "pip" {
+					return nil, fmt.Errorf("%s: unexpected dependency section %q", fn, key)
+				}
+				pip, _ := value.([]any)
+				fmt.Fprintln(os.Stderr, "WARNING: ignoring", len(pip),
+					"pip dependencies in", fn)
+			}
+		}
+	}
+	return &env, nil
+}
+
+// addChannel adds the channel of a pinned dependency, if it is not already
+// present.
+func (env *environmentFile) addChannel(channel string) {
+	if slices.Contains(env.Channels, channel) ||
+		slices.Contains(env.PinChannels, channel) {
+		return
+	}
+	env.PinChannels = append(env.PinChannels, channel)
+}
+
+// channels returns the channels from which to solve the environment: those
+// listed by the file, or the given defaults if it lists none, followed by
+// the channels of any pinned dependencies.
+func (env *environmentFile) channels(defaults []string) []string {
+	channels := env.Channels
+	if len(channels) == 0 {
+		channels = defaults
+	}
+	result := slices.Clip(channels)
+	for _, c := range env.PinChannels {
+		if !slices.Contains(result, c) {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// writeRequirements writes the dependencies to a temporary file in the
+// format accepted by `conda create --file`, and returns its name.
+func (env *environmentFile) writeRequirements() (string, error) {
+	f, err := os.CreateTemp("", "requirements*.txt")
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.WriteString(strings.Join(env.Dependencies, "\n") + "\n"); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
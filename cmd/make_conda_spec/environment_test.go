@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadEnvironment(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "environment.yml")
+	if err := os.WriteFile(fn, []byte(`name: test
+channels:
+  - conda-forge
+  - nodefaults
+dependencies:
+  - python 3.11.*
+  - bioconda::samtools >=1.19
+  - pip
+  - pip:
+    - requests
+`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	env, err := readEnvironment(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env == nil {
+		t.Fatal("expected an environment file")
+	}
+	if c := strings.Join(env.Channels, ","); c != "conda-forge" {
+		t.Errorf("unexpected channels %s", c)
+	}
+	if c := strings.Join(env.channels([]string{"defaults"}), ","); c != "conda-forge,bioconda" {
+		t.Errorf("unexpected effective channels %s", c)
+	}
+	// Pinned channels are added to the defaults when the file lists none.
+	env.Channels = nil
+	defaults := []string{"conda-forge", "defaults"}
+	if c := strings.Join(env.channels(defaults), ","); c != "conda-forge,defaults,bioconda" {
+		t.Errorf("unexpected effective channels %s", c)
+	}
+	if len(defaults) != 2 {
+		t.Errorf("defaults were modified: %v", defaults)
+	}
+	if d := strings.Join(env.Dependencies, ","); d !=
+		"python 3.11.*,bioconda::samtools >=1.19,pip" {
+		t.Errorf("unexpected dependencies %s", d)
+	}
+	reqs, err := env.writeRequirements()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(reqs)
+	specs, err := readRequirements(reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 3 || specs[1].Channel != "bioconda" {
+		t.Errorf("unexpected requirements %v", specs)
+	}
+}
+
+func TestReadEnvironmentLock(t *testing.T) {
+	if env, err := readEnvironment("testdata/lockfiles/conda-lock.yml"); err != nil {
+		t.Error(err)
+	} else if env != nil {
+		t.Error("lock file read as an environment file")
+	}
+}
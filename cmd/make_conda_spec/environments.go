@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/10XGenomics/rules_conda/buildutil"
+	"github.com/bazelbuild/buildtools/build"
+)
+
+// The name of the macro for the primary environment.  Additional
+// environments use this name with a suffix, e.g. conda_environment_dev.
+const primaryMacro = "conda_environment"
+
+// A conda environment macro in the lock file.
+type lockEnvironment struct {
+	// The suffix of the macro name, or empty for the primary environment.
+	name string
+	// The requirements file from which the environment is solved.
+	requirements string
+	// The requirements file given to the solver, which differs from
+	// requirements if that is an environment file.
+	solverRequirements string
+	// The channels from which the environment is solved.
+	channels []string
+	// The packages in the environment, merged across platforms.
+	specs map[string]*PkgSpec
+	// The packages whose repositories are declared by the macro of an
+	// earlier environment.
+	declared map[string]struct{}
+	// The packages which are used by more than one environment.
+	shared map[string]struct{}
+	// Aliases to add for the PyPI names of the packages, or nil if they
+	// are not generated.
+	aliases map[string]string
+	// The packages detected to be executable, or nil if they are not
+	// detected.
+	executables []string
+	// The packages which could not be checked for executables, since they
+	// have not been extracted in the package cache.
+	unchecked []string
+}
+
+// macro returns the name of the macro which declares the environment.
+func (env *lockEnvironment) macro() string {
+	if env.name == "" {
+		return primaryMacro
+	}
+	return primaryMacro + "_" + env.name
+}
+
+// repo returns the default name of the environment repository.
+func (env *lockEnvironment) repo() string {
+	if env.name == "" {
+		return buildutil.DefaultCondaRepo
+	}
+	return buildutil.DefaultCondaRepo + "_" + env.name
+}
+
+// isEnvironmentMacro returns true if the name is that of a macro for the
+// primary or an additional environment.
+func isEnvironmentMacro(name string) bool {
+	return name == primaryMacro || strings.HasPrefix(name, primaryMacro+"_")
+}
+
+// parseEnvironments parses a comma-separated list of name=requirements
+// pairs, each naming an additional environment and the requirements file
+// from which it is solved.
+func parseEnvironments(s string) ([]*lockEnvironment, error) {
+	var envs []*lockEnvironment
+	seen := make(map[string]struct{})
+	for _, item := range splitList(s) {
+		name, requirements, ok := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		requirements = strings.TrimSpace(requirements)
+		if !ok || requirements == "" {
+			return envs, fmt.Errorf(
+				"environment %q must be given as name=requirements", item)
+		}
+		if name == "" || strings.Trim(name,
+			"abcdefghijklmnopqrstuvwxyz0123456789_") != "" {
+			return envs, fmt.Errorf(
+				"environment name %q must consist of lower case letters, "+
+					"digits and underscores", name)
+		}
+		if _, ok := seen[name]; ok {
+			return envs, fmt.Errorf("environment %s is given more than once", name)
+		}
+		seen[name] = struct{}{}
+		envs = append(envs, &lockEnvironment{
+			name:         name,
+			requirements: requirements,
+		})
+	}
+	return envs, nil
+}
+
+// sameSpec returns true if the packages are locked to the same archives on
+// every platform, so they can share a repository.
+func sameSpec(a, b *PkgSpec) bool {
+	if !a.sameArchive(b) || len(a.Platforms) != len(b.Platforms) {
+		return false
+	}
+	for p, pa := range a.Platforms {
+		if pb := b.Platforms[p]; pb == nil || !pa.sameArchive(pb) {
+			return false
+		}
+	}
+	return true
+}
+
+// describeSpec returns the dist name of the package, or the dist name on
+// each platform if it differs between platforms.
+func describeSpec(spec *PkgSpec) string {
+	if len(spec.Platforms) == 0 {
+		return spec.DistName
+	}
+	dists := make([]string, 0, len(spec.Platforms))
+	for _, p := range spec.platformNames() {
+		dists = append(dists, p+":"+spec.Platforms[p].DistName)
+	}
+	return strings.Join(dists, ",")
+}
+
+// shareRepositories assigns the repository for each package to the macro of
+// the first environment which uses it, so that packages used by several
+// environments are declared only once.  It returns an error listing any
+// packages which resolve to different builds in different environments,
+// since those cannot share a repository.
+func shareRepositories(envs []*lockEnvironment) error {
+	owners := make(map[string]*lockEnvironment)
+	var conflicts []string
+	for _, env := range envs {
+		env.declared = make(map[string]struct{})
+		env.shared = make(map[string]struct{})
+		names := make([]string, 0, len(env.specs))
+		for name := range env.specs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			owner := owners[name]
+			if owner == nil {
+				owners[name] = env
+				continue
+			}
+			env.declared[name] = struct{}{}
+			env.shared[name] = struct{}{}
+			owner.shared[name] = struct{}{}
+			if spec := env.specs[name]; !sameSpec(owner.specs[name], spec) {
+				conflicts = append(conflicts, fmt.Sprintf(
+					"%s: %s in %s, but %s in %s",
+					name, describeSpec(owner.specs[name]), owner.macro(),
+					describeSpec(spec), env.macro()))
+			}
+		}
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("packages resolve to different builds in different "+
+			"environments, so they cannot share a repository.  Pin them in "+
+			"the requirements to make them consistent:\n  %s",
+			strings.Join(conflicts, "\n  "))
+	}
+	return nil
+}
+
+// unionSpecs returns the packages of every environment.
+func unionSpecs(envs []*lockEnvironment) map[string]*PkgSpec {
+	if len(envs) == 1 {
+		return envs[0].specs
+	}
+	specs := make(map[string]*PkgSpec)
+	for _, env := range envs {
+		for name, spec := range env.specs {
+			if _, ok := specs[name]; !ok {
+				specs[name] = spec
+			}
+		}
+	}
+	return specs
+}
+
+// declaresEnvironment returns true if the macro calls
+// conda_environment_repository, rather than being written by hand.
+func declaresEnvironment(def *build.DefStmt) bool {
+	for _, expr := range def.Body {
+		if c, ok := expr.(*build.CallExpr); ok &&
+			buildutil.Ident(c.X) == "conda_environment_repository" {
+			return true
+		}
+	}
+	return false
+}
+
+// removeStaleEnvironments removes the macros for additional environments
+// which are no longer requested.
+func removeStaleEnvironments(file *build.File, envs []*lockEnvironment) {
+	macros := make(map[string]struct{}, len(envs))
+	for _, env := range envs {
+		macros[env.macro()] = struct{}{}
+	}
+	stmts := file.Stmt[:0]
+	for _, expr := range file.Stmt {
+		if def, ok := expr.(*build.DefStmt); ok && isEnvironmentMacro(def.Name) {
+			if _, ok := macros[def.Name]; !ok && declaresEnvironment(def) {
+				fmt.Fprintln(os.Stderr, "Removing", def.Name,
+					"since the environment is no longer requested.")
+				continue
+			}
+		}
+		stmts = append(stmts, expr)
+	}
+	file.Stmt = stmts
+}
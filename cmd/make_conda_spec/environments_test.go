@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/10XGenomics/rules_conda/buildutil"
+	"github.com/bazelbuild/buildtools/build"
+)
+
+func TestParseEnvironments(t *testing.T) {
+	envs, err := parseEnvironments("dev=requirements-dev.txt, docs = docs/environment.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(envs) != 2 ||
+		envs[0].macro() != "conda_environment_dev" ||
+		envs[0].repo() != "conda_env_dev" ||
+		envs[1].requirements != "docs/environment.yml" {
+		t.Errorf("unexpected environments %+v", envs)
+	}
+	for _, bad := range []string{
+		"dev",
+		"dev=",
+		"Dev=requirements.txt",
+		"dev=a.txt,dev=b.txt",
+	} {
+		if _, err := parseEnvironments(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestShareRepositories(t *testing.T) {
+	python := &PkgSpec{Name: "python", DistName: "python-3.12.3-h0", Sha256: "a"}
+	pytest := &PkgSpec{Name: "pytest", DistName: "pytest-8.2.0-pyhd8ed1ab_0",
+		Sha256: "b", Depends: []string{"python", "pluggy"}}
+	pluggy := &PkgSpec{Name: "pluggy", DistName: "pluggy-1.5.0-pyhd8ed1ab_0", Sha256: "c"}
+	primary := &lockEnvironment{specs: map[string]*PkgSpec{"python": python}}
+	dev := &lockEnvironment{name: "dev", specs: map[string]*PkgSpec{
+		"python": python,
+		"pytest": pytest,
+		"pluggy": pluggy,
+	}}
+	test := &lockEnvironment{name: "test", specs: map[string]*PkgSpec{
+		"python": python,
+		"pytest": pytest,
+		"pluggy": pluggy,
+	}}
+	envs := []*lockEnvironment{primary, dev, test}
+	if err := shareRepositories(envs); err != nil {
+		t.Fatal(err)
+	}
+	if len(primary.declared) != 0 || len(primary.shared) != 1 {
+		t.Errorf("unexpected primary environment %+v", primary)
+	}
+	if _, ok := dev.declared["pytest"]; ok || len(dev.declared) != 1 || len(dev.shared) != 3 {
+		t.Errorf("unexpected dev environment %+v", dev)
+	}
+	if len(test.declared) != 3 {
+		t.Errorf("unexpected test environment %+v", test)
+	}
+	if len(unionSpecs(envs)) != 3 {
+		t.Errorf("unexpected union %v", unionSpecs(envs))
+	}
+
+	// Render the macros for the environments.
+	file := &build.File{Path: "conda_env.bzl", Type: build.TypeBzl}
+	for _, env := range envs {
+		addSpecFunc(env, nil, []string{"linux-64"}, file)
+	}
+	defs := make(map[string]*build.DefStmt)
+	for _, expr := range file.Stmt {
+		if def, ok := expr.(*build.DefStmt); ok {
+			defs[def.Name] = def
+		}
+	}
+	repos := func(def *build.DefStmt) string {
+		var names []string
+		for _, e := range def.Body {
+			if rn := repoCallName(e); rn != "" {
+				names = append(names, rn)
+				if attr := getAttr("shared", e.(*build.CallExpr).List); attr == nil {
+					if _, ok := dev.shared[strings.TrimPrefix(rn, "conda_package_")]; ok {
+						t.Errorf("%s is not marked as shared", rn)
+					}
+				}
+			}
+		}
+		return strings.Join(names, ",")
+	}
+	if got := repos(defs["conda_environment"]); got != "conda_package_python" {
+		t.Errorf("unexpected primary repositories %s", got)
+	}
+	if got := repos(defs["conda_environment_dev"]); got !=
+		"conda_package_pluggy,conda_package_pytest" {
+		t.Errorf("unexpected dev repositories %s", got)
+	}
+	if got := repos(defs["conda_environment_test"]); got != "" {
+		t.Errorf("unexpected test repositories %s", got)
+	}
+	devDef := defs["conda_environment_dev"]
+	if name := stringValue(getAttr("name", devDef.Params).RHS); name != "conda_env_dev" {
+		t.Errorf("unexpected default repository name %s", name)
+	}
+	last := devDef.Body[len(devDef.Body)-1].(*build.CallExpr)
+	if buildutil.Ident(last.X) != "conda_environment_repository" {
+		t.Errorf("expected no toolchain registration, got %s", buildutil.Ident(last.X))
+	}
+	if pkgs := stringList(getAttr("conda_packages", last.List).RHS); len(pkgs) != 3 {
+		t.Errorf("unexpected dev packages %v", pkgs)
+	}
+
+	removeStaleEnvironments(file, envs[:2])
+	if len(file.Stmt) != 2 {
+		t.Errorf("expected the test environment to be removed")
+	}
+
+	// The test environment gets a different build of pytest.
+	test.specs["pytest"] = &PkgSpec{Name: "pytest",
+		DistName: "pytest-8.1.1-pyhd8ed1ab_0", Sha256: "d"}
+	err := shareRepositories(envs)
+	if err == nil || !strings.Contains(err.Error(),
+		"pytest: pytest-8.2.0-pyhd8ed1ab_0 in conda_environment_dev, "+
+			"but pytest-8.1.1-pyhd8ed1ab_0 in conda_environment_test") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+
+	"github.com/10XGenomics/rules_conda/buildutil"
+	"github.com/bazelbuild/buildtools/build"
+)
+
+// The comment on entries of executable_packages and aliases which were
+// added by -detect_executables or -pip_aliases, rather than by hand.
+const detectedComment = "# detected"
+
+func readInfoJson(pkgDir, distName, fn string, v any) bool {
+	b, err := os.ReadFile(filepath.Join(pkgDir, distName, "info", fn))
+	return err == nil && json.Unmarshal(b, v) == nil
+}
+
+// isExecutablePackage returns true if the extracted package in the package
+// cache directory declares an app entry point or python entry points, or
+// provides an executable named for the package.
+func isExecutablePackage(pkgDir, distName, name string) bool {
+	var index struct {
+		AppEntry string `json:"app_entry"`
+	}
+	if readInfoJson(pkgDir, distName, "index.json", &index) && index.AppEntry != "" {
+		return true
+	}
+	var link struct {
+		Noarch struct {
+			EntryPoints []string `json:"entry_points"`
+		} `json:"noarch"`
+	}
+	if readInfoJson(pkgDir, distName, "link.json", &link) &&
+		len(link.Noarch.EntryPoints) > 0 {
+		return true
+	}
+	var paths struct {
+		Paths []struct {
+			Path string `json:"_path"`
+		} `json:"paths"`
+	}
+	if readInfoJson(pkgDir, distName, "paths.json", &paths) {
+		for _, p := range paths.Paths {
+			if p.Path == "bin/"+name || p.Path == "Scripts/"+name+".exe" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// detectExecutables returns the sorted names of the packages which are
+// executable on any platform, as far as can be told from the packages
+// extracted in the package cache directory, and the sorted names of the
+// packages which could not be checked because they have not been extracted
+// there.
+func detectExecutables(specs map[string]*PkgSpec, pkgDir string) ([]string, []string) {
+	executables := make([]string, 0)
+	var unchecked []string
+	for name, spec := range specs {
+		found := false
+		for _, dist := range specDists(spec) {
+			if !isExtracted(pkgDir, dist) {
+				continue
+			}
+			found = true
+			if isExecutablePackage(pkgDir, dist, name) {
+				executables = append(executables, name)
+				break
+			}
+		}
+		if !found {
+			unchecked = append(unchecked, name)
+		}
+	}
+	sort.Strings(executables)
+	sort.Strings(unchecked)
+	return executables, unchecked
+}
+
+func isDetected(e build.Expr) bool {
+	for _, c := range e.Comment().Suffix {
+		if c.Token == detectedComment {
+			return true
+		}
+	}
+	return false
+}
+
+// updateExecutables adds the detected packages to the executable_packages
+// of the conda_environment_repository call, marking them as detected.
+// Previously detected entries are removed unless the package is still
+// detected, or could not be checked, while entries added by hand are left
+// untouched.
+func updateExecutables(c *build.CallExpr, detected, unchecked []string) {
+	var list *build.ListExpr
+	if attr := getAttr("executable_packages", c.List); attr != nil {
+		list, _ = attr.RHS.(*build.ListExpr)
+	}
+	if list == nil {
+		list = &build.ListExpr{ForceMultiLine: true}
+		updateValue("executable_packages", list, c)
+	}
+	present := make(map[string]struct{}, len(list.List)+len(detected))
+	kept := list.List[:0]
+	for _, e := range list.List {
+		name := stringValue(e)
+		if isDetected(e) && !slices.Contains(detected, name) &&
+			!slices.Contains(unchecked, name) {
+			continue
+		}
+		present[name] = struct{}{}
+		kept = append(kept, e)
+	}
+	list.List = kept
+	for _, name := range detected {
+		if _, ok := present[name]; ok {
+			continue
+		}
+		str := buildutil.StrExpr(name)
+		str.Comments.Suffix = []build.Comment{{Token: detectedComment}}
+		// Insert in order, without moving the existing entries.
+		i := 0
+		for i < len(list.List) && stringValue(list.List[i]) < name {
+			i++
+		}
+		list.List = append(list.List, nil)
+		copy(list.List[i+1:], list.List[i:])
+		list.List[i] = str
+		list.ForceMultiLine = true
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/10XGenomics/rules_conda/buildutil"
+	"github.com/bazelbuild/buildtools/build"
+)
+
+func TestDetectExecutables(t *testing.T) {
+	dir := t.TempDir()
+	write := func(fn, content string) {
+		t.Helper()
+		fn = filepath.Join(dir, fn)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("samtools-1.20-h50ea8bc_0/info/paths.json",
+		`{"paths": [{"_path": "bin/samtools"}, {"_path": "share/man/man1/samtools.1"}]}`)
+	write("pytest-8.2.0-pyhd8ed1ab_0/info/link.json",
+		`{"noarch": {"type": "python", "entry_points": ["pytest = pytest:console_main"]}}`)
+	write("libpng-1.6.43-h2797004_0/info/paths.json",
+		`{"paths": [{"_path": "bin/libpng-config"}, {"_path": "lib/libpng.so"}]}`)
+	write("spyder-5.5.1-py312_0/info/index.json", `{"app_entry": "spyder"}`)
+	specs := map[string]*PkgSpec{
+		"samtools": {Name: "samtools", DistName: "samtools-1.20-h50ea8bc_0"},
+		"pytest":   {Name: "pytest", DistName: "pytest-8.2.0-pyhd8ed1ab_0"},
+		"libpng":   {Name: "libpng", DistName: "libpng-1.6.43-h2797004_0"},
+		"spyder":   {Name: "spyder", DistName: "spyder-5.5.1-py312_0"},
+		"zlib":     {Name: "zlib", DistName: "zlib-1.3.1-h0"},
+	}
+	detected, unchecked := detectExecutables(specs, dir)
+	if got := strings.Join(detected, ","); got != "pytest,samtools,spyder" {
+		t.Errorf("unexpected executables %s", got)
+	}
+	if got := strings.Join(unchecked, ","); got != "zlib" {
+		t.Errorf("unexpected unchecked packages %s", got)
+	}
+
+	markDetected := func(name string) *build.StringExpr {
+		str := buildutil.StrExpr(name)
+		str.Comments.Suffix = []build.Comment{{Token: detectedComment}}
+		return str
+	}
+	c := &build.CallExpr{
+		X: &build.Ident{Name: "conda_environment_repository"},
+		List: []build.Expr{
+			buildutil.Attr("executable_packages", buildutil.ListExpr(
+				buildutil.StrExpr("python"),
+				// Gone from the environment.
+				markDetected("oldtool"),
+				buildutil.StrExpr("conda"),
+				// No longer detected as executable.
+				markDetected("libpng"),
+				buildutil.StrExpr("samtools"),
+				// Could not be checked.
+				markDetected("zlib"),
+			)),
+		},
+	}
+	updateExecutables(c, detected, unchecked)
+	var got []string
+	for _, e := range getAttr("executable_packages", c.List).RHS.(*build.ListExpr).List {
+		s := stringValue(e)
+		if isDetected(e) {
+			s += " (detected)"
+		}
+		got = append(got, s)
+	}
+	if strings.Join(got, ",") !=
+		"pytest (detected),python,conda,samtools,spyder (detected),zlib (detected)" {
+		t.Errorf("unexpected executable_packages %v", got)
+	}
+}
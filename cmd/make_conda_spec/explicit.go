@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The line which marks a file as an explicit package list, as produced by
+// `conda list --explicit`.
+const explicitMarker = "@EXPLICIT"
+
+// isExplicit returns true if the file is an explicit package list rather
+// than a requirements file.
+func isExplicit(fn string) (bool, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == explicitMarker {
+			return true, nil
+		}
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return false, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// readExplicit reads an explicit package list, which contains one package
+// URL per line, optionally with a `#sha256:` fragment.
+func readExplicit(fn, arch string, excludeList []string) (map[string]*PkgSpec, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	specs := make(map[string]*PkgSpec)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if p, ok := strings.CutPrefix(text, "# platform:"); ok {
+			if p = strings.TrimSpace(p); p != arch {
+				fmt.Fprintf(os.Stderr,
+					"WARNING: %s is for platform %s, not %s\n",
+					fn, p, arch)
+			}
+			continue
+		}
+		if text == "" || text == explicitMarker || strings.HasPrefix(text, "#") {
+			continue
+		}
+		spec, err := parseExplicitUrl(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", fn, line, err)
+		}
+		// Explicit package lists do not record dependencies.
+		spec.dependsUnknown = true
+		specs[spec.Name] = spec
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, e := range excludeList {
+		delete(specs, e)
+	}
+	return specs, nil
+}
+
+func parseExplicitUrl(text string) (*PkgSpec, error) {
+	url, hash, _ := strings.Cut(text, "#")
+	i := strings.LastIndexByte(url, '/')
+	if i < 0 {
+		return nil, fmt.Errorf("invalid package url %q", url)
+	}
+	fileName := url[i+1:]
+	dist, ok := strings.CutSuffix(fileName, ".conda")
+	if !ok {
+		if dist, ok = strings.CutSuffix(fileName, ".tar.bz2"); !ok {
+			return nil, fmt.Errorf("unknown archive type for %q", url)
+		}
+	}
+	name, version, build := splitDistName(dist)
+	if version == "" {
+		return nil, fmt.Errorf("could not parse package name %q", dist)
+	}
+	spec := &PkgSpec{
+		Name:     name,
+		DistName: dist,
+		Version:  version,
+		Build:    build,
+		BaseUrl:  url[:i],
+		Url:      url,
+		Platform: path.Base(url[:i]),
+	}
+	if sha, ok := strings.CutPrefix(hash, "sha256:"); ok {
+		spec.Sha256 = sha
+	} else if md, ok := strings.CutPrefix(hash, "md5:"); ok {
+		spec.Md5 = md
+	} else if len(hash) == 64 {
+		spec.Sha256 = hash
+	} else if len(hash) == 32 {
+		spec.Md5 = hash
+	}
+	return spec, nil
+}
+
+// url returns the download URL for the package.
+func (spec *PkgSpec) url() string {
+	if spec.Url != "" {
+		return spec.Url
+	}
+	return spec.BaseUrl + "/" + spec.DistName + ".tar.bz2"
+}
+
+// writeExplicit writes an explicit package list for the given platform,
+// which can be passed to `conda create --file`.
+func writeExplicit(w io.Writer, specs map[string]*PkgSpec, platform string) error {
+	list := make([]*PkgSpec, 0, len(specs))
+	for _, spec := range specs {
+		if p := spec.Platforms; len(p) > 0 {
+			if spec = p[platform]; spec == nil {
+				continue
+			}
+		}
+		list = append(list, spec)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].DistName < list[j].DistName
+	})
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, `# This file may be used to create an environment using:
+# $ conda create --name <env> --file <this file>
+# platform: %s
+%s
+`, platform, explicitMarker)
+	for _, spec := range list {
+		bw.WriteString(spec.downloadUrls()[0])
+		if spec.Sha256 != "" {
+			bw.WriteString("#sha256:")
+			bw.WriteString(spec.Sha256)
+		}
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+// platformFileName returns the name of the output file to write for a
+// platform.  If there is more than one platform, the platform name is added
+// before the extension.
+func platformFileName(fn, platform string, platforms []string) string {
+	if len(platforms) < 2 {
+		return fn
+	}
+	ext := filepath.Ext(fn)
+	return strings.TrimSuffix(fn, ext) + "-" + platform + ext
+}
+
+// writeExplicitFiles writes an explicit package list for each platform.
+func writeExplicitFiles(fn string, specs map[string]*PkgSpec, platforms []string) error {
+	for _, platform := range platforms {
+		f, err := os.Create(platformFileName(fn, platform, platforms))
+		if err != nil {
+			return err
+		}
+		if err := writeExplicit(f, specs, platform); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExplicitRoundTrip(t *testing.T) {
+	specs := map[string]*PkgSpec{
+		"click": {
+			Name:     "click",
+			DistName: "click-8.1.7-unix_pyh707e725_0",
+			BaseUrl:  "https://conda.anaconda.org/conda-forge/noarch",
+			Url:      "https://conda.anaconda.org/conda-forge/noarch/click-8.1.7-unix_pyh707e725_0.conda",
+			Sha256:   "43e91a1d3a7b9e1e7c7d4b55a2ed7a7ca0c1e6bb1cd7b4e1f0b8c8a1e96a8b71",
+		},
+		"python": {
+			Name: "python",
+			Platforms: map[string]*PkgSpec{
+				"linux-64": {
+					Name:     "python",
+					DistName: "python-3.11.8-hab00c5b_0_cpython",
+					BaseUrl:  "https://conda.anaconda.org/conda-forge/linux-64",
+					Sha256:   "d63d1ba6d8f13c4d0b8e1a8e1e0c1b4dbb3f9e5ac4a7e35d7fbc2b1c1f7a3e55",
+				},
+			},
+		},
+	}
+	var buf bytes.Buffer
+	if err := writeExplicit(&buf, specs, "linux-64"); err != nil {
+		t.Fatal(err)
+	}
+	expect := `# This file may be used to create an environment using:
+# $ conda create --name <env> --file <this file>
+# platform: linux-64
+@EXPLICIT
+https://conda.anaconda.org/conda-forge/noarch/click-8.1.7-unix_pyh707e725_0.conda#sha256:43e91a1d3a7b9e1e7c7d4b55a2ed7a7ca0c1e6bb1cd7b4e1f0b8c8a1e96a8b71
+https://conda.anaconda.org/conda-forge/linux-64/python-3.11.8-hab00c5b_0_cpython.tar.bz2#sha256:d63d1ba6d8f13c4d0b8e1a8e1e0c1b4dbb3f9e5ac4a7e35d7fbc2b1c1f7a3e55
+`
+	if buf.String() != expect {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+	fn := filepath.Join(t.TempDir(), "explicit.txt")
+	if err := os.WriteFile(fn, buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := isExplicit(fn); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Error("expected an explicit file")
+	}
+	read, err := readExplicit(fn, "linux-64", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 2 {
+		t.Errorf("expected 2 packages, got %d", len(read))
+	}
+	if py := read["python"]; py == nil {
+		t.Error("missing python")
+	} else if py.Version != "3.11.8" || py.Build != "hab00c5b_0_cpython" ||
+		py.BaseUrl != "https://conda.anaconda.org/conda-forge/linux-64" ||
+		py.Sha256 != specs["python"].Platforms["linux-64"].Sha256 {
+		t.Errorf("unexpected python %+v", py)
+	}
+	if click := read["click"]; click == nil {
+		t.Error("missing click")
+	} else if click.Url != specs["click"].Url || click.Platform != "noarch" {
+		t.Errorf("unexpected click %+v", click)
+	}
+}
+
+func TestIsExplicit(t *testing.T) {
+	reqs := writeRequirements(t, "# @EXPLICIT", "numpy")
+	if ok, err := isExplicit(reqs); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Error("requirements file detected as explicit")
+	}
+}
+
+func TestExplicitMd5Only(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/noarch/ok-1.0-0.conda" {
+				w.Write([]byte("ok"))
+				return
+			}
+			http.NotFound(w, r)
+		}))
+	defer server.Close()
+	fn := writeRequirements(t, "@EXPLICIT",
+		server.URL+"/noarch/ok-1.0-0.conda#444bcb3a3fcf8389296c49467f27e1d6",
+		server.URL+"/noarch/cached-1.0-0.conda#md5:1a79a4d60de6718e8e5b326e338ae533")
+	specs, err := readExplicit(fn, "linux-64", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if specs["ok"].Sha256 != "" || specs["ok"].Md5 != "444bcb3a3fcf8389296c49467f27e1d6" {
+		t.Fatalf("unexpected checksums %+v", specs["ok"])
+	}
+	pkgDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(pkgDir, "cached-1.0-0.conda"),
+		[]byte("example"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := hashLockInput(specs, pkgDir, true); err == nil {
+		t.Error("expected an error while offline")
+	} else if !strings.Contains(err.Error(), "ok-1.0-0") ||
+		strings.Contains(err.Error(), "cached-1.0-0") {
+		t.Errorf("error did not name only the uncached package: %v", err)
+	}
+	if err := hashLockInput(specs, pkgDir, false); err != nil {
+		t.Fatal(err)
+	}
+	if s := specs["ok"].Sha256; s != "2689367b205c16ce32ed4200942b8b8b1e262dfc70d9bc9fbc77c49699a4f1df" {
+		t.Errorf("wrong checksum %s", s)
+	}
+	if s := specs["cached"].Sha256; s != "50d858e0985ecc7f60418aaf0cc5ab587f42c2570a884095a9e8ccacd0f6545c" {
+		t.Errorf("wrong checksum %s", s)
+	}
+	specs["ok"].Sha256 = ""
+	specs["ok"].Md5 = "00000000000000000000000000000000"
+	if err := hashLockInput(specs, pkgDir, false); err == nil ||
+		!strings.Contains(err.Error(), "md5 mismatch") {
+		t.Errorf("expected an md5 mismatch, got %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A dependency of a package in the graph.
+type graphDep struct {
+	Name string `json:"name"`
+	// The dependency as given in the package metadata, including any
+	// version constraint.
+	Spec string `json:"spec"`
+}
+
+// A package in the dependency graph.
+type graphNode struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Build   string `json:"build,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	// The spec from the requirements file, if the package was requested
+	// directly.
+	Requested string     `json:"requested,omitempty"`
+	Depends   []graphDep `json:"depends"`
+}
+
+// The dependency graph of a solved environment for one platform.
+type depGraph struct {
+	Platform string       `json:"platform"`
+	Packages []*graphNode `json:"packages"`
+}
+
+// directRequirements returns the requested spec for each package named in
+// the requirements file.  It returns nil if the requirements are an
+// already-solved package list.
+func directRequirements(requirements string) map[string]string {
+	if requirements == "" {
+		return nil
+	}
+	if specs, err := readLockInput(requirements, "", nil); err != nil || specs != nil {
+		return nil
+	}
+	reqs, err := readRequirements(requirements)
+	if err != nil {
+		return nil
+	}
+	direct := make(map[string]string, len(reqs))
+	for _, r := range reqs {
+		direct[r.Name] = r.String()
+	}
+	return direct
+}
+
+// makeGraph builds the dependency graph for the solved packages.
+func makeGraph(platform string, specs map[string]*PkgSpec,
+	direct map[string]string) *depGraph {
+	g := depGraph{
+		Platform: platform,
+		Packages: make([]*graphNode, 0, len(specs)),
+	}
+	for _, spec := range specs {
+		node := graphNode{
+			Name:      spec.Name,
+			Version:   spec.Version,
+			Build:     spec.Build,
+			Size:      spec.Size,
+			Channel:   spec.Channel,
+			Requested: direct[spec.Name],
+			Depends:   make([]graphDep, 0, len(spec.Depends)),
+		}
+		if node.Build == "" {
+			node.Build = spec.BuildStr
+		}
+		depSpecs := spec.DependSpecs
+		if len(depSpecs) == 0 {
+			depSpecs = spec.Depends
+		}
+		for _, d := range depSpecs {
+			name := d
+			if m, err := ParseMatchSpec(d); err == nil {
+				name = m.Name
+			}
+			node.Depends = append(node.Depends, graphDep{Name: name, Spec: d})
+		}
+		sort.Slice(node.Depends, func(i, j int) bool {
+			return node.Depends[i].Name < node.Depends[j].Name
+		})
+		g.Packages = append(g.Packages, &node)
+	}
+	sort.Slice(g.Packages, func(i, j int) bool {
+		return g.Packages[i].Name < g.Packages[j].Name
+	})
+	return &g
+}
+
+func (g *depGraph) writeJson(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(g)
+}
+
+// writeDot writes the graph in Graphviz DOT format.  Directly requested
+// packages are drawn in bold, and each edge is labeled with its version
+// constraint.  Dependencies which are not in the solution, such as virtual
+// packages, are omitted.
+func (g *depGraph) writeDot(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "digraph %s {\n", strconv.Quote(g.Platform))
+	bw.WriteString("  node [shape=box];\n")
+	present := make(map[string]struct{}, len(g.Packages))
+	for _, node := range g.Packages {
+		present[node.Name] = struct{}{}
+	}
+	for _, node := range g.Packages {
+		label := node.Name + "\n" + node.Version
+		if node.Size > 0 {
+			label += "\n" + formatSize(node.Size)
+		}
+		fmt.Fprintf(bw, "  %s [label=%s", strconv.Quote(node.Name), strconv.Quote(label))
+		if node.Requested != "" {
+			bw.WriteString(", style=bold, color=blue")
+		}
+		bw.WriteString("];\n")
+	}
+	for _, node := range g.Packages {
+		for _, d := range node.Depends {
+			if _, ok := present[d.Name]; !ok {
+				continue
+			}
+			fmt.Fprintf(bw, "  %s -> %s", strconv.Quote(node.Name), strconv.Quote(d.Name))
+			if c := strings.TrimSpace(strings.TrimPrefix(d.Spec, d.Name)); c != "" {
+				fmt.Fprintf(bw, " [label=%s]", strconv.Quote(c))
+			}
+			bw.WriteString(";\n")
+		}
+	}
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+// formatSize formats a size in bytes for display.
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return strconv.FormatInt(size, 10) + " B"
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGT"[exp])
+}
+
+// writeGraphFiles writes the dependency graph for each platform to the
+// given DOT and json files, either of which may be empty.  If there is more
+// than one platform, the platform name is added before the extension.
+func writeGraphFiles(dotFile, jsonFile string, platforms []string,
+	solutions map[string]map[string]*PkgSpec, direct map[string]string) error {
+	for _, platform := range platforms {
+		g := makeGraph(platform, solutions[platform], direct)
+		for _, out := range [...]struct {
+			fn    string
+			write func(io.Writer) error
+		}{
+			{dotFile, g.writeDot},
+			{jsonFile, g.writeJson},
+		} {
+			if out.fn == "" {
+				continue
+			}
+			f, err := os.Create(platformFileName(out.fn, platform, platforms))
+			if err != nil {
+				return err
+			}
+			if err := out.write(f); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDependencyGraph(t *testing.T) {
+	specs := map[string]*PkgSpec{
+		"numpy": {
+			Name:        "numpy",
+			Version:     "1.26.4",
+			Build:       "py311h64a7726_0",
+			Size:        8 * 1024 * 1024,
+			Depends:     []string{"python", "__glibc"},
+			DependSpecs: []string{"python >=3.11,<3.12.0a0", "__glibc >=2.17"},
+		},
+		"python": {
+			Name:    "python",
+			Version: "3.11.8",
+		},
+	}
+	g := makeGraph("linux-64", specs, map[string]string{"numpy": "numpy >=1.26"})
+	if len(g.Packages) != 2 || g.Packages[0].Name != "numpy" {
+		t.Fatalf("unexpected packages %+v", g.Packages)
+	}
+	if d := g.Packages[0].Depends[1]; d.Name != "python" || d.Spec != "python >=3.11,<3.12.0a0" {
+		t.Errorf("unexpected dependency %+v", d)
+	}
+	var buf strings.Builder
+	if err := g.writeDot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	const want = `digraph "linux-64" {
+  node [shape=box];
+  "numpy" [label="numpy\n1.26.4\n8.0 MiB", style=bold, color=blue];
+  "python" [label="python\n3.11.8"];
+  "numpy" -> "python" [label=">=3.11,<3.12.0a0"];
+}
+`
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected dot output:\n%s", got)
+	}
+	buf.Reset()
+	if err := g.writeJson(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"requested": "numpy >=1.26"`) {
+		t.Errorf("requested spec missing from json:\n%s", buf.String())
+	}
+}
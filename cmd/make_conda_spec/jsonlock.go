@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/10XGenomics/rules_conda/buildutil"
+	"github.com/bazelbuild/buildtools/build"
+)
+
+// The name of the variable in a lock file written with -thin which holds
+// the lock data.
+const lockDataVar = "_LOCK_DATA"
+
+// A package in the json lock file.
+type jsonLockPackage struct {
+	Name     string   `json:"name"`
+	Version  string   `json:"version"`
+	Build    string   `json:"build"`
+	DistName string   `json:"dist_name"`
+	Channel  string   `json:"channel"`
+	BaseUrls []string `json:"base_urls"`
+	// The URL of the package archive, from which the archive type can be
+	// determined.
+	Url    string `json:"url"`
+	Sha256 string `json:"sha256"`
+	Md5    string `json:"md5,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	// The dependencies, including version constraints where known.
+	Depends []string `json:"depends"`
+}
+
+// The canonical json form of a lock, with the packages for each platform
+// sorted by name.
+type jsonLock struct {
+	Platforms map[string][]*jsonLockPackage `json:"platforms"`
+}
+
+func makeJsonLock(platforms []string,
+	solutions map[string]map[string]*PkgSpec) *jsonLock {
+	data := jsonLock{
+		Platforms: make(map[string][]*jsonLockPackage, len(platforms)),
+	}
+	for _, platform := range platforms {
+		specs := solutions[platform]
+		pkgs := make([]*jsonLockPackage, 0, len(specs))
+		for _, spec := range specs {
+			pkg := jsonLockPackage{
+				Name:     spec.Name,
+				Version:  spec.Version,
+				Build:    spec.Build,
+				DistName: spec.DistName,
+				Channel:  spec.Channel,
+				BaseUrls: spec.baseUrls(),
+				Url:      spec.downloadUrls()[0],
+				Sha256:   spec.Sha256,
+				Md5:      spec.Md5,
+				Size:     spec.Size,
+				Depends:  spec.DependSpecs,
+			}
+			if pkg.Build == "" {
+				pkg.Build = spec.BuildStr
+			}
+			if len(pkg.Depends) == 0 {
+				pkg.Depends = spec.Depends
+			}
+			if pkg.Depends == nil {
+				pkg.Depends = []string{}
+			}
+			pkgs = append(pkgs, &pkg)
+		}
+		sort.Slice(pkgs, func(i, j int) bool {
+			return pkgs[i].Name < pkgs[j].Name
+		})
+		data.Platforms[platform] = pkgs
+	}
+	return &data
+}
+
+func (data *jsonLock) render() ([]byte, error) {
+	b, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+func (data *jsonLock) write(fn string) error {
+	b, err := data.render()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fn, b, 0666)
+}
+
+// readJsonLock reads an existing json lock file.  It returns nil if the
+// file does not exist.
+func readJsonLock(fn string) (*jsonLock, error) {
+	b, err := os.ReadFile(fn)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var data jsonLock
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// lockedPackages returns the packages in the same form as the
+// lockedPackages function returns for a .bzl lock file, where packages
+// which are the same on every platform have an empty platform.
+func (data *jsonLock) lockedPackages() map[string]map[string]*lockedPackage {
+	result := make(map[string]map[string]*lockedPackage)
+	for platform, pkgs := range data.Platforms {
+		for _, pkg := range pkgs {
+			if result[pkg.Name] == nil {
+				result[pkg.Name] = make(map[string]*lockedPackage, len(data.Platforms))
+			}
+			result[pkg.Name][platform] = &lockedPackage{
+				DistName: pkg.DistName,
+				BaseUrls: pkg.BaseUrls,
+				Sha256:   pkg.Sha256,
+			}
+		}
+	}
+	for _, byPlatform := range result {
+		if len(byPlatform) != len(data.Platforms) {
+			continue
+		}
+		var first *lockedPackage
+		shared := true
+		for _, pkg := range byPlatform {
+			if first == nil {
+				first = pkg
+			} else if pkg.DistName != first.DistName ||
+				pkg.Sha256 != first.Sha256 ||
+				!slices.Equal(pkg.BaseUrls, first.BaseUrls) {
+				shared = false
+				break
+			}
+		}
+		if shared {
+			clear(byPlatform)
+			byPlatform[""] = first
+		}
+	}
+	return result
+}
+
+// jsonExpr converts a value decoded from json to the equivalent Starlark
+// expression.
+func jsonExpr(v any) build.Expr {
+	switch v := v.(type) {
+	case string:
+		return buildutil.StrExpr(v)
+	case float64:
+		return &build.LiteralExpr{Token: strconv.FormatFloat(v, 'f', -1, 64)}
+	case bool:
+		if v {
+			return &build.Ident{Name: "True"}
+		}
+		return &build.Ident{Name: "False"}
+	case []any:
+		list := &build.ListExpr{
+			List:           make([]build.Expr, len(v)),
+			ForceMultiLine: len(v) > 1,
+		}
+		for i, item := range v {
+			list.List[i] = jsonExpr(item)
+		}
+		return list
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		dict := &build.DictExpr{ForceMultiLine: true}
+		for _, k := range keys {
+			dict.List = append(dict.List, &build.KeyValueExpr{
+				Key:   buildutil.StrExpr(k),
+				Value: jsonExpr(v[k]),
+			})
+		}
+		return dict
+	}
+	return &build.Ident{Name: "None"}
+}
+
+// exprJson converts a Starlark expression written by jsonExpr back to the
+// value decoded from json.
+func exprJson(e build.Expr) (any, error) {
+	switch e := e.(type) {
+	case *build.StringExpr:
+		return e.Value, nil
+	case *build.LiteralExpr:
+		return strconv.ParseFloat(e.Token, 64)
+	case *build.Ident:
+		switch e.Name {
+		case "True":
+			return true, nil
+		case "False":
+			return false, nil
+		case "None":
+			return nil, nil
+		}
+	case *build.ListExpr:
+		list := make([]any, len(e.List))
+		for i, item := range e.List {
+			v, err := exprJson(item)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = v
+		}
+		return list, nil
+	case *build.DictExpr:
+		dict := make(map[string]any, len(e.List))
+		for _, kv := range e.List {
+			key, ok := kv.Key.(*build.StringExpr)
+			if !ok {
+				return nil, fmt.Errorf("unsupported dict key %s", build.FormatString(kv.Key))
+			}
+			v, err := exprJson(kv.Value)
+			if err != nil {
+				return nil, err
+			}
+			dict[key.Value] = v
+		}
+		return dict, nil
+	}
+	return nil, fmt.Errorf("unsupported expression %s", build.FormatString(e))
+}
+
+// readThinLock reads the lock data from a lock file written with -thin.
+// It returns nil if the file has no lock data.
+func readThinLock(file *build.File) (*jsonLock, error) {
+	e := moduleVar(file, lockDataVar)
+	if e == nil {
+		return nil, nil
+	}
+	v, err := exprJson(e)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", lockDataVar, err)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var data jsonLock
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, fmt.Errorf("%s: %w", lockDataVar, err)
+	}
+	return &data, nil
+}
+
+// expr returns the lock data as a Starlark expression.
+func (data *jsonLock) expr() (build.Expr, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return jsonExpr(v), nil
+}
+
+// specs returns the packages for a platform, with the names of their
+// dependencies.
+func (data *jsonLock) specs(platform string) map[string]*PkgSpec {
+	pkgs := data.Platforms[platform]
+	specs := make(map[string]*PkgSpec, len(pkgs))
+	for _, pkg := range pkgs {
+		spec := &PkgSpec{
+			Name:        pkg.Name,
+			Version:     pkg.Version,
+			DistName:    pkg.DistName,
+			DependSpecs: pkg.Depends,
+		}
+		for _, d := range pkg.Depends {
+			name, _, _ := strings.Cut(d, " ")
+			spec.Depends = append(spec.Depends, name)
+		}
+		specs[pkg.Name] = spec
+	}
+	return specs
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bazelbuild/buildtools/build"
+)
+
+func TestJsonLock(t *testing.T) {
+	zlib := &PkgSpec{
+		Name:        "zlib",
+		Version:     "1.3.1",
+		BuildStr:    "h4ab18f5_1",
+		DistName:    "zlib-1.3.1-h4ab18f5_1",
+		Channel:     "conda-forge",
+		BaseUrl:     "https://conda.anaconda.org/conda-forge/noarch",
+		Sha256:      "abc",
+		Depends:     []string{"libgcc-ng"},
+		DependSpecs: []string{"libgcc-ng >=12"},
+	}
+	solutions := map[string]map[string]*PkgSpec{
+		"linux-64": {
+			"zlib": zlib,
+			"libgcc-ng": {
+				Name:     "libgcc-ng",
+				Version:  "14.1.0",
+				Build:    "h77fa898_0",
+				DistName: "libgcc-ng-14.1.0-h77fa898_0",
+				BaseUrl:  "https://conda.anaconda.org/conda-forge/linux-64",
+				Url:      "https://conda.anaconda.org/conda-forge/linux-64/libgcc-ng-14.1.0-h77fa898_0.conda",
+				Sha256:   "def",
+				Size:     842109,
+			},
+		},
+		"osx-arm64": {
+			"zlib": zlib,
+		},
+	}
+	data := makeJsonLock([]string{"linux-64", "osx-arm64"}, solutions)
+	fn := filepath.Join(t.TempDir(), "conda_env.json")
+	if err := data.write(fn); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw map[string]map[string][]map[string]any
+	if err := json.Unmarshal(b, &raw); err != nil {
+		t.Fatal(err)
+	}
+	linux := raw["platforms"]["linux-64"]
+	if len(linux) != 2 || linux[0]["name"] != "libgcc-ng" ||
+		linux[0]["url"] != solutions["linux-64"]["libgcc-ng"].Url ||
+		linux[1]["build"] != "h4ab18f5_1" ||
+		linux[1]["depends"].([]any)[0] != "libgcc-ng >=12" {
+		t.Errorf("unexpected json lock:\n%s", b)
+	}
+	back, err := readJsonLock(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := back.lockedPackages()
+	if pkg := locked["zlib"][""]; pkg == nil || pkg.DistName != zlib.DistName {
+		t.Errorf("expected zlib to be shared, got %v", locked["zlib"])
+	}
+	if pkg := locked["libgcc-ng"]["linux-64"]; pkg == nil || pkg.Sha256 != "def" {
+		t.Errorf("expected libgcc-ng for linux-64, got %v", locked["libgcc-ng"])
+	}
+	if d := back.specs("linux-64")["zlib"].Depends; len(d) != 1 || d[0] != "libgcc-ng" {
+		t.Errorf("unexpected dependencies %v", d)
+	}
+	if missing, err := readJsonLock(fn + ".missing"); err != nil || missing != nil {
+		t.Errorf("expected no lock for a missing file, got %v, %v", missing, err)
+	}
+
+	file := &build.File{Path: "conda_env.bzl"}
+	if _, err := renderThin(file, data, []string{"extra"}, fn,
+		&lockProvenance{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := moduleVar(file, "_LOCK_DATA").(*build.DictExpr); !ok {
+		t.Error("lock data not embedded")
+	}
+	if thin, err := readThinLock(file); err != nil {
+		t.Error(err)
+	} else if thin == nil {
+		t.Error("lock data not read back")
+	} else if tb, err := thin.render(); err != nil {
+		t.Error(err)
+	} else if string(tb) != string(b) {
+		t.Errorf("lock data did not round trip:\n%s", tb)
+	}
+	if thin, err := readThinLock(&build.File{}); err != nil || thin != nil {
+		t.Errorf("expected no lock data, got %v, %v", thin, err)
+	}
+	def, ok := file.Stmt[len(file.Stmt)-1].(*build.DefStmt)
+	if !ok || def.Name != "conda_environment" {
+		t.Fatal("expected a conda_environment macro")
+	}
+	if c, ok := def.Body[1].(*build.CallExpr); !ok ||
+		(c.X.(*build.Ident)).Name != "conda_lock_environment" {
+		t.Errorf("unexpected macro body %v", def.Body)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/10XGenomics/rules_conda/buildutil"
+	"github.com/bazelbuild/buildtools/build"
+)
+
+// The attributes of conda_package_repository which are set by
+// make_conda_spec.  Any other attribute was added by hand.
+var generatedAttrs = map[string]struct{}{
+	"name":                   {},
+	"base_url":               {},
+	"base_urls":              {},
+	"dist_name":              {},
+	"sha256":                 {},
+	"archive_type":           {},
+	"md5":                    {},
+	"size":                   {},
+	"platform_base_urls":     {},
+	"platform_dist_names":    {},
+	"platform_sha256":        {},
+	"platform_archive_types": {},
+	"platform_md5":           {},
+	"platform_size":          {},
+	"exclude_deps":           {},
+	"conda_repo":             {},
+	"shared":                 {},
+}
+
+// repoCallName returns the name of a conda_package_repository call, or the
+// empty string if the expression is not one.
+func repoCallName(e build.Expr) string {
+	c, ok := e.(*build.CallExpr)
+	if !ok || buildutil.Ident(c.X) != "conda_package_repository" {
+		return ""
+	}
+	if attr := getAttr("name", c.List); attr != nil {
+		return stringValue(attr.RHS)
+	}
+	return ""
+}
+
+// hasKeepComment returns true if any of the comments is a `# keep` marker,
+// optionally followed by a reason.
+func hasKeepComment(comments ...[]build.Comment) bool {
+	for _, list := range comments {
+		for _, c := range list {
+			text := strings.TrimSpace(strings.TrimPrefix(c.Token, "#"))
+			if text == "keep" ||
+				strings.HasPrefix(text, "keep:") ||
+				strings.HasPrefix(text, "keep ") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isKept returns true if the call is marked with a `# keep` comment, either
+// before or after the call or on its name attribute.
+func isKept(c *build.CallExpr) bool {
+	if hasKeepComment(c.Comments.Before, c.Comments.Suffix) {
+		return true
+	}
+	if attr := getAttr("name", c.List); attr != nil {
+		return hasKeepComment(attr.Comments.Before, attr.Comments.Suffix)
+	}
+	return false
+}
+
+// customAttrs returns the attributes of the call which were added by hand.
+func customAttrs(c *build.CallExpr) []string {
+	var attrs []string
+	for _, e := range c.List {
+		if attr, ok := e.(*build.AssignExpr); ok {
+			key := buildutil.Ident(attr.LHS)
+			if _, ok := generatedAttrs[key]; !ok {
+				attrs = append(attrs, key)
+			}
+		}
+	}
+	return attrs
+}
+
+// keptRepos returns the conda_package_repository calls in the existing
+// macro body which are not generated for any of the given specs but are
+// marked with a `# keep` comment, sorted by name.  Unmarked calls which
+// were customised by hand are reported to w, since they will be removed.
+func keptRepos(w io.Writer, body []build.Expr, specs []*PkgSpec) []*build.CallExpr {
+	solved := make(map[string]struct{}, len(specs))
+	for _, spec := range specs {
+		solved[spec.repoName()] = struct{}{}
+	}
+	var kept []*build.CallExpr
+	for _, e := range body {
+		rn := repoCallName(e)
+		if rn == "" {
+			continue
+		}
+		if _, ok := solved[rn]; ok {
+			continue
+		}
+		c := e.(*build.CallExpr)
+		if isKept(c) {
+			kept = append(kept, c)
+		} else if attrs := customAttrs(c); len(attrs) > 0 {
+			fmt.Fprintf(w,
+				"WARNING: removing %s, which is no longer in the solution, "+
+					"loses customised attributes %s.  "+
+					"Mark it with `# keep` to keep it.\n",
+				rn, strings.Join(attrs, ", "))
+		}
+	}
+	sort.SliceStable(kept, func(i, j int) bool {
+		return repoCallName(kept[i]) < repoCallName(kept[j])
+	})
+	return kept
+}
+
+// keptPackages returns the names of the packages in the existing package
+// list which refer to kept repositories.
+func keptPackages(kept []*build.CallExpr, existing []build.Expr) []string {
+	if len(kept) == 0 {
+		return nil
+	}
+	names := make(map[string]struct{}, len(kept))
+	for _, c := range kept {
+		names[repoCallName(c)] = struct{}{}
+	}
+	var pkgs []string
+	for _, e := range existing {
+		if s, ok := e.(*build.StringExpr); ok {
+			spec := PkgSpec{Name: s.Value}
+			if _, ok := names[spec.repoName()]; ok {
+				pkgs = append(pkgs, s.Value)
+			}
+		}
+	}
+	return pkgs
+}
+
+// withoutKept returns the locked packages without those whose repositories
+// are marked with `# keep` in the lock file and are not in specs, since
+// those repositories are kept rather than removed.
+func withoutKept(file *build.File, locked map[string]map[string]*lockedPackage,
+	specs map[string]*PkgSpec) map[string]map[string]*lockedPackage {
+	if file == nil {
+		return locked
+	}
+	kept := make(map[string]struct{})
+	for _, expr := range file.Stmt {
+		def, ok := expr.(*build.DefStmt)
+		if !ok || !isEnvironmentMacro(def.Name) {
+			continue
+		}
+		for _, e := range def.Body {
+			if repoCallName(e) == "" || !isKept(e.(*build.CallExpr)) {
+				continue
+			}
+			c := e.(*build.CallExpr)
+			dists := []string{stringValue(attrValue("dist_name", c))}
+			if d, ok := attrValue("platform_dist_names", c).(*build.DictExpr); ok {
+				for _, kv := range d.List {
+					dists = append(dists, stringValue(kv.Value))
+				}
+			}
+			for _, dist := range dists {
+				if name, _, _ := splitDistName(dist); name != "" && specs[name] == nil {
+					kept[name] = struct{}{}
+				}
+			}
+		}
+	}
+	if len(kept) == 0 {
+		return locked
+	}
+	result := make(map[string]map[string]*lockedPackage, len(locked))
+	for name, pkgs := range locked {
+		if _, ok := kept[name]; !ok {
+			result[name] = pkgs
+		}
+	}
+	return result
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/10XGenomics/rules_conda/buildutil"
+	"github.com/bazelbuild/buildtools/build"
+)
+
+func TestKeptRepos(t *testing.T) {
+	repo := func(name string, attrs ...build.Expr) *build.CallExpr {
+		return &build.CallExpr{
+			X: &build.Ident{Name: "conda_package_repository"},
+			List: append([]build.Expr{
+				buildutil.StrAttr("name", name),
+				buildutil.StrAttr("dist_name", name+"-1.0-0"),
+				buildutil.StrAttr("sha256", "abc"),
+			}, attrs...),
+		}
+	}
+	patched := repo("conda_package_libfoo",
+		buildutil.Attr("patches", buildutil.ListExpr(
+			buildutil.StrExprList("//patches:libfoo.patch")...)))
+	patched.Comments.Before = []build.Comment{{Token: "# keep: built in house"}}
+	licensed := repo("conda_package_libbar",
+		buildutil.Attr("licenses", buildutil.ListExpr(
+			buildutil.StrExprList("@rules_license//licenses/spdx:MIT")...)),
+		buildutil.Attr("cc_include_path", buildutil.ListExpr(
+			buildutil.StrExprList("include/bar")...)))
+	existing := &build.Function{
+		Params: []build.Expr{buildutil.StrAttr("name", "conda_env")},
+		Body: []build.Expr{
+			&build.StringExpr{Value: "docstring"},
+			licensed,
+			patched,
+			repo("conda_package_stale"),
+			repo("conda_package_zlib"),
+			&build.CallExpr{
+				X: &build.Ident{Name: "conda_environment_repository"},
+				List: []build.Expr{
+					buildutil.Attr("name", &build.Ident{Name: "name"}),
+					buildutil.Attr("conda_packages", buildutil.ListExpr(
+						buildutil.StrExprList(
+							"libbar", "libfoo", "stale", "zlib")...)),
+				},
+			},
+		},
+	}
+	specs := map[string]*PkgSpec{
+		"zlib": {
+			Name:     "zlib",
+			DistName: "zlib-1.3.1-h0",
+			BaseUrl:  "https://conda.anaconda.org/conda-forge/linux-64",
+			Url:      "https://conda.anaconda.org/conda-forge/linux-64/zlib-1.3.1-h0.conda",
+			Sha256:   "def",
+			Depends:  []string{"libfoo"},
+		},
+	}
+
+	var buf strings.Builder
+	kept := keptRepos(&buf, existing.Body, []*PkgSpec{specs["zlib"]})
+	if len(kept) != 1 || kept[0] != patched {
+		t.Errorf("expected only libfoo to be kept, got %v", kept)
+	}
+	if got := buf.String(); !strings.Contains(got, "conda_package_libbar") ||
+		!strings.Contains(got, "licenses, cc_include_path") ||
+		strings.Contains(got, "stale") {
+		t.Errorf("unexpected warning %q", got)
+	}
+
+	file := &build.File{Stmt: []build.Expr{&build.DefStmt{
+		Name:     "conda_environment",
+		Function: build.Function{Body: existing.Body},
+	}}}
+	locked := withoutKept(file, lockedPackages(file), specs)
+	if _, ok := locked["libfoo"]; ok || len(locked) != 3 {
+		t.Errorf("expected only libfoo to be omitted, got %v", locked)
+	}
+	for _, change := range diffLock(locked, specs).Changes {
+		if change.Name == "libfoo" {
+			t.Errorf("kept repository reported as %s", change.Change)
+		}
+	}
+
+	fn := makeSpecFunc(&lockEnvironment{specs: specs}, nil, []string{"linux-64"}, existing)
+	var repos []string
+	for _, e := range fn.Body {
+		if rn := repoCallName(e); rn != "" {
+			repos = append(repos, rn)
+		}
+	}
+	if got := strings.Join(repos, ","); got != "conda_package_libfoo,conda_package_zlib" {
+		t.Errorf("unexpected repositories %s", got)
+	}
+	pkgs := stringList(getAttr("conda_packages",
+		fn.Body[len(fn.Body)-2].(*build.CallExpr).List).RHS)
+	if got := strings.Join(pkgs, ","); got != "libfoo,zlib" {
+		t.Errorf("unexpected conda_packages %s", got)
+	}
+	for _, e := range fn.Body {
+		if repoCallName(e) == "conda_package_zlib" {
+			if attr := getAttr("exclude_deps", e.(*build.CallExpr).List); attr != nil {
+				t.Errorf("kept dependency excluded: %v", stringList(attr.RHS))
+			}
+		}
+	}
+}
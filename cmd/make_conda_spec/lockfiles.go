@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// readLockInput reads the packages from the requirements file, if it is
+// an already-solved package list rather than a list of requirements.
+//
+// Explicit package lists, conda-lock.yml files, and pixi.lock files are
+// supported.  If the file is an ordinary requirements file, nil is
+// returned.  Packages listed without a sha256 must be passed to
+// hashLockInput before they are written to the lock file.
+func readLockInput(fn, arch string, excludeList []string) (map[string]*PkgSpec, error) {
+	if fn == "" {
+		return nil, nil
+	}
+	if explicit, err := isExplicit(fn); err != nil {
+		return nil, err
+	} else if explicit {
+		return readExplicit(fn, arch, excludeList)
+	}
+	switch filepath.Ext(fn) {
+	case ".yml", ".yaml", ".lock":
+	default:
+		return nil, nil
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := parseYaml(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	top, _ := doc.(map[string]any)
+	var specs map[string]*PkgSpec
+	switch {
+	case top["package"] != nil && top["metadata"] != nil:
+		specs, err = readCondaLock(top, arch)
+	case top["environments"] != nil && top["packages"] != nil:
+		specs, err = readPixiLock(top, arch)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("%s: no conda packages for platform %s", fn, arch)
+	}
+	for _, e := range excludeList {
+		delete(specs, e)
+	}
+	for _, spec := range specs {
+		spec.hashSource = fn
+	}
+	return specs, nil
+}
+
+// specFromUrl creates a spec for the package archive at the given URL,
+// with its checksums from hash and its size from pkg.
+func specFromUrl(url string, pkg, hash map[string]any) (*PkgSpec, error) {
+	spec, err := parseExplicitUrl(url)
+	if err != nil {
+		return nil, err
+	}
+	spec.Sha256 = yamlString(hash["sha256"])
+	spec.Md5 = yamlString(hash["md5"])
+	if size, err := strconv.ParseInt(yamlString(pkg["size"]), 10, 64); err == nil {
+		spec.Size = size
+	}
+	return spec, nil
+}
+
+// depNames returns the package names from a list of match specs.
+func depNames(deps []any) []string {
+	names := make([]string, 0, len(deps))
+	for _, d := range deps {
+		if s := yamlString(d); s != "" {
+			if spec, err := ParseMatchSpec(s); err == nil {
+				names = append(names, spec.Name)
+			}
+		}
+	}
+	return names
+}
+
+// readCondaLock reads the packages for a platform from a conda-lock.yml
+// file.
+func readCondaLock(top map[string]any, arch string) (map[string]*PkgSpec, error) {
+	pkgs, ok := top["package"].([]any)
+	if !ok {
+		return nil, fmt.Errorf("expected a list of packages")
+	}
+	specs := make(map[string]*PkgSpec, len(pkgs))
+	for _, p := range pkgs {
+		pkg, _ := p.(map[string]any)
+		if pkg == nil || yamlString(pkg["platform"]) != arch {
+			continue
+		}
+		name := yamlString(pkg["name"])
+		if m := yamlString(pkg["manager"]); m != "conda" {
+			fmt.Fprintf(os.Stderr, "WARNING: skipping %s package %s\n", m, name)
+			continue
+		}
+		hash, _ := pkg["hash"].(map[string]any)
+		spec, err := specFromUrl(yamlString(pkg["url"]), pkg, hash)
+		if err != nil {
+			return nil, err
+		}
+		if v := yamlString(pkg["version"]); v != "" {
+			spec.Version = v
+		}
+		deps, _ := pkg["dependencies"].(map[string]any)
+		spec.Depends = make([]string, 0, len(deps))
+		for d := range deps {
+			spec.Depends = append(spec.Depends, d)
+		}
+		sort.Strings(spec.Depends)
+		spec.DependSpecs = make([]string, len(spec.Depends))
+		for i, d := range spec.Depends {
+			spec.DependSpecs[i] = strings.TrimSpace(d + " " + yamlString(deps[d]))
+		}
+		specs[spec.Name] = spec
+	}
+	return specs, nil
+}
+
+// readPixiLock reads the packages for a platform in the default environment
+// of a pixi.lock file.
+func readPixiLock(top map[string]any, arch string) (map[string]*PkgSpec, error) {
+	envs, _ := top["environments"].(map[string]any)
+	env, _ := envs["default"].(map[string]any)
+	if env == nil {
+		if len(envs) != 1 {
+			return nil, fmt.Errorf("no default environment")
+		}
+		for _, e := range envs {
+			env, _ = e.(map[string]any)
+		}
+	}
+	platforms, _ := env["packages"].(map[string]any)
+	refs, _ := platforms[arch].([]any)
+	// Index the package details by url.
+	pkgs, _ := top["packages"].([]any)
+	details := make(map[string]map[string]any, len(pkgs))
+	for _, p := range pkgs {
+		if pkg, ok := p.(map[string]any); ok {
+			url := yamlString(pkg["conda"])
+			if url == "" && yamlString(pkg["kind"]) == "conda" {
+				// Before lock file version 5.
+				url = yamlString(pkg["url"])
+			}
+			if url != "" {
+				details[url] = pkg
+			}
+		}
+	}
+	specs := make(map[string]*PkgSpec, len(refs))
+	for _, r := range refs {
+		ref, _ := r.(map[string]any)
+		url := yamlString(ref["conda"])
+		if url == "" {
+			if pypi := yamlString(ref["pypi"]); pypi != "" {
+				fmt.Fprintln(os.Stderr, "WARNING: skipping pypi package", path.Base(pypi))
+			}
+			continue
+		}
+		pkg := details[url]
+		if pkg == nil {
+			return nil, fmt.Errorf("no package details for %s", url)
+		}
+		spec, err := specFromUrl(url, pkg, pkg)
+		if err != nil {
+			return nil, err
+		}
+		deps, _ := pkg["depends"].([]any)
+		spec.Depends = depNames(deps)
+		for _, d := range deps {
+			if s := yamlString(d); s != "" {
+				spec.DependSpecs = append(spec.DependSpecs, s)
+			}
+		}
+		specs[spec.Name] = spec
+	}
+	return specs, nil
+}
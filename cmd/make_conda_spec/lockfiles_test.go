@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func checkLockInput(t *testing.T, fn string) {
+	t.Helper()
+	specs, err := readLockInput(fn, "linux-64", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 2 {
+		t.Errorf("expected 2 packages, got %d", len(specs))
+	}
+	zlib := specs["libzlib"]
+	if zlib == nil {
+		t.Fatal("missing libzlib")
+	}
+	if zlib.DistName != "libzlib-1.3.1-h4ab18f5_1" ||
+		zlib.Version != "1.3.1" ||
+		zlib.BaseUrl != "https://conda.anaconda.org/conda-forge/linux-64" ||
+		!strings.HasSuffix(zlib.Url, ".conda") ||
+		zlib.Sha256 != "adf6096f98b537a11ae3729eaa642b0811478f0ea0402ca67b5108fe2cb0010d" ||
+		zlib.Md5 != "57d7dc60e9325e3de37ff8dffd18e814" {
+		t.Errorf("unexpected libzlib %+v", zlib)
+	}
+	if d := strings.Join(zlib.Depends, ","); d != "__glibc,libgcc-ng" {
+		t.Errorf("unexpected depends %s", d)
+	}
+	if click := specs["click"]; click == nil {
+		t.Error("missing click")
+	} else if click.BaseUrl != "https://conda.anaconda.org/conda-forge/noarch" {
+		t.Errorf("unexpected base url %s", click.BaseUrl)
+	}
+	if specs, err := readLockInput(fn, "osx-arm64", []string{"click"}); err != nil {
+		t.Error(err)
+	} else if len(specs) != 0 {
+		t.Errorf("expected click to be excluded, got %v", specs)
+	}
+}
+
+func TestReadCondaLock(t *testing.T) {
+	checkLockInput(t, "testdata/lockfiles/conda-lock.yml")
+}
+
+func TestReadPixiLock(t *testing.T) {
+	checkLockInput(t, "testdata/lockfiles/pixi.lock")
+}
+
+func TestReadLockInputRequirements(t *testing.T) {
+	reqs := writeRequirements(t, "numpy")
+	if specs, err := readLockInput(reqs, "linux-64", nil); err != nil {
+		t.Error(err)
+	} else if specs != nil {
+		t.Error("expected nil for a requirements file")
+	}
+}
+
+func TestPixiLockMd5Only(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}))
+	defer server.Close()
+	url := server.URL + "/noarch/ok-1.0-0.conda"
+	fn := filepath.Join(t.TempDir(), "pixi.lock")
+	if err := os.WriteFile(fn, []byte(`version: 6
+environments:
+  default:
+    channels:
+    - url: `+server.URL+`/
+    packages:
+      linux-64:
+      - conda: `+url+`
+packages:
+- conda: `+url+`
+  md5: 444bcb3a3fcf8389296c49467f27e1d6
+  size: 3
+`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	specs, err := readLockInput(fn, "linux-64", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if specs["ok"] == nil || specs["ok"].Sha256 != "" {
+		t.Fatalf("unexpected packages %v", specs)
+	}
+	// The recorded size is wrong, so the download does not match.
+	err = hashLockInput(specs, "", false)
+	if err == nil {
+		t.Fatal("expected a size mismatch")
+	} else if msg := err.Error(); !strings.Contains(msg, "size mismatch") ||
+		!strings.Contains(msg, "from "+fn) {
+		t.Errorf("error did not name the lock file: %v", err)
+	}
+	specs["ok"].Size = 2
+	if err := hashLockInput(specs, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if s := specs["ok"].Sha256; s != "2689367b205c16ce32ed4200942b8b8b1e262dfc70d9bc9fbc77c49699a4f1df" {
+		t.Errorf("wrong checksum %s", s)
+	}
+}
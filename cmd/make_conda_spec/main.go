@@ -1,15 +1,18 @@
 // Generate complete conda spec from a requirements file.
 //
 // The requirements file will be given to `conda create -F` so must
-// be formatted appropriately for that parser.
+// be formatted appropriately for that parser.  Alternatively, with
+// `-solver builtin`, the requirements are resolved without conda against
+// the repodata.json of local channels.  The requirements file may also be
+// an @EXPLICIT package list, a conda-lock.yml, or a pixi.lock file, in which
+// case the packages are used as given, or a conda environment.yml file.
 //
 // The requirements will be output as a .bzl file with a macro that can
 // be used to initialize the repository.
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -17,7 +20,6 @@ import (
 	"io"
 	"io/fs"
 	"log"
-	"net/http"
 	"os"
 	"os/exec"
 	"path"
@@ -26,7 +28,7 @@ import (
 	"strings"
 )
 
-func getEnv(condaDir string) []string {
+func getEnv(condaDir string, virtual virtualOverrides) []string {
 	oldEnvs := os.Environ()
 	envs := make([]string, 0, len(oldEnvs)+2)
 	for _, e := range oldEnvs {
@@ -49,7 +51,7 @@ func getEnv(condaDir string) []string {
 		}
 	}
 	envs = append(envs, "PYTHONHASHSEED=0", "PYTHONNOUSERSITE=0")
-	return envs
+	return virtual.env(envs)
 }
 
 func splitList(s string) []string {
@@ -60,12 +62,30 @@ func splitList(s string) []string {
 }
 
 func main() {
-	var buildFile, requirements, conda, outName, channels, exclude, extra, arch string
+	var buildFile, requirements, conda, outName, channels, exclude, extra, arch, solver, update string
+	var diffJson, explicitOut, formatFlag, mirrors, graphDot, graphJson, why, virtual string
+	var moduleJson, lockJson, environments, pypiNamesFile string
+	var check, checkInputs, prune, thin, aliasPypi, findExecutables bool
+	var opts lockOptions
 	flag.StringVar(&buildFile, "build", "",
 		"The path to a sibling file of the target location. "+
 			"This is used if the output file doesn't already exist.")
 	flag.StringVar(&requirements, "requirements", "",
-		"Specifies the requirements to use in generating the spec.")
+		"Specifies the requirements to use in generating the spec.  "+
+			"This may also be an @EXPLICIT package list, as produced by "+
+			"`conda list --explicit`, a conda-lock.yml file, or a "+
+			"pixi.lock file, in which case the packages for the given "+
+			"architecture are used without solving, or a conda "+
+			"environment.yml file, in which case its channels, if any, "+
+			"are used instead of -chan, and the channels of any "+
+			"channel::package dependencies are added.")
+	flag.StringVar(&environments, "env", "",
+		"A comma-separated list of additional environments to manage in "+
+			"the same output file, as name=requirements pairs.  Each is "+
+			"solved separately and declared by a conda_environment_<name> "+
+			"macro, creating the @conda_env_<name> repository by default.  "+
+			"Packages used by several environments must resolve to the "+
+			"same build, and their repositories are declared only once.")
 	flag.StringVar(&conda, "conda", "",
 		"The path to the conda executable to use for fetching.")
 	flag.StringVar(&outName, "o", "",
@@ -80,9 +100,135 @@ func main() {
 	flag.StringVar(&exclude, "exclude", "",
 		"A comma-separated list of packages to exclude from the generated "+
 			"lock file, if they are present in the solution returned by conda.")
+	flag.BoolVar(&prune, "prune", false,
+		"Remove packages which are not reachable through the dependency "+
+			"graph from the packages named in -requirements, such as those "+
+			"which were only needed by a package in -exclude.  The removed "+
+			"packages are reported.")
 	flag.StringVar(&arch, "arch", "linux-64",
-		"The architecture to pass to the solver.")
+		"The architecture to pass to the solver.  If a comma-separated "+
+			"list is given, the environment is solved for each one, and "+
+			"the generated lock file contains packages for every platform.")
+	flag.StringVar(&solver, "solver", "conda",
+		"The solver to use.  Either 'conda', to run the executable given "+
+			"by -conda, or 'builtin', to resolve the requirements directly "+
+			"from the repodata.json files of the channels, which must be "+
+			"file:// URLs or local directories.")
+	flag.StringVar(&update, "update", "",
+		"A comma-separated list of packages to update.  If set, every "+
+			"other package in the existing lock file is kept at its "+
+			"locked version, unless that version conflicts with the "+
+			"requirements or the new versions of these packages.")
+	flag.StringVar(&explicitOut, "explicit", "",
+		"If set, also write the solution as an @EXPLICIT package list, "+
+			"which can be passed to `conda create --file`, to this path.  "+
+			"If there is more than one architecture, a file is written "+
+			"for each, with the architecture added before the extension.")
+	flag.StringVar(&diffJson, "diff_json", "",
+		"If set, write a json report of the changes to the lock file "+
+			"to this path.  A summary table is always printed to stderr.")
+	flag.StringVar(&graphDot, "graph_dot", "",
+		"If set, write the dependency graph of the solution, in Graphviz "+
+			"DOT format, to this path.  Directly requested packages are "+
+			"drawn in bold.  If there is more than one architecture, a "+
+			"file is written for each.")
+	flag.StringVar(&graphJson, "graph_json", "",
+		"If set, write the dependency graph of the solution, including "+
+			"version constraints and package sizes, as json to this path.")
+	flag.StringVar(&moduleJson, "module_json", "",
+		"If set, also write the repositories declared in the output file "+
+			"to this json file, for the bzlmod module extension in "+
+			"rules/extensions.bzl, and print the MODULE.bazel stanza for "+
+			"using it.  A relative path is relative to the output file.")
+	flag.StringVar(&lockJson, "lock_json", "",
+		"If set, also write the locked packages for each architecture, "+
+			"with their versions, URLs, checksums and dependencies, to "+
+			"this json file.  If the file exists, the existing packages "+
+			"are read from it rather than from the output file, for "+
+			"example for -update.  A relative path is relative to the "+
+			"output file.")
+	flag.BoolVar(&thin, "thin", false,
+		"Write the output file as a thin conda_environment macro over the "+
+			"embedded lock data, as written by -lock_json, instead of "+
+			"declaring each package repository.  Per-package customizations "+
+			"of the repositories are not preserved.")
+	flag.StringVar(&formatFlag, "format", "",
+		"The package archive format to lock: 'conda' or 'tar.bz2' to "+
+			"require that format, or 'prefer-conda' to use .conda "+
+			"archives where they are available.  By default, the archive "+
+			"chosen by the solver is used.")
+	flag.StringVar(&mirrors, "mirrors", "",
+		"A file mapping channel URLs to mirrors.  Each line has a channel "+
+			"URL prefix followed by one or more mirror URL prefixes.  The "+
+			"package URLs in the lock file are replaced by the URLs for each "+
+			"mirror, in order.  To keep the channel itself as a fallback, "+
+			"list it as the last mirror.")
+	flag.BoolVar(&aliasPypi, "pip_aliases", false,
+		"Add aliases to the generated conda_environment_repository from "+
+			"the PyPI distribution name of each python package, such as "+
+			"PyYAML for pyyaml, where it differs from the package name.  "+
+			"The names are read from the -pypi_names table, or else from "+
+			"the python metadata of packages extracted in the package "+
+			"cache.  Names which collide with other packages are reported "+
+			"and skipped.  Added aliases are marked with a # detected "+
+			"comment, and are removed when their package is gone.")
+	flag.BoolVar(&findExecutables, "detect_executables", false,
+		"Add the packages which provide executables to the "+
+			"executable_packages of the generated "+
+			"conda_environment_repository, marked with a `# detected` "+
+			"comment.  A package is executable if it declares an app or "+
+			"python entry point, or has an executable in bin/ named for "+
+			"the package, according to its metadata in the package cache.  "+
+			"Detected entries are removed when the package is no longer "+
+			"in the environment or no longer executable, while entries "+
+			"added by hand are kept.  Packages which have not been "+
+			"extracted in the package cache are reported.")
+	flag.StringVar(&pypiNamesFile, "pypi_names", "",
+		"A file mapping conda package names to PyPI distribution names, "+
+			"for -pip_aliases.  Each line has a conda package name followed "+
+			"by one or more PyPI names.")
+	flag.StringVar(&virtual, "virtual", "",
+		"A comma-separated list of virtual package versions to assume "+
+			"when solving, instead of those of the host, for example "+
+			"'__glibc=2.28,__cuda=12.2'.  An empty version, as in "+
+			"'__cuda=', means the package is absent.  The overrides are "+
+			"recorded in the output file, and are used from there when "+
+			"this flag is not given.")
+	flag.StringVar(&opts.pkgDir, "pkgs", "",
+		"The conda package cache directory from which to read package "+
+			"checksums and URLs, with a snapshot of the channel repodata "+
+			"in its cache subdirectory.  By default, the pkgs directory of "+
+			"the conda installation is used.")
+	flag.BoolVar(&opts.offline, "offline", false,
+		"Never use the network.  Packages are resolved only from the "+
+			"-pkgs directory, or the pkgs directory of the conda "+
+			"installation, and its repodata snapshot, and it is an "+
+			"error if any checksum or URL is missing.")
+	flag.StringVar(&why, "why", "",
+		"Instead of writing the output file, print every dependency path "+
+			"from the requested packages to the named package.  If "+
+			"-requirements is not given, the packages in the existing "+
+			"output file are used, with their dependencies read from the "+
+			"package cache.")
+	flag.BoolVar(&check, "check", false,
+		"Instead of writing the output file, check that it is up to date "+
+			"and exit with an error, showing the differences, if it is not.")
+	flag.BoolVar(&checkInputs, "check_inputs", false,
+		"Instead of solving, check that the output file records that it "+
+			"was generated from the current requirements, channels, "+
+			"architectures, and other inputs, and exit with an error "+
+			"listing the differences if it was not.")
 	flag.Parse()
+	var err error
+	if opts.format, err = parseArchiveFormat(formatFlag); err != nil {
+		log.Fatalln(err)
+	}
+	if opts.mirrors, err = readMirrors(mirrors); err != nil {
+		log.Fatalln("Failed reading mirrors:\n", err)
+	}
+	if opts.virtual, err = parseVirtualOverrides(virtual); err != nil {
+		log.Fatalln(err)
+	}
 
 	if outName == "" {
 		log.Fatalln("Missing outName")
@@ -107,6 +253,345 @@ func main() {
 	} else {
 		outName = resolved
 	}
+	if moduleJson != "" && !filepath.IsAbs(moduleJson) {
+		moduleJson = filepath.Join(filepath.Dir(outName), moduleJson)
+	}
+	if lockJson != "" && !filepath.IsAbs(lockJson) {
+		lockJson = filepath.Join(filepath.Dir(outName), lockJson)
+	}
+	if thin && moduleJson != "" {
+		log.Fatalln("-module_json cannot be used with -thin.")
+	}
+	extraEnvs, err := parseEnvironments(environments)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(extraEnvs) > 0 && (thin || moduleJson != "" || lockJson != "") {
+		log.Fatalln("-env cannot be used with -thin, -module_json or -lock_json.")
+	}
+	if thin && (aliasPypi || findExecutables) {
+		log.Fatalln("-pip_aliases and -detect_executables cannot be used with -thin.")
+	}
+	pypiTable, err := readPypiNames(pypiNamesFile)
+	if err != nil {
+		log.Fatalln("Failed reading PyPI names:\n", err)
+	}
+	if opts.offline && opts.pkgDir == "" && conda != "" {
+		// The conda root is a temporary directory, so conda must be told
+		// to use the package cache of the installation explicitly.
+		if opts.pkgDir, err = filepath.Abs(opts.packageDir(conda)); err != nil {
+			log.Fatalln("Could not resolve the package cache directory:\n", err)
+		}
+	}
+	channelList := splitList(channels)
+	// The original requirements file, before any conversion, for the
+	// provenance recorded in the lock file.
+	requirementsFile := requirements
+	if env, err := readEnvironment(requirements); err != nil {
+		log.Fatalln("Failed reading environment file:\n", err)
+	} else if env != nil {
+		channelList = env.channels(channelList)
+		if requirements, err = env.writeRequirements(); err != nil {
+			log.Fatalln("Failed writing requirements:\n", err)
+		}
+		defer os.Remove(requirements)
+	}
+	for _, env := range extraEnvs {
+		// Each environment file may list its own channels, and otherwise
+		// the channels given by -chan are used.
+		env.channels = splitList(channels)
+		env.solverRequirements = env.requirements
+		if envFile, err := readEnvironment(env.requirements); err != nil {
+			log.Fatalln("Failed reading environment file:\n", err)
+		} else if envFile != nil {
+			env.channels = envFile.channels(env.channels)
+			if env.solverRequirements, err = envFile.writeRequirements(); err != nil {
+				log.Fatalln("Failed writing requirements:\n", err)
+			}
+			defer os.Remove(env.solverRequirements)
+		}
+	}
+	extrasList := splitList(extra)
+	excludeList := splitList(exclude)
+	platforms := splitList(arch)
+	if len(platforms) == 0 {
+		log.Fatalln("At least one architecture is required.")
+	}
+	file := readLock(outName)
+	if virtual == "" {
+		opts.virtual = readVirtualOverrides(file)
+	}
+	prov, err := makeProvenance(solver, conda, requirementsFile, channelList,
+		platforms, excludeList, extrasList, opts.virtual, extraEnvs)
+	if err != nil {
+		log.Fatalln("Failed reading requirements:\n", err)
+	}
+	if checkInputs {
+		if err := checkProvenance(outName, file, prov); err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Fprintln(os.Stderr, outName, "was generated from the current inputs.")
+		return
+	}
+	// The existing packages must be read before renderSpecs updates them.
+	locked := lockedPackages(file)
+	var existingJson *jsonLock
+	if lockJson != "" {
+		if existingJson, err = readJsonLock(lockJson); err != nil {
+			log.Fatalln("Failed reading json lock:\n", err)
+		}
+	}
+	if existingJson == nil {
+		// A file written with -thin keeps its packages only in the lock data.
+		if existingJson, err = readThinLock(file); err != nil {
+			log.Fatalln("Failed reading lock data:\n", err)
+		}
+	}
+	if existingJson != nil {
+		locked = existingJson.lockedPackages()
+	}
+	if why != "" && requirements == "" {
+		if existingJson != nil {
+			explainJsonLock(why, existingJson, platforms)
+		} else {
+			explainLocked(why, locked, platforms, opts.packageDir(conda))
+		}
+		return
+	}
+	updateList := splitList(update)
+	if len(updateList) > 0 && len(locked) == 0 {
+		log.Fatalln("There is no existing lock file to update.")
+	}
+	solvePlatforms := func(requirements string,
+		channelList []string) map[string]map[string]*PkgSpec {
+		solutions := make(map[string]map[string]*PkgSpec, len(platforms))
+		for _, platform := range platforms {
+			if len(platforms) > 1 {
+				fmt.Fprintln(os.Stderr, "Solving for", platform)
+			}
+			if len(updateList) > 0 {
+				solutions[platform] = solveUpdate(solver, requirements, conda,
+					channelList, platform, excludeList, updateList, locked, &opts)
+			} else {
+				solutions[platform] = solve(solver, requirements, conda,
+					channelList, platform, excludeList, &opts)
+			}
+		}
+		if prune {
+			direct := directRequirements(requirements)
+			if len(direct) == 0 {
+				log.Fatalln("-prune requires -requirements to name the requested packages.")
+			}
+			for _, platform := range platforms {
+				pruned, err := pruneUnreachable(solutions[platform], direct)
+				if err != nil {
+					log.Fatalln(err)
+				}
+				if len(pruned) == 0 {
+					continue
+				}
+				label := platform
+				if len(platforms) == 1 {
+					label = ""
+				}
+				if err := printPruned(os.Stderr, label, pruned); err != nil {
+					log.Fatalln(err)
+				}
+			}
+		}
+		if opts.offline {
+			if err := checkOffline(platforms, solutions); err != nil {
+				log.Fatalln(err)
+			}
+		}
+		return solutions
+	}
+	solutions := solvePlatforms(requirements, channelList)
+	if why != "" {
+		direct := directRequirements(requirements)
+		for _, platform := range platforms {
+			label := platform
+			if len(platforms) == 1 {
+				label = ""
+			}
+			if err := printWhy(os.Stdout, label, why,
+				solutions[platform], direct); err != nil {
+				log.Fatalln(err)
+			}
+		}
+		return
+	}
+	envs := append([]*lockEnvironment{{
+		requirements: requirementsFile,
+		specs:        mergePlatforms(platforms, solutions),
+	}}, extraEnvs...)
+	for _, env := range extraEnvs {
+		fmt.Fprintln(os.Stderr, "Solving environment", env.name)
+		env.specs = mergePlatforms(platforms,
+			solvePlatforms(env.solverRequirements, env.channels))
+	}
+	if err := shareRepositories(envs); err != nil {
+		log.Fatalln(err)
+	}
+	if aliasPypi {
+		for _, env := range envs {
+			pkgs := append(sortedKeys(env.specs), extrasList...)
+			names, missing := pypiNames(env.specs, pypiTable, opts.packageDir(conda))
+			warnMissingMetadata(os.Stderr, opts.packageDir(conda), "PyPI names", missing)
+			env.aliases = pipAliases(os.Stderr, pkgs, names)
+		}
+	}
+	if findExecutables {
+		for _, env := range envs {
+			env.executables, env.unchecked = detectExecutables(env.specs,
+				opts.packageDir(conda))
+			missing := make([]string, len(env.unchecked))
+			for i, name := range env.unchecked {
+				missing[i] = env.specs[name].DistName
+			}
+			warnMissingMetadata(os.Stderr, opts.packageDir(conda),
+				"executables", missing)
+		}
+	}
+	specs := envs[0].specs
+	allSpecs := unionSpecs(envs)
+	diff := diffLock(withoutKept(file, locked, allSpecs), allSpecs)
+	if diffJson != "" {
+		if err := diff.writeJson(diffJson); err != nil {
+			log.Fatalln("Failed writing json report:\n", err)
+		}
+	}
+	if graphDot != "" || graphJson != "" {
+		if err := writeGraphFiles(graphDot, graphJson, platforms, solutions,
+			directRequirements(requirements)); err != nil {
+			log.Fatalln("Failed writing dependency graph:\n", err)
+		}
+	}
+	lockData := makeJsonLock(platforms, solutions)
+	var content []byte
+	if thin {
+		if content, err = renderThin(file, lockData, extrasList, outName, prov); err != nil {
+			log.Fatalln("Failed rendering lock data:\n", err)
+		}
+	} else {
+		content = renderSpecs(file, envs, extrasList, platforms, outName, prov)
+	}
+	if check {
+		err := checkLock(outName, content)
+		if err == nil && lockJson != "" {
+			b, rerr := lockData.render()
+			if rerr != nil {
+				log.Fatalln("Failed rendering json lock:\n", rerr)
+			}
+			err = checkLock(lockJson, b)
+		}
+		if err == nil && moduleJson != "" {
+			_, b, rerr := renderModuleLock(outName, content)
+			if rerr != nil {
+				log.Fatalln("Failed rendering module extension data:\n", rerr)
+			}
+			err = checkLock(moduleJson, b)
+		}
+		if err != nil {
+			if err := diff.print(os.Stderr); err != nil {
+				log.Println("Failed writing report:\n", err)
+			}
+			log.Fatalln(err)
+		}
+		return
+	}
+	if err := os.WriteFile(outName, content, 0666); err != nil {
+		log.Fatalln("Failed writing spec:\n", err)
+	}
+	if lockJson != "" {
+		if err := lockData.write(lockJson); err != nil {
+			log.Fatalln("Failed writing json lock:\n", err)
+		}
+	}
+	if moduleJson != "" {
+		lock, err := writeModuleLock(outName, moduleJson)
+		if err != nil {
+			log.Fatalln("Failed writing module extension data:\n", err)
+		}
+		if err := lock.printUseRepo(os.Stdout, moduleJson); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if explicitOut != "" {
+		if err := writeExplicitFiles(explicitOut, specs, platforms); err != nil {
+			log.Fatalln("Failed writing explicit package list:\n", err)
+		}
+	}
+	if err := diff.print(os.Stderr); err != nil {
+		log.Fatalln("Failed writing report:\n", err)
+	}
+}
+
+// Options which affect which package archives are locked, and where they
+// are fetched from.
+type lockOptions struct {
+	format  archiveFormat
+	mirrors mirrorMap
+	// The conda package cache directory, if not the default.
+	pkgDir  string
+	offline bool
+	virtual virtualOverrides
+	// Only resolve the package versions and dependencies, without finding
+	// the URLs and checksums of the packages.
+	resolveOnly bool
+}
+
+// solve solves the environment for one architecture with the given solver.
+// If the requirements file is an explicit package list or a conda-lock or
+// pixi lock file, the packages are used as-is, apart from computing any
+// missing sha256 checksums.
+func solve(solver, requirements, conda string, channelList []string,
+	arch string, excludeList []string, opts *lockOptions) map[string]*PkgSpec {
+	if specs, err := readLockInput(requirements, arch, excludeList); err != nil {
+		log.Fatalln("Failed reading requirements:\n", err)
+	} else if specs != nil {
+		pkgDir := opts.pkgDir
+		if pkgDir == "" && conda != "" {
+			pkgDir = opts.packageDir(conda)
+		}
+		if err := hashLockInput(specs, pkgDir, opts.offline); err != nil {
+			log.Fatalln("Failed computing checksums:\n", err)
+		}
+		if pkgDir != "" {
+			caches, err := loadRepodataCaches(pkgDir)
+			if err != nil {
+				log.Fatalln("Failed reading package cache:\n", err)
+			}
+			fillDepends(specs, caches, pkgDir)
+		}
+		opts.mirrors.apply(specs)
+		return specs
+	}
+	switch solver {
+	case "conda":
+		return condaSolve(requirements, conda, channelList, arch, excludeList, opts)
+	case "builtin":
+		fmt.Fprintln(os.Stderr, "Solving dependencies...")
+		specs, err := solveBuiltin(requirements, channelList, arch, excludeList, opts)
+		if unsat := (unsatisfiableError{}); errors.As(err, &unsat) {
+			fmt.Fprintf(os.Stderr,
+				"Could not solve the environment for %s:\n%v\nChannels searched: %s\n",
+				arch, err, strings.Join(channelList, ", "))
+			os.Exit(exitConflict)
+		} else if err != nil {
+			log.Fatalln("Failed solving dependencies:\n", err)
+		}
+		opts.mirrors.apply(specs)
+		return specs
+	}
+	log.Fatalln("Unknown solver", solver)
+	return nil
+}
+
+// condaSolve runs conda to solve the environment and then fills in
+// hashes and URLs from the conda package cache.
+func condaSolve(requirements, conda string, channelList []string,
+	arch string, excludeList []string, opts *lockOptions) map[string]*PkgSpec {
 	if conda == "" {
 		log.Fatalln("Path to conda is required.")
 	}
@@ -118,39 +603,49 @@ func main() {
 		log.Fatalln("Can't create temp dir for mamba root.")
 	}
 	defer os.RemoveAll(tempdir)
-	channelList := splitList(channels)
-	extrasList := splitList(extra)
-	excludeList := splitList(exclude)
-	cmd := condaCreate(requirements, conda, channelList, arch, tempdir)
-	out, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatalln("Failed making output pipe for conda:\n", err)
-	}
+	cmd := condaCreate(requirements, conda, channelList, arch, tempdir, opts)
+	var out bytes.Buffer
+	cmd.Stdout = &out
 	cmd.Stderr = os.Stderr
-	cmd.Env = getEnv(filepath.Dir(conda))
+	cmd.Env = opts.env(getEnv(filepath.Dir(conda), opts.virtual))
 	fmt.Fprintln(os.Stderr, "Solving dependencies...")
 	if err := cmd.Start(); err != nil {
 		log.Fatalln("Failed starting conda:\n", err)
 	}
-	specs, err := readSpecs(out, excludeList)
-	if err != nil {
-		log.Fatalln("Failed reading conda output:\n", err)
-	}
 	if err := cmd.Wait(); err != nil {
+		if report := parseConflicts(out.Bytes(), requirements,
+			channelList, arch); report != nil {
+			if err := report.print(os.Stderr); err != nil {
+				log.Println("Failed writing report:\n", err)
+			}
+			os.Exit(exitConflict)
+		}
 		fmt.Fprintln(os.Stderr, "Conda failed, rerunning to show output...")
-		showCondaError(requirements, conda, channelList, arch, tempdir)
+		showCondaError(requirements, conda, channelList, arch, tempdir, opts)
 		log.Fatalln("Original conda failure:\n", err)
 	}
+	specs, err := readSpecs(io.NopCloser(&out), excludeList)
+	if err != nil {
+		log.Fatalln("Failed reading conda output:\n", err)
+	}
+	if opts.resolveOnly {
+		pkgDir := opts.packageDir(conda)
+		caches, err := loadRepodataCaches(pkgDir)
+		if err != nil {
+			log.Fatalln("Failed reading package cache:\n", err)
+		}
+		fillDepends(specs, caches, pkgDir)
+		return specs
+	}
 	fmt.Fprintln(os.Stderr, "Getting package URLs and hashes...")
-	if err := fillSpecs(specs, conda, requirements, channelList, arch, tempdir); err != nil {
+	if err := fillSpecs(specs, conda, requirements, channelList, arch, tempdir, opts); err != nil {
 		log.Fatalln("Failed getting hashes:\n", err)
 	}
-	if err := writeSpecs(specs, extrasList, outName); err != nil {
-		log.Fatalln("Failed writing spec:\n", err)
-	}
+	return specs
 }
 
-func condaArgs(requirements string, channels []string, arch, tempdir string) []string {
+func condaArgs(requirements string, channels []string, arch, tempdir string,
+	opts *lockOptions) []string {
 	args := []string{
 		"create",
 		"-y", // Non-interactive, assume "yes" for all questions
@@ -171,24 +666,30 @@ func condaArgs(requirements string, channels []string, arch, tempdir string) []s
 	for _, c := range channels {
 		args = append(args, "--channel", c)
 	}
+	if opts.offline {
+		args = append(args, "--offline")
+	}
 	return args
 }
 
-func condaCreate(requirements, conda string, channels []string, arch, tempdir string) *exec.Cmd {
+func condaCreate(requirements, conda string, channels []string, arch, tempdir string,
+	opts *lockOptions) *exec.Cmd {
 	condaPath := path.Dir(conda) + string([]rune{os.PathListSeparator}) + os.Getenv("PATH")
-	args := append(condaArgs(requirements, channels, arch, tempdir),
+	args := append(condaArgs(requirements, channels, arch, tempdir, opts),
 		"--dry-run", // Don't actually create the environment
 		"--json",    // Output as json so we can parse it
 	)
 	return makeCmd(conda, condaPath, args...)
 }
 
-func showCondaError(requirements, conda string, channels []string, arch, tempdir string) {
+func showCondaError(requirements, conda string, channels []string, arch, tempdir string,
+	opts *lockOptions) {
 	condaPath := path.Dir(conda) + string([]rune{os.PathListSeparator}) + os.Getenv("PATH")
-	args := append(condaArgs(requirements, channels, arch, tempdir),
+	args := append(condaArgs(requirements, channels, arch, tempdir, opts),
 		"--dry-run", // Don't actually create the environment
 	)
 	cmd := makeCmd(conda, condaPath, args...)
+	cmd.Env = opts.env(opts.virtual.env(cmd.Env))
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
 	if err := cmd.Run(); err != nil {
@@ -196,9 +697,10 @@ func showCondaError(requirements, conda string, channels []string, arch, tempdir
 	}
 }
 
-func condaDownload(requirements, conda string, channels []string, arch, tempdir string) *exec.Cmd {
+func condaDownload(requirements, conda string, channels []string, arch, tempdir string,
+	opts *lockOptions) *exec.Cmd {
 	condaPath := path.Dir(conda) + string([]rune{os.PathListSeparator}) + os.Getenv("PATH")
-	args := append(condaArgs(requirements, channels, arch, tempdir),
+	args := append(condaArgs(requirements, channels, arch, tempdir, opts),
 		"--download-only",
 	)
 	return makeCmd(conda, condaPath, args...)
@@ -212,12 +714,27 @@ type PkgSpec struct {
 	Platform string   `json:"platform"`
 	Version  string   `json:"version"`
 	BaseUrl  string   `json:"base_url"`
+	// Mirror URLs for BaseUrl, in order of preference, if any.
+	BaseUrls []string `json:"-"`
 	Url      string   `json:"url,omitempty"`
 	Sha256   string   `json:"sha256"`
+	Md5      string   `json:"md5,omitempty"`
+	Size     int64    `json:"size,omitempty"`
 	// In the output of conda create, the build string is "build_string", but in
 	// but in the package info or index "build" is the build string.
 	BuildStr string `json:"build_string,omitempty"`
 	Build    string `json:"build,omitempty"`
+	// For packages which differ between platforms in a multi-platform
+	// lock, the package for each platform.
+	Platforms map[string]*PkgSpec `json:"-"`
+	// The dependencies, with their version constraints, as given in the
+	// package metadata.
+	DependSpecs []string `json:"-"`
+	// Where the checksums and size came from, for error reporting.
+	hashSource string
+	// Set if the dependencies are not known, such as for packages which
+	// conda linked from the package cache without reporting their metadata.
+	dependsUnknown bool
 }
 
 func readSpecs(out io.ReadCloser, excludeList []string) (map[string]*PkgSpec, error) {
@@ -238,23 +755,22 @@ func readSpecs(out io.ReadCloser, excludeList []string) (map[string]*PkgSpec, er
 		if pkg.BaseUrl != "" && pkg.Platform != "" {
 			pkg.BaseUrl = pkg.BaseUrl + "/" + pkg.Platform
 		}
-		if pkg.Url == "" && pkg.BaseUrl != "" {
-			pkg.Url = pkg.BaseUrl + "/" + pkg.DistName + ".tar.bz2"
-		}
 		if pkg.DistName == "" {
 			if pkg.BuildStr != "" {
 				pkg.DistName = strings.Join([]string{
 					pkg.Name, pkg.Version, pkg.BuildStr}, "-")
 			}
 		}
+		// Only fetched packages are reported with their dependencies.
+		pkg.dependsUnknown = true
 		specs[pkg.Name] = pkg
 	}
 	for _, pkg := range condaResult.Actions.Fetch {
 		spec := specs[pkg.Name]
 		if pkg.Url != "" {
 			spec.Url = pkg.Url
-			if pkg.Sha256 != "" {
-				spec.Sha256 = pkg.Sha256
+			if err := spec.checkHashes(pkg.hashes(), "conda"); err != nil {
+				return nil, err
 			}
 		}
 		if pkg.BaseUrl != "" && pkg.Platform != "" {
@@ -263,12 +779,14 @@ func readSpecs(out io.ReadCloser, excludeList []string) (map[string]*PkgSpec, er
 			i := strings.LastIndexByte(pkg.Url, '/')
 			spec.BaseUrl = pkg.Url[:i]
 		}
+		spec.DependSpecs = append([]string(nil), pkg.Depends...)
 		for i, d := range pkg.Depends {
 			if j := strings.IndexByte(d, ' '); j > 0 {
 				pkg.Depends[i] = d[:j]
 			}
 		}
 		spec.Depends = pkg.Depends
+		spec.dependsUnknown = false
 	}
 	for _, e := range excludeList {
 		delete(specs, e)
@@ -301,17 +819,29 @@ func urlRank(url string) int {
 	return 7
 }
 
-func fillSpecs(specs map[string]*PkgSpec, conda, requirements string,
-	channels []string, arch, tempdir string) error {
-	pkgDir := path.Join(path.Dir(path.Dir(conda)), "pkgs")
+// The repodata for a channel subdir in the conda package cache.
+type repodataCache struct {
+	Url           string             `json:"_url"`
+	Packages      map[string]PkgSpec `json:"packages"`
+	PackagesConda map[string]PkgSpec `json:"packages.conda"`
+}
+
+// packageDir returns the conda package cache directory.
+func (opts *lockOptions) packageDir(conda string) string {
+	if opts.pkgDir != "" {
+		return opts.pkgDir
+	}
+	return path.Join(path.Dir(path.Dir(conda)), "pkgs")
+}
+
+// loadRepodataCaches loads the cached repodata from the package cache
+// directory, in order of preference.
+func loadRepodataCaches(pkgDir string) ([]*repodataCache, error) {
 	cacheFiles, err := filepath.Glob(path.Join(pkgDir, "cache/*.json"))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	caches := make([]*struct {
-		Url      string             `json:"_url"`
-		Packages map[string]PkgSpec `json:"packages"`
-	}, len(cacheFiles))
+	caches := make([]*repodataCache, len(cacheFiles))
 	for i, cachefile := range cacheFiles {
 		if err := func(cachefile string, cache interface{}) error {
 			f, err := os.Open(cachefile)
@@ -322,7 +852,13 @@ func fillSpecs(specs map[string]*PkgSpec, conda, requirements string,
 			dec := json.NewDecoder(f)
 			return dec.Decode(cache)
 		}(cachefile, &caches[i]); err != nil {
-			return err
+			return nil, err
+		}
+		if caches[i].Packages == nil {
+			caches[i].Packages = make(map[string]PkgSpec, len(caches[i].PackagesConda))
+		}
+		for fn, pkg := range caches[i].PackagesConda {
+			caches[i].Packages[fn] = pkg
 		}
 	}
 	sort.SliceStable(caches, func(i, j int) bool {
@@ -335,67 +871,98 @@ func fillSpecs(specs map[string]*PkgSpec, conda, requirements string,
 		}
 		return caches[i].Url < caches[j].Url
 	})
+	return caches, nil
+}
+
+// fillDepends looks up the dependencies of packages for which they are not
+// known from the repodata or the extracted packages in the package cache.
+func fillDepends(specs map[string]*PkgSpec, caches []*repodataCache, pkgDir string) {
+	for _, pkg := range specs {
+		if !pkg.dependsUnknown {
+			continue
+		}
+		depends, ok := cachedDepends(caches, pkgDir, pkg.DistName)
+		if !ok {
+			continue
+		}
+		pkg.DependSpecs = append([]string(nil), depends...)
+		pkg.Depends = make([]string, len(depends))
+		for i, d := range depends {
+			pkg.Depends[i], _, _ = strings.Cut(d, " ")
+		}
+		pkg.dependsUnknown = false
+	}
+}
+
+func fillSpecs(specs map[string]*PkgSpec, conda, requirements string,
+	channels []string, arch, tempdir string, opts *lockOptions) error {
+	pkgDir := opts.packageDir(conda)
+	caches, err := loadRepodataCaches(pkgDir)
+	if err != nil {
+		return err
+	}
+	if err := chooseArchives(specs, caches, opts.format); err != nil {
+		return err
+	}
+	fillDepends(specs, caches, pkgDir)
 	for _, cache := range caches {
 		for tarballName, pkgCache := range cache.Packages {
 			if pkg := specs[pkgCache.Name]; pkg != nil &&
-				(pkg.Sha256 == "" || pkg.BaseUrl == "") &&
-				(pkg.DistName == strings.TrimSuffix(tarballName, ".tar.bz2") ||
-					pkg.DistName == strings.TrimSuffix(tarballName, ".conda")) &&
+				(pkg.Url == "" && (pkg.DistName == strings.TrimSuffix(tarballName, ".tar.bz2") ||
+					pkg.DistName == strings.TrimSuffix(tarballName, ".conda")) ||
+					pkg.Url != "" && path.Base(pkg.Url) == tarballName) &&
 				pkg.Version == pkgCache.Version &&
 				(pkg.BuildStr == pkgCache.Build || pkg.Build == pkgCache.Build) &&
 				(pkg.BaseUrl == "" || cache.Url == pkg.BaseUrl) {
-				if pkgCache.Sha256 != "" {
-					pkg.Sha256 = pkgCache.Sha256
+				if err := pkg.checkHashes(pkgCache.hashes(),
+					cache.Url+"/"+tarballName); err != nil {
+					return err
 				}
 				if pkg.BaseUrl == "" {
 					pkg.BaseUrl = cache.Url
 				}
+				if pkg.Url == "" {
+					pkg.Url = cache.Url + "/" + tarballName
+				}
 			}
 		}
 	}
+	// Packages which must be downloaded to compute their checksum.
+	var fetch []*PkgSpec
 	for _, pkg := range specs {
-		if pkg.Sha256 == "" {
-			if sha, err := computeSha256(path.Join(pkgDir, path.Base(pkg.Url))); err == nil {
-				if sha != "" {
-					pkg.Sha256 = sha
-				} else {
-					fmt.Fprintf(os.Stderr,
-						`WARNING: Computed hash for %s was empty!
-WARNING: The spec is incomplete. Continuing anyway to allow for debugging.
-`, pkg.DistName)
-				}
-			} else if requirements == "" {
-				fmt.Fprintf(os.Stderr,
-					`WARNING: Error computing hash for %s: %v
+		fn := path.Join(pkgDir, path.Base(pkg.Url))
+		if h, err := computeFileHashes(fn); err == nil {
+			// Always check the downloaded package, if there is one, in
+			// case the repodata in the cache is corrupted.
+			if err := pkg.checkHashes(h, fn); err != nil {
+				return err
+			}
+		} else if pkg.Sha256 != "" || opts.offline {
+			// If offline, missing checksums are reported by checkOffline.
+			continue
+		} else if requirements == "" {
+			fmt.Fprintf(os.Stderr,
+				`WARNING: Error computing hash for %s: %v
 WARNING: The spec is incomplete. Continuing anyway to allow for debugging.
 `, pkg.DistName, err)
-			} else {
-				if pkg.Url != "" {
-					fmt.Fprintln(os.Stderr, "Downloading", pkg.Url,
-						"to compute checksum.")
-					if sha, err := computeSha256http(pkg.Url); err != nil {
-						fmt.Fprintf(os.Stderr,
-							"WARNING: Error computing hash for %s: %v\n",
-							pkg.DistName, err)
-					} else if sha != "" {
-						pkg.Sha256 = sha
-					} else {
-						fmt.Fprintf(os.Stderr,
-							"WARNING: Computed hash for %s was empty!\n",
-							pkg.DistName)
-					}
-				}
-				if pkg.Sha256 == "" {
-					fmt.Fprintln(os.Stderr, "No known checksum for", pkg.Name)
-					return download(specs, conda, requirements, channels, arch, tempdir)
-				}
-			}
+		} else if pkg.Url != "" {
+			fetch = append(fetch, pkg)
+		} else {
+			fmt.Fprintln(os.Stderr, "No known checksum for", pkg.Name)
+			return download(specs, conda, requirements, channels, arch, tempdir, opts)
 		}
 	}
+	opts.mirrors.apply(specs)
+	if err := hashPackages(fetch); err != nil {
+		return err
+	}
 	for _, pkg := range specs {
 		if pkg.BaseUrl == "" {
 			if url, err := getBaseUrl(path.Join(pkgDir, pkg.DistName)); err == nil && url != "" {
 				pkg.BaseUrl = url
+				pkg.BaseUrls = opts.mirrors.urls(url)
+			} else if opts.offline {
+				continue
 			} else if requirements == "" {
 				fmt.Fprintf(os.Stderr,
 					`WARNING: Error getting base URL for %s: %v
@@ -405,52 +972,13 @@ lock file before committing to revert broken changes.
 `, pkg.DistName, err)
 			} else {
 				fmt.Fprintln(os.Stderr, "No known URL for", pkg.Name)
-				return download(specs, conda, requirements, channels, arch, tempdir)
+				return download(specs, conda, requirements, channels, arch, tempdir, opts)
 			}
 		}
 	}
 	return nil
 }
 
-func computeSha256(filename string) (string, error) {
-	f, err := os.Open(filename)
-	if err != nil {
-		return "", err
-	}
-	defer f.Close()
-	return computeSha256reader(f)
-}
-
-func computeSha256http(url string) (string, error) {
-	r, err := http.Get(url)
-	if err != nil {
-		return "", err
-	}
-	defer r.Body.Close()
-	return computeSha256reader(r.Body)
-}
-
-func computeSha256reader(f io.Reader) (string, error) {
-	var buffer [4096]byte
-	sum := sha256.New()
-	n, err := f.Read(buffer[:])
-	for n > 0 && err == nil {
-		if _, err := sum.Write(buffer[:n]); err != nil {
-			return "", err
-		}
-		n, err = f.Read(buffer[:])
-	}
-	if err != nil && err != io.EOF {
-		return "", err
-	}
-	if n > 0 {
-		if _, err := sum.Write(buffer[:n]); err != nil {
-			return "", err
-		}
-	}
-	return hex.EncodeToString(sum.Sum(nil)), nil
-}
-
 func getBaseUrl(pkgDir string) (string, error) {
 	b, err := os.ReadFile(path.Join(pkgDir, "info/repodata_record.json"))
 	if err != nil {
@@ -466,13 +994,14 @@ func getBaseUrl(pkgDir string) (string, error) {
 }
 
 func download(specs map[string]*PkgSpec, conda, requirements string,
-	channels []string, arch, tempdir string) error {
+	channels []string, arch, tempdir string, opts *lockOptions) error {
 	fmt.Fprintln(os.Stderr, "Downloading missing packages to compute hashes...")
-	cmd := condaDownload(requirements, conda, channels, arch, tempdir)
+	cmd := condaDownload(requirements, conda, channels, arch, tempdir, opts)
+	cmd.Env = opts.env(opts.virtual.env(cmd.Env))
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
 	if err := cmd.Run(); err != nil {
 		return err
 	}
-	return fillSpecs(specs, conda, "", channels, arch, tempdir)
+	return fillSpecs(specs, conda, "", channels, arch, tempdir, opts)
 }
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A constraint on package versions.
+type versionSpec interface {
+	match(v *condaVersion) bool
+	String() string
+}
+
+type anyVersion struct{}
+
+func (anyVersion) match(*condaVersion) bool { return true }
+func (anyVersion) String() string           { return "*" }
+
+type versionConstraint struct {
+	op      string
+	version condaVersion
+}
+
+func (c *versionConstraint) match(v *condaVersion) bool {
+	switch c.op {
+	case "==":
+		return v.compare(&c.version) == 0
+	case "!=":
+		return v.compare(&c.version) != 0
+	case "<":
+		return v.compare(&c.version) < 0
+	case "<=":
+		return v.compare(&c.version) <= 0
+	case ">":
+		return v.compare(&c.version) > 0
+	case ">=":
+		return v.compare(&c.version) >= 0
+	case "=*":
+		return v.hasPrefix(&c.version)
+	case "!=*":
+		return !v.hasPrefix(&c.version)
+	case "~=":
+		if v.compare(&c.version) < 0 {
+			return false
+		}
+		prefix := c.version
+		if len(prefix.main) > 1 {
+			prefix.main = prefix.main[:len(prefix.main)-1]
+		}
+		return v.hasPrefix(&prefix)
+	}
+	return false
+}
+
+func (c *versionConstraint) String() string {
+	switch c.op {
+	case "=*":
+		return c.version.source + ".*"
+	case "!=*":
+		return "!=" + c.version.source + ".*"
+	}
+	return c.op + c.version.source
+}
+
+type versionAnd []versionSpec
+
+func (a versionAnd) match(v *condaVersion) bool {
+	for _, s := range a {
+		if !s.match(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a versionAnd) String() string {
+	parts := make([]string, len(a))
+	for i, s := range a {
+		parts[i] = s.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+type versionOr []versionSpec
+
+func (o versionOr) match(v *condaVersion) bool {
+	for _, s := range o {
+		if s.match(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o versionOr) String() string {
+	parts := make([]string, len(o))
+	for i, s := range o {
+		parts[i] = s.String()
+	}
+	return strings.Join(parts, "|")
+}
+
+var versionOps = [...]string{"==", "!=", "<=", ">=", "~=", "<", ">", "="}
+
+func parseVersionConstraint(s string, exact bool) (versionSpec, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "*" {
+		return anyVersion{}, nil
+	}
+	op := ""
+	for _, o := range versionOps {
+		if strings.HasPrefix(s, o) {
+			op = o
+			s = strings.TrimSpace(s[len(o):])
+			break
+		}
+	}
+	if s == "" {
+		return nil, fmt.Errorf("missing version after %q", op)
+	}
+	glob := false
+	if t := strings.TrimSuffix(s, "*"); t != s {
+		glob = true
+		s = strings.TrimSuffix(t, ".")
+		if s == "" {
+			return anyVersion{}, nil
+		}
+	}
+	switch op {
+	case "":
+		if glob || !exact {
+			op = "=*"
+		} else {
+			op = "=="
+		}
+	case "=":
+		op = "=*"
+	case "==":
+		if glob {
+			op = "=*"
+		}
+	case "!=":
+		if glob {
+			op = "!=*"
+		}
+	}
+	return &versionConstraint{op: op, version: parseVersion(s)}, nil
+}
+
+// parseVersionSpec parses a version specification such as `>=1.2,<2|3.*`.
+//
+// If exact is true, a bare version (without an operator or wildcard)
+// matches only that version.  Otherwise it is treated as a prefix, which
+// is how conda interprets `name=1.2`.
+func parseVersionSpec(s string, exact bool) (versionSpec, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "*" {
+		return anyVersion{}, nil
+	}
+	var or versionOr
+	for _, alt := range strings.Split(s, "|") {
+		var and versionAnd
+		for _, c := range strings.Split(alt, ",") {
+			vc, err := parseVersionConstraint(c, exact)
+			if err != nil {
+				return nil, fmt.Errorf("invalid version spec %q: %w", s, err)
+			}
+			if _, ok := vc.(anyVersion); !ok {
+				and = append(and, vc)
+			}
+		}
+		switch len(and) {
+		case 0:
+			or = append(or, anyVersion{})
+		case 1:
+			or = append(or, and[0])
+		default:
+			or = append(or, and)
+		}
+	}
+	if len(or) == 1 {
+		return or[0], nil
+	}
+	return or, nil
+}
+
+// A parsed conda match specification, e.g. `conda-forge::numpy >=1.20 py39*`.
+type MatchSpec struct {
+	Name    string
+	Channel string
+	Version versionSpec
+	// A glob pattern for the build string.  Empty matches any build.
+	Build string
+}
+
+// Whitespace within a version constraint, after an operator or around a
+// separator, as in `>= 1.2, < 2`.
+var versionSpace = regexp.MustCompile(`\s*([,|])\s*|([<>=!~]=?)\s+`)
+
+// ParseMatchSpec parses a conda match specification, in any of the forms
+// accepted in a requirements file or in the `depends` list of a package.
+func ParseMatchSpec(s string) (*MatchSpec, error) {
+	orig := s
+	if i := strings.IndexByte(s, '#'); i >= 0 {
+		s = s[:i]
+	}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, fmt.Errorf("empty match spec")
+	}
+	var spec MatchSpec
+	if ch, rest, ok := strings.Cut(s, "::"); ok {
+		spec.Channel = strings.TrimSpace(ch)
+		s = strings.TrimSpace(rest)
+	}
+	var bracket map[string]string
+	if i := strings.IndexByte(s, '['); i >= 0 && strings.HasSuffix(s, "]") {
+		bracket = parseBracket(s[i+1 : len(s)-1])
+		s = strings.TrimSpace(s[:i])
+	}
+	nameEnd := strings.IndexAny(s, " =<>!~")
+	if nameEnd < 0 {
+		nameEnd = len(s)
+	}
+	spec.Name = strings.ToLower(s[:nameEnd])
+	if spec.Name == "" {
+		return nil, fmt.Errorf("missing package name in %q", orig)
+	}
+	rest := strings.TrimSpace(s[nameEnd:])
+	var version string
+	exact := true
+	if strings.HasPrefix(rest, "=") && !strings.HasPrefix(rest, "==") {
+		// name=version=build form.
+		version, spec.Build, _ = strings.Cut(rest[1:], "=")
+		exact = spec.Build != ""
+	} else {
+		// name version build form.  Operators and separators may be
+		// followed by spaces.
+		rest = versionSpace.ReplaceAllString(rest, "$1$2")
+		fields := strings.Fields(rest)
+		if len(fields) > 2 ||
+			len(fields) > 1 && strings.ContainsAny(fields[1][:1], "<>=!~,|") {
+			return nil, fmt.Errorf("could not parse match spec %q", orig)
+		}
+		if len(fields) > 0 {
+			version = fields[0]
+		}
+		if len(fields) > 1 {
+			spec.Build = fields[1]
+		}
+	}
+	if v, ok := bracket["version"]; ok {
+		version = v
+	}
+	if b, ok := bracket["build"]; ok {
+		spec.Build = b
+	}
+	vs, err := parseVersionSpec(version, exact)
+	if err != nil {
+		return nil, err
+	}
+	spec.Version = vs
+	if spec.Build == "*" {
+		spec.Build = ""
+	}
+	return &spec, nil
+}
+
+func parseBracket(s string) map[string]string {
+	result := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			continue
+		}
+		result[strings.TrimSpace(k)] = strings.Trim(strings.TrimSpace(v), `"'`)
+	}
+	return result
+}
+
+func (spec *MatchSpec) String() string {
+	var sb strings.Builder
+	if spec.Channel != "" {
+		sb.WriteString(spec.Channel)
+		sb.WriteString("::")
+	}
+	sb.WriteString(spec.Name)
+	if _, ok := spec.Version.(anyVersion); !ok && spec.Version != nil {
+		sb.WriteByte(' ')
+		sb.WriteString(spec.Version.String())
+	}
+	if spec.Build != "" {
+		if _, ok := spec.Version.(anyVersion); ok || spec.Version == nil {
+			sb.WriteString(" *")
+		}
+		sb.WriteByte(' ')
+		sb.WriteString(spec.Build)
+	}
+	return sb.String()
+}
+
+// matchVersion returns true if the version and build match the spec.
+func (spec *MatchSpec) matchVersion(v *condaVersion, build string) bool {
+	if spec.Version != nil && !spec.Version.match(v) {
+		return false
+	}
+	return spec.Build == "" || globMatch(spec.Build, build)
+}
+
+// globMatch matches a string against a pattern where `*` matches any
+// sequence of characters.
+func globMatch(pattern, s string) bool {
+	star := strings.IndexByte(pattern, '*')
+	if star < 0 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, pattern[:star]) {
+		return false
+	}
+	s = s[star:]
+	pattern = pattern[star+1:]
+	if pattern == "" {
+		return true
+	}
+	for i := 0; i <= len(s); i++ {
+		if globMatch(pattern, s[i:]) {
+			return true
+		}
+	}
+	return false
+}
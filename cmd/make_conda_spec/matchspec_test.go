@@ -0,0 +1,121 @@
+package main
+
+import "testing"
+
+func TestVersionOrder(t *testing.T) {
+	ordered := []string{
+		"0.4",
+		"0.4.1.rc",
+		"0.4.1",
+		"0.5a1",
+		"0.5b3",
+		"0.5",
+		"0.9.6",
+		"0.960923",
+		"1.0dev",
+		"1.0a",
+		"1.0",
+		"1.0post1",
+		"1.1dev1",
+		"1.1",
+		"1.1.1",
+		"1.10",
+		"1!0.1",
+	}
+	for i := 1; i < len(ordered); i++ {
+		a, b := parseVersion(ordered[i-1]), parseVersion(ordered[i])
+		if c := a.compare(&b); c >= 0 {
+			t.Errorf("expected %s < %s, got %d", a.source, b.source, c)
+		}
+		if c := b.compare(&a); c <= 0 {
+			t.Errorf("expected %s > %s, got %d", b.source, a.source, c)
+		}
+	}
+	chkEq := func(a, b string) {
+		t.Helper()
+		va, vb := parseVersion(a), parseVersion(b)
+		if c := va.compare(&vb); c != 0 {
+			t.Errorf("expected %s == %s, got %d", a, b, c)
+		}
+	}
+	chkEq("0.4", "0.4.0")
+	chkEq("1.2-3", "1.2_3")
+	chkEq("1.2.3", "0!1.2.3")
+}
+
+func TestMatchSpec(t *testing.T) {
+	chk := func(spec, version, build string, expect bool) {
+		t.Helper()
+		s, err := ParseMatchSpec(spec)
+		if err != nil {
+			t.Fatalf("parsing %q: %v", spec, err)
+		}
+		v := parseVersion(version)
+		if m := s.matchVersion(&v, build); m != expect {
+			t.Errorf("expected %v, got %v for %q matching %s %s",
+				expect, m, spec, version, build)
+		}
+	}
+	chk("numpy", "1.26.4", "py311_0", true)
+	chk("numpy >=1.20", "1.26.4", "py311_0", true)
+	chk("numpy >=1.20", "1.19.5", "py311_0", false)
+	chk("numpy >=1.20,<1.26", "1.26.4", "py311_0", false)
+	chk("numpy >=1.20, <1.27", "1.26.4", "py311_0", true)
+	chk("numpy 1.26.*", "1.26.4", "py311_0", true)
+	chk("numpy 1.2.*", "1.26.4", "py311_0", false)
+	chk("numpy=1.26", "1.26.4", "py311_0", true)
+	chk("numpy=1.2", "1.26.4", "py311_0", false)
+	chk("numpy==1.26", "1.26.4", "py311_0", false)
+	chk("numpy 1.26", "1.26.0", "py311_0", true)
+	chk("numpy 1.26.4 py311*", "1.26.4", "py311_0", true)
+	chk("numpy 1.26.4 py312*", "1.26.4", "py311_0", false)
+	chk("numpy=1.26.4=py311_0", "1.26.4", "py311_0", true)
+	chk("numpy[version='>=1.26',build=py311*]", "1.26.4", "py311_0", true)
+	chk("numpy[version='>=1.27']", "1.26.4", "py311_0", false)
+	chk("python_abi 3.11.* *_cp311", "3.11", "4_cp311", true)
+	chk("python_abi 3.11.* *_cp311", "3.11", "4_cp312", false)
+	chk("python >=3.11,<3.12.0a0", "3.12.0rc1", "h_0", false)
+	chk("python >=3.11,<3.12.0a0", "3.11.8", "h_0", true)
+	chk("python 2.7.*|>=3.8", "3.7.1", "h_0", false)
+	chk("python 2.7.*|>=3.8", "2.7.18", "h_0", true)
+	chk("python !=3.9.*", "3.9.1", "h_0", false)
+	chk("python ~=3.9.1", "3.9.7", "h_0", true)
+	chk("python ~=3.9.1", "3.10.0", "h_0", false)
+	chk("numpy >= 1.2", "1.26.4", "py311_0", true)
+	chk("numpy >= 1.2 , < 1.26", "1.26.4", "py311_0", false)
+	chk("python == 3.11.8 h_0", "3.11.8", "h_0", true)
+	chk("python 2.7.* | >= 3.8", "3.9.1", "h_0", true)
+
+	if s, err := ParseMatchSpec("numpy >= 1.2"); err != nil {
+		t.Error(err)
+	} else if s.Build != "" {
+		t.Errorf("expected no build string, got %q", s.Build)
+	}
+	if _, err := ParseMatchSpec("numpy 1.2 >=py3"); err == nil {
+		t.Error("expected an error for an operator in the build string")
+	}
+
+	if s, err := ParseMatchSpec("conda-forge::numpy>=1.20 # comment"); err != nil {
+		t.Error(err)
+	} else if s.Channel != "conda-forge" || s.Name != "numpy" {
+		t.Errorf("expected conda-forge::numpy, got %s", s)
+	} else if str := s.String(); str != "conda-forge::numpy >=1.20" {
+		t.Errorf("unexpected string %q", str)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	chk := func(pattern, s string, expect bool) {
+		t.Helper()
+		if m := globMatch(pattern, s); m != expect {
+			t.Errorf("expected %v, got %v for %q matching %q",
+				expect, m, pattern, s)
+		}
+	}
+	chk("py311*", "py311h64a7726_0", true)
+	chk("*_cp311", "4_cp311", true)
+	chk("*_cp311", "4_cp3111", false)
+	chk("*cuda*", "py311_cuda_0", true)
+	chk("cpu_0", "cpu_0", true)
+	chk("cpu_0", "cpu_1", false)
+}
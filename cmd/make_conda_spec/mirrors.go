@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// A channel URL prefix and the mirror prefixes which replace it.
+type mirrorRule struct {
+	prefix  string
+	mirrors []string
+}
+
+// A set of mirror rules, with the longest prefixes first.
+type mirrorMap []mirrorRule
+
+// readMirrors reads a mirror configuration file.  Each line has a channel
+// URL prefix followed by one or more mirror URL prefixes, separated by
+// whitespace.  Blank lines and lines starting with `#` are ignored.
+func readMirrors(fn string) (mirrorMap, error) {
+	if fn == "" {
+		return nil, nil
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var m mirrorMap
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: no mirrors for %s", fn, line, fields[0])
+		}
+		for i, u := range fields {
+			fields[i] = strings.TrimSuffix(u, "/")
+		}
+		m = append(m, mirrorRule{prefix: fields[0], mirrors: fields[1:]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(m, func(i, j int) bool {
+		return len(m[i].prefix) > len(m[j].prefix)
+	})
+	return m, nil
+}
+
+// urls returns the mirror URLs for the given URL, in order, or nil if it
+// does not match any rule.
+func (m mirrorMap) urls(url string) []string {
+	for _, rule := range m {
+		rest, ok := strings.CutPrefix(url, rule.prefix)
+		if !ok || rest != "" && rest[0] != '/' {
+			continue
+		}
+		result := make([]string, len(rule.mirrors))
+		for i, mirror := range rule.mirrors {
+			result[i] = mirror + rest
+		}
+		return result
+	}
+	return nil
+}
+
+// apply sets the mirror URLs for each package.
+func (m mirrorMap) apply(specs map[string]*PkgSpec) {
+	if len(m) == 0 {
+		return
+	}
+	for _, spec := range specs {
+		spec.BaseUrls = m.urls(spec.BaseUrl)
+		m.apply(spec.Platforms)
+	}
+}
+
+// baseUrls returns the URLs from which the package can be fetched, in
+// order of preference.
+func (spec *PkgSpec) baseUrls() []string {
+	if len(spec.BaseUrls) > 0 {
+		return spec.BaseUrls
+	}
+	return []string{spec.BaseUrl}
+}
+
+// downloadUrls returns the URLs of the package archive, in order of
+// preference.
+func (spec *PkgSpec) downloadUrls() []string {
+	if len(spec.BaseUrls) == 0 {
+		return []string{spec.url()}
+	}
+	fn := path.Base(spec.url())
+	urls := make([]string, len(spec.BaseUrls))
+	for i, base := range spec.BaseUrls {
+		urls[i] = base + "/" + fn
+	}
+	return urls
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMirrors(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "mirrors.txt")
+	if err := os.WriteFile(fn, []byte(`# Internal mirrors.
+https://conda.anaconda.org https://mirror.example.com/conda
+https://conda.anaconda.org/conda-forge/ https://artifactory.example.com/cf https://conda.anaconda.org/conda-forge
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := readMirrors(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(m.urls("https://conda.anaconda.org/conda-forge/noarch"), " "); got != "https://artifactory.example.com/cf/noarch https://conda.anaconda.org/conda-forge/noarch" {
+		t.Errorf("unexpected conda-forge mirrors %s", got)
+	}
+	if got := strings.Join(m.urls("https://conda.anaconda.org/bioconda/noarch"), " "); got != "https://mirror.example.com/conda/bioconda/noarch" {
+		t.Errorf("unexpected bioconda mirrors %s", got)
+	}
+	if got := m.urls("https://conda.anaconda.org/conda-forge-extra/noarch"); len(got) != 1 {
+		t.Errorf("prefix matched part of a path element: %v", got)
+	}
+	if got := m.urls("https://repo.anaconda.com/pkgs/main/noarch"); got != nil {
+		t.Errorf("unexpected mirrors %v", got)
+	}
+}
+
+func TestHashPackagesMirrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/public/noarch/ok-1.0-0.conda" {
+				w.Write([]byte("ok"))
+			} else {
+				http.NotFound(w, r)
+			}
+		}))
+	defer server.Close()
+	pkg := &PkgSpec{
+		Name:     "ok",
+		DistName: "ok-1.0-0",
+		BaseUrl:  server.URL + "/public/noarch",
+		Url:      server.URL + "/public/noarch/ok-1.0-0.conda",
+	}
+	m := mirrorMap{{
+		prefix:  server.URL + "/public",
+		mirrors: []string{server.URL + "/internal", server.URL + "/public"},
+	}}
+	m.apply(map[string]*PkgSpec{"ok": pkg})
+	if len(pkg.BaseUrls) != 2 {
+		t.Fatalf("mirrors not applied: %v", pkg.BaseUrls)
+	}
+	if err := hashPackages([]*PkgSpec{pkg}); err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Sha256 != "2689367b205c16ce32ed4200942b8b8b1e262dfc70d9bc9fbc77c49699a4f1df" {
+		t.Errorf("wrong checksum %s", pkg.Sha256)
+	}
+}
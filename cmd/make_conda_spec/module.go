@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/10XGenomics/rules_conda/buildutil"
+	"github.com/bazelbuild/buildtools/build"
+)
+
+// The data read by the conda module extension to create the same
+// repositories as the conda_environment macro in the lock file.
+type moduleLock struct {
+	// The name of the environment repository.
+	Name string `json:"name"`
+	// The attributes of the conda_environment_repository.
+	Environment map[string]any `json:"environment"`
+	// The attributes of each conda_package_repository, including the name.
+	Packages []map[string]any `json:"packages"`
+}
+
+// makeModuleLock extracts the repositories declared by the
+// conda_environment macro in a lock file.
+func makeModuleLock(file *build.File) (*moduleLock, error) {
+	var def *build.DefStmt
+	for _, expr := range file.Stmt {
+		if d, ok := expr.(*build.DefStmt); ok && d.Name == "conda_environment" {
+			def = d
+			break
+		}
+	}
+	if def == nil {
+		return nil, fmt.Errorf("%s has no conda_environment macro", file.Path)
+	}
+	lock := moduleLock{
+		Name: buildutil.DefaultCondaRepo,
+	}
+	if attr := getAttr("name", def.Params); attr != nil {
+		if name := stringValue(attr.RHS); name != "" {
+			lock.Name = name
+		}
+	}
+	for _, expr := range def.Body {
+		c, ok := expr.(*build.CallExpr)
+		if !ok {
+			continue
+		}
+		switch buildutil.Ident(c.X) {
+		case "conda_package_repository":
+			attrs, err := lock.attrs(c)
+			if err != nil {
+				return nil, err
+			}
+			lock.Packages = append(lock.Packages, attrs)
+		case "conda_environment_repository":
+			attrs, err := lock.attrs(c)
+			if err != nil {
+				return nil, err
+			}
+			delete(attrs, "name")
+			lock.Environment = attrs
+		}
+	}
+	if lock.Environment == nil {
+		return nil, fmt.Errorf("%s has no conda_environment_repository", file.Path)
+	}
+	sort.Slice(lock.Packages, func(i, j int) bool {
+		return lock.Packages[i]["name"].(string) < lock.Packages[j]["name"].(string)
+	})
+	return &lock, nil
+}
+
+// attrs converts the attributes of a repository rule call to json values.
+func (lock *moduleLock) attrs(c *build.CallExpr) (map[string]any, error) {
+	attrs := make(map[string]any, len(c.List))
+	for _, e := range c.List {
+		attr, ok := e.(*build.AssignExpr)
+		if !ok {
+			continue
+		}
+		key := buildutil.Ident(attr.LHS)
+		v, err := lock.value(attr.RHS)
+		if err != nil {
+			return nil, fmt.Errorf("attribute %s of %s: %w",
+				key, buildutil.Ident(c.X), err)
+		}
+		attrs[key] = v
+	}
+	if _, ok := attrs["name"].(string); !ok {
+		return nil, fmt.Errorf("%s has no name", buildutil.Ident(c.X))
+	}
+	return attrs, nil
+}
+
+func (lock *moduleLock) value(e build.Expr) (any, error) {
+	switch e := e.(type) {
+	case *build.StringExpr:
+		return e.Value, nil
+	case *build.LiteralExpr:
+		return strconv.ParseInt(e.Token, 10, 64)
+	case *build.Ident:
+		switch e.Name {
+		case "name":
+			// The parameter of the conda_environment macro.
+			return lock.Name, nil
+		case "True":
+			return true, nil
+		case "False":
+			return false, nil
+		}
+	case *build.ListExpr:
+		list := make([]any, 0, len(e.List))
+		for _, item := range e.List {
+			v, err := lock.value(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case *build.DictExpr:
+		dict := make(map[string]any, len(e.List))
+		for _, kv := range e.List {
+			key, ok := kv.Key.(*build.StringExpr)
+			if !ok {
+				return nil, fmt.Errorf("unsupported dict key %s", build.FormatString(kv.Key))
+			}
+			v, err := lock.value(kv.Value)
+			if err != nil {
+				return nil, err
+			}
+			dict[key.Value] = v
+		}
+		return dict, nil
+	}
+	return nil, fmt.Errorf("unsupported value %s", build.FormatString(e))
+}
+
+// repos returns the names of the repositories, with the environment first.
+func (lock *moduleLock) repos() []string {
+	repos := make([]string, 0, len(lock.Packages)+1)
+	repos = append(repos, lock.Name)
+	for _, pkg := range lock.Packages {
+		repos = append(repos, pkg["name"].(string))
+	}
+	return repos
+}
+
+func (lock *moduleLock) render() ([]byte, error) {
+	b, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// renderModuleLock returns the content of the module extension data file
+// for the given lock file content.
+func renderModuleLock(outName string, content []byte) (*moduleLock, []byte, error) {
+	file, err := build.ParseBzl(outName, content)
+	if err != nil {
+		return nil, nil, err
+	}
+	lock, err := makeModuleLock(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := lock.render()
+	return lock, b, err
+}
+
+// moduleLabel returns a label for the given file, relative to the
+// workspace when run with `bazel run`.
+func moduleLabel(fn string) string {
+	ws := os.Getenv("BUILD_WORKSPACE_DIRECTORY")
+	if ws == "" {
+		return fn
+	}
+	rel, err := filepath.Rel(ws, fn)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return fn
+	}
+	dir, base := filepath.Split(filepath.ToSlash(rel))
+	return "//" + strings.TrimSuffix(dir, "/") + ":" + base
+}
+
+// printUseRepo writes the MODULE.bazel stanza for using the repositories
+// created from the module extension data file.
+func (lock *moduleLock) printUseRepo(w io.Writer, moduleFile string) error {
+	var buf strings.Builder
+	buf.WriteString("Add the following to MODULE.bazel:\n\n")
+	fmt.Fprintf(&buf,
+		"conda = use_extension(%q, \"conda\")\n",
+		"@"+buildutil.BazelRulesConda+"//rules:extensions.bzl")
+	fmt.Fprintf(&buf, "conda.lock(lock = %q)\n", moduleLabel(moduleFile))
+	buf.WriteString("use_repo(\n    conda,\n")
+	for _, repo := range lock.repos() {
+		fmt.Fprintf(&buf, "    %q,\n", repo)
+	}
+	buf.WriteString(")\n")
+	fmt.Fprintf(&buf, "register_toolchains(\"@%s//:python_toolchain\")\n", lock.Name)
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+// writeModuleLock writes the module extension data file for the lock file.
+func writeModuleLock(outName, moduleFile string) (*moduleLock, error) {
+	content, err := os.ReadFile(outName)
+	if err != nil {
+		return nil, err
+	}
+	lock, b, err := renderModuleLock(outName, content)
+	if err != nil {
+		return nil, err
+	}
+	return lock, os.WriteFile(moduleFile, b, 0666)
+}
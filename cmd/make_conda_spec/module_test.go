@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/10XGenomics/rules_conda/buildutil"
+	"github.com/bazelbuild/buildtools/build"
+)
+
+func TestModuleLock(t *testing.T) {
+	file := &build.File{
+		Path: "conda_env.bzl",
+		Stmt: []build.Expr{
+			&build.DefStmt{
+				Name: "conda_environment",
+				Function: build.Function{
+					Params: []build.Expr{
+						buildutil.StrAttr("name", "my_env"),
+					},
+					Body: []build.Expr{
+						&build.CallExpr{
+							X: &build.Ident{Name: "conda_package_repository"},
+							List: []build.Expr{
+								buildutil.StrAttr("name", "conda_package_zlib"),
+								buildutil.StrListAttr("base_urls", "https://conda.anaconda.org/conda-forge/linux-64"),
+								buildutil.StrAttr("dist_name", "zlib-1.3.1-h4ab18f5_1"),
+								buildutil.StrAttr("size", "89141"),
+								buildutil.Attr("conda_repo", &build.Ident{Name: "name"}),
+							},
+						},
+						&build.CallExpr{
+							X: &build.Ident{Name: "conda_package_repository"},
+							List: []build.Expr{
+								buildutil.StrAttr("name", "conda_package_python"),
+								buildutil.Attr("platform_dist_names", &build.DictExpr{
+									List: []*build.KeyValueExpr{{
+										Key:   buildutil.StrExpr("linux-64"),
+										Value: buildutil.StrExpr("python-3.12.3-h0"),
+									}},
+								}),
+							},
+						},
+						&build.CallExpr{
+							X: &build.Ident{Name: "conda_environment_repository"},
+							List: []build.Expr{
+								buildutil.Attr("name", &build.Ident{Name: "name"}),
+								buildutil.StrListAttr("conda_packages", "python", "zlib"),
+								buildutil.Attr("py_version", &build.LiteralExpr{Token: "3"}),
+							},
+						},
+						&build.CallExpr{
+							X: &build.Ident{Name: "native.register_toolchains"},
+						},
+					},
+				},
+			},
+		},
+	}
+	lock, err := makeModuleLock(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := lock.render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data struct {
+		Name        string
+		Environment map[string]any
+		Packages    []map[string]any
+	}
+	if err := json.Unmarshal(b, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Name != "my_env" || data.Environment["py_version"] != 3.0 ||
+		data.Environment["name"] != nil {
+		t.Errorf("unexpected environment %s", b)
+	}
+	if len(data.Packages) != 2 ||
+		data.Packages[0]["name"] != "conda_package_python" ||
+		data.Packages[1]["conda_repo"] != "my_env" ||
+		data.Packages[1]["size"] != "89141" {
+		t.Errorf("unexpected packages %s", b)
+	}
+	var buf strings.Builder
+	t.Setenv("BUILD_WORKSPACE_DIRECTORY", "/src")
+	if err := lock.printUseRepo(&buf, "/src/third-party/conda/conda_env.json"); err != nil {
+		t.Fatal(err)
+	}
+	const want = `conda.lock(lock = "//third-party/conda:conda_env.json")
+use_repo(
+    conda,
+    "my_env",
+    "conda_package_python",
+    "conda_package_zlib",
+)
+register_toolchains("@my_env//:python_toolchain")
+`
+	if got := buf.String(); !strings.HasSuffix(got, want) {
+		t.Errorf("unexpected MODULE.bazel stanza:\n%s", got)
+	}
+	if moduleLabel("/src/conda_env.json") != "//:conda_env.json" {
+		t.Errorf("unexpected label %s", moduleLabel("/src/conda_env.json"))
+	}
+}
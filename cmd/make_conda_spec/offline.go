@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// env adds the environment variables for conda to use the configured
+// package cache.
+func (opts *lockOptions) env(env []string) []string {
+	if opts.pkgDir == "" {
+		return env
+	}
+	return append(env, "CONDA_PKGS_DIRS="+opts.pkgDir)
+}
+
+// missingOffline returns a description of each package in the solution
+// for which the checksum or URL could not be found.
+func missingOffline(specs map[string]*PkgSpec) []string {
+	var missing []string
+	for _, spec := range specs {
+		var what []string
+		if spec.Sha256 == "" {
+			what = append(what, "sha256")
+		}
+		if spec.BaseUrl == "" {
+			what = append(what, "base URL")
+		}
+		if len(what) > 0 {
+			missing = append(missing,
+				spec.DistName+": no "+strings.Join(what, " or "))
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// checkOffline returns an error listing every package, on any platform,
+// which could not be fully resolved without using the network.
+func checkOffline(platforms []string, solutions map[string]map[string]*PkgSpec) error {
+	var buf strings.Builder
+	count := 0
+	for _, platform := range platforms {
+		missing := missingOffline(solutions[platform])
+		if len(missing) == 0 {
+			continue
+		}
+		count += len(missing)
+		fmt.Fprintf(&buf, "\n%s:", platform)
+		for _, m := range missing {
+			buf.WriteString("\n  ")
+			buf.WriteString(m)
+		}
+	}
+	if count == 0 {
+		return nil
+	}
+	return fmt.Errorf(
+		"%d packages could not be resolved from the package cache "+
+			"while offline:%s", count, buf.String())
+}
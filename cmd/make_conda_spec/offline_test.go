@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckOffline(t *testing.T) {
+	solutions := map[string]map[string]*PkgSpec{
+		"linux-64": {
+			"zlib": {
+				DistName: "zlib-1.3.1-h4ab18f5_1",
+				BaseUrl:  "https://conda.anaconda.org/conda-forge/linux-64",
+				Sha256:   "abc",
+			},
+			"click": {
+				DistName: "click-8.1.7-unix_pyh707e725_0",
+			},
+		},
+		"osx-arm64": {
+			"click": {
+				DistName: "click-8.1.7-unix_pyh707e725_0",
+				BaseUrl:  "https://conda.anaconda.org/conda-forge/noarch",
+			},
+		},
+	}
+	err := checkOffline([]string{"linux-64", "osx-arm64"}, solutions)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	const want = `2 packages could not be resolved from the package cache while offline:
+linux-64:
+  click-8.1.7-unix_pyh707e725_0: no sha256 or base URL
+osx-arm64:
+  click-8.1.7-unix_pyh707e725_0: no sha256`
+	if msg := err.Error(); msg != want {
+		t.Errorf("unexpected error:\n%s", msg)
+	}
+	delete(solutions, "osx-arm64")
+	delete(solutions["linux-64"], "click")
+	if err := checkOffline([]string{"linux-64"}, solutions); err != nil {
+		t.Error(err)
+	}
+	if !strings.HasPrefix((&lockOptions{pkgDir: "/pkgs"}).env(nil)[0], "CONDA_PKGS_DIRS=") {
+		t.Error("package cache not passed to conda")
+	}
+}
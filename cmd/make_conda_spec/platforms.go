@@ -0,0 +1,91 @@
+package main
+
+import (
+	"sort"
+)
+
+// mergePlatforms combines the solutions for several platforms into a single
+// set of specs.
+//
+// Packages which resolve to the same archive on every platform, which is
+// generally the case for noarch packages, are shared between platforms.
+// Otherwise, the merged spec holds the package for each platform on which
+// it was found in its Platforms field.
+func mergePlatforms(platforms []string,
+	solutions map[string]map[string]*PkgSpec) map[string]*PkgSpec {
+	if len(platforms) == 1 {
+		return solutions[platforms[0]]
+	}
+	names := make(map[string]struct{})
+	for _, specs := range solutions {
+		for name := range specs {
+			names[name] = struct{}{}
+		}
+	}
+	merged := make(map[string]*PkgSpec, len(names))
+	for name := range names {
+		var first *PkgSpec
+		shared := true
+		for _, p := range platforms {
+			spec := solutions[p][name]
+			if spec == nil {
+				shared = false
+			} else if first == nil {
+				first = spec
+			} else if !spec.sameArchive(first) {
+				shared = false
+			}
+		}
+		result := *first
+		result.Depends = nil
+		if !shared {
+			result.Platforms = make(map[string]*PkgSpec, len(platforms))
+		}
+		for _, p := range platforms {
+			if spec := solutions[p][name]; spec != nil {
+				result.Depends = unionDepends(result.Depends, spec.Depends)
+				if !shared {
+					result.Platforms[p] = spec
+				}
+			}
+		}
+		merged[name] = &result
+	}
+	return merged
+}
+
+// sameArchive returns true if the two specs refer to the same package
+// archive.
+func (spec *PkgSpec) sameArchive(other *PkgSpec) bool {
+	return spec.DistName == other.DistName &&
+		spec.BaseUrl == other.BaseUrl &&
+		spec.Sha256 == other.Sha256
+}
+
+func unionDepends(a, b []string) []string {
+	if len(a) == 0 {
+		return append([]string(nil), b...)
+	}
+	seen := make(map[string]struct{}, len(a)+len(b))
+	for _, d := range a {
+		seen[d] = struct{}{}
+	}
+	for _, d := range b {
+		if _, ok := seen[d]; !ok {
+			seen[d] = struct{}{}
+			a = append(a, d)
+		}
+	}
+	return a
+}
+
+// platformNames returns the sorted list of platforms for which the spec
+// has a platform-specific package.
+func (spec *PkgSpec) platformNames() []string {
+	names := make([]string, 0, len(spec.Platforms))
+	for p := range spec.Platforms {
+		names = append(names, p)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMergePlatforms(t *testing.T) {
+	click := &PkgSpec{
+		Name:     "click",
+		DistName: "click-8.1.7-unix_pyh707e725_0",
+		BaseUrl:  "https://conda.anaconda.org/conda-forge/noarch",
+		Sha256:   "abc",
+		Depends:  []string{"__unix", "python"},
+	}
+	solutions := map[string]map[string]*PkgSpec{
+		"linux-64": {
+			"click": click,
+			"python": {
+				Name:     "python",
+				DistName: "python-3.11.8-hab00c5b_0_cpython",
+				BaseUrl:  "https://conda.anaconda.org/conda-forge/linux-64",
+				Sha256:   "def",
+				Depends:  []string{"libzlib"},
+			},
+			"libzlib": {
+				Name:     "libzlib",
+				DistName: "libzlib-1.3.1-h4ab18f5_1",
+				BaseUrl:  "https://conda.anaconda.org/conda-forge/linux-64",
+			},
+		},
+		"linux-aarch64": {
+			"click": click,
+			"python": {
+				Name:     "python",
+				DistName: "python-3.11.8-h43d1f9e_0_cpython",
+				BaseUrl:  "https://conda.anaconda.org/conda-forge/linux-aarch64",
+				Sha256:   "123",
+				Depends:  []string{"libffi"},
+			},
+		},
+	}
+	merged := mergePlatforms([]string{"linux-64", "linux-aarch64"}, solutions)
+	if len(merged) != 3 {
+		t.Errorf("expected 3 packages, got %d", len(merged))
+	}
+	if c := merged["click"]; c == nil || c.Platforms != nil {
+		t.Error("expected click to be shared")
+	}
+	py := merged["python"]
+	if py == nil {
+		t.FailNow()
+	}
+	if names := strings.Join(py.platformNames(), ","); names != "linux-64,linux-aarch64" {
+		t.Errorf("unexpected platforms %s", names)
+	}
+	if d := py.Platforms["linux-aarch64"].DistName; d != "python-3.11.8-h43d1f9e_0_cpython" {
+		t.Errorf("wrong aarch64 package %s", d)
+	}
+	if d := strings.Join(py.Depends, ","); d != "libzlib,libffi" {
+		t.Errorf("unexpected depends %s", d)
+	}
+	if z := merged["libzlib"]; z == nil || len(z.Platforms) != 1 {
+		t.Error("expected libzlib only on linux-64")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/10XGenomics/rules_conda/buildutil"
+	"github.com/bazelbuild/buildtools/build"
+)
+
+// The name of the variable in the lock file which records the inputs from
+// which it was generated.
+const provenanceVar = "LOCK_PROVENANCE"
+
+// The inputs from which a lock file was generated.
+type lockProvenance struct {
+	// The solver, either the base name of the conda executable or
+	// "builtin".
+	Solver        string
+	SolverVersion string
+	Channels      []string
+	Platforms     []string
+	Virtual       virtualOverrides
+	Exclude       []string
+	Extra         []string
+	// The sha256 of the content of the requirements file.
+	RequirementsSha256 string
+	// The name of each additional environment and the sha256 of its
+	// requirements file, as name=sha256.
+	Environments []string
+	// The channels of each additional environment, in order, as
+	// name=channel.
+	EnvironmentChannels []string
+}
+
+// makeProvenance describes the current inputs.
+func makeProvenance(solver, conda, requirements string,
+	channels, platforms, exclude, extra []string,
+	virtual virtualOverrides, envs []*lockEnvironment) (*lockProvenance, error) {
+	p := lockProvenance{
+		Solver:    solver,
+		Channels:  channels,
+		Platforms: platforms,
+		Virtual:   virtual,
+		Exclude:   exclude,
+		Extra:     extra,
+	}
+	if solver == "conda" && conda != "" {
+		p.Solver = path.Base(conda)
+		p.SolverVersion = solverVersion(conda)
+	}
+	if requirements != "" {
+		sum, err := fileSha256(requirements)
+		if err != nil {
+			return nil, err
+		}
+		p.RequirementsSha256 = sum
+	}
+	for _, env := range envs {
+		sum, err := fileSha256(env.requirements)
+		if err != nil {
+			return nil, err
+		}
+		p.Environments = append(p.Environments, env.name+"="+sum)
+		for _, c := range env.channels {
+			p.EnvironmentChannels = append(p.EnvironmentChannels, env.name+"="+c)
+		}
+	}
+	return &p, nil
+}
+
+func fileSha256(fn string) (string, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// solverVersion returns the version reported by the conda executable, or the
+// empty string if it could not be determined.
+func solverVersion(conda string) string {
+	condaPath := path.Dir(conda) + string([]rune{os.PathListSeparator}) + os.Getenv("PATH")
+	cmd := makeCmd(conda, condaPath, "--version")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return ""
+	}
+	// conda prints "conda 24.1.2" while micromamba prints only the version.
+	v := strings.TrimSpace(out.String())
+	if _, after, ok := strings.Cut(v, " "); ok {
+		v = after
+	}
+	return v
+}
+
+// fields returns the name and a description of the value of each field, in
+// the order in which they are written.
+func (p *lockProvenance) fields() [][2]string {
+	virtual := make([]string, 0, len(p.Virtual))
+	for _, name := range p.Virtual.names() {
+		virtual = append(virtual, name+"="+p.Virtual[name])
+	}
+	return [][2]string{
+		{"solver", p.Solver},
+		{"solver_version", p.SolverVersion},
+		{"channels", strings.Join(p.Channels, ",")},
+		{"platforms", strings.Join(p.Platforms, ",")},
+		{"virtual_packages", strings.Join(virtual, ",")},
+		{"exclude", strings.Join(p.Exclude, ",")},
+		{"extra", strings.Join(p.Extra, ",")},
+		{"requirements_sha256", p.RequirementsSha256},
+		{"environments", strings.Join(p.Environments, ",")},
+		{"environment_channels", strings.Join(p.EnvironmentChannels, ",")},
+	}
+}
+
+// dict returns the provenance as a Starlark dict.
+func (p *lockProvenance) dict() *build.DictExpr {
+	str := func(s string) build.Expr {
+		return buildutil.StrExpr(s)
+	}
+	list := func(l []string) build.Expr {
+		return buildutil.ListExpr(buildutil.StrExprList(l...)...)
+	}
+	virtual := p.Virtual.dict()
+	if virtual == nil {
+		virtual = &build.DictExpr{}
+	}
+	values := [...]build.Expr{
+		str(p.Solver),
+		str(p.SolverVersion),
+		list(p.Channels),
+		list(p.Platforms),
+		virtual,
+		list(p.Exclude),
+		list(p.Extra),
+		str(p.RequirementsSha256),
+		list(p.Environments),
+		list(p.EnvironmentChannels),
+	}
+	dict := &build.DictExpr{ForceMultiLine: true}
+	for i, f := range p.fields() {
+		dict.List = append(dict.List, &build.KeyValueExpr{
+			Key:   buildutil.StrExpr(f[0]),
+			Value: values[i],
+		})
+	}
+	return dict
+}
+
+// readProvenance returns the provenance recorded in an existing lock file,
+// or nil if there is none.
+func readProvenance(file *build.File) *lockProvenance {
+	dict, ok := moduleVar(file, provenanceVar).(*build.DictExpr)
+	if !ok {
+		return nil
+	}
+	var p lockProvenance
+	for _, kv := range dict.List {
+		switch stringValue(kv.Key) {
+		case "solver":
+			p.Solver = stringValue(kv.Value)
+		case "solver_version":
+			p.SolverVersion = stringValue(kv.Value)
+		case "channels":
+			p.Channels = stringList(kv.Value)
+		case "platforms":
+			p.Platforms = stringList(kv.Value)
+		case "virtual_packages":
+			if d, ok := kv.Value.(*build.DictExpr); ok {
+				p.Virtual = parseVirtualDict(d)
+			}
+		case "exclude":
+			p.Exclude = stringList(kv.Value)
+		case "extra":
+			p.Extra = stringList(kv.Value)
+		case "requirements_sha256":
+			p.RequirementsSha256 = stringValue(kv.Value)
+		case "environments":
+			p.Environments = stringList(kv.Value)
+		case "environment_channels":
+			p.EnvironmentChannels = stringList(kv.Value)
+		}
+	}
+	return &p
+}
+
+// setProvenance records the provenance in the lock file.
+func setProvenance(file *build.File, p *lockProvenance) {
+	setModuleVar(file, provenanceVar,
+		"The inputs from which this file was generated.",
+		p.dict())
+}
+
+// compare returns a description of each field which differs between the
+// recorded provenance and the current inputs.
+func (p *lockProvenance) compare(current *lockProvenance) []string {
+	var diffs []string
+	cur := current.fields()
+	for i, f := range p.fields() {
+		if f[1] != cur[i][1] {
+			diffs = append(diffs, fmt.Sprintf("%s: recorded %q, now %q",
+				f[0], f[1], cur[i][1]))
+		}
+	}
+	return diffs
+}
+
+// checkProvenance returns an error listing the differences if the lock file
+// was not generated from the current inputs.
+func checkProvenance(outName string, file *build.File, current *lockProvenance) error {
+	recorded := readProvenance(file)
+	if recorded == nil {
+		return fmt.Errorf("%s does not record the inputs it was generated from", outName)
+	}
+	if diffs := recorded.compare(current); len(diffs) > 0 {
+		return fmt.Errorf("%s was generated from different inputs:\n  %s",
+			outName, strings.Join(diffs, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/buildtools/build"
+)
+
+func TestProvenance(t *testing.T) {
+	reqs := filepath.Join(t.TempDir(), "requirements.txt")
+	if err := os.WriteFile(reqs, []byte("python 3.12.*\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	prov, err := makeProvenance("builtin", "", reqs,
+		[]string{"conda-forge"}, []string{"linux-64", "osx-arm64"},
+		[]string{"tk"}, nil, virtualOverrides{"__glibc": "2.28"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prov.Solver != "builtin" || len(prov.RequirementsSha256) != 64 {
+		t.Errorf("unexpected provenance %+v", prov)
+	}
+	file := &build.File{
+		Stmt: []build.Expr{
+			&build.LoadStmt{},
+			&build.DefStmt{Name: "conda_environment"},
+		},
+	}
+	if err := checkProvenance("lock.bzl", file, prov); err == nil {
+		t.Error("expected an error without recorded provenance")
+	}
+	setProvenance(file, prov)
+	if err := checkProvenance("lock.bzl", file, prov); err != nil {
+		t.Error(err)
+	}
+	recorded := readProvenance(file)
+	if strings.Join(recorded.Platforms, ",") != "linux-64,osx-arm64" ||
+		recorded.Virtual["__glibc"] != "2.28" ||
+		recorded.RequirementsSha256 != prov.RequirementsSha256 {
+		t.Errorf("unexpected recorded provenance %+v", recorded)
+	}
+	if err := os.WriteFile(reqs, []byte("python 3.11.*\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := makeProvenance("builtin", "", reqs,
+		[]string{"conda-forge", "bioconda"}, []string{"linux-64", "osx-arm64"},
+		[]string{"tk"}, nil, virtualOverrides{"__glibc": "2.28"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkProvenance("lock.bzl", file, changed)
+	if err == nil {
+		t.Fatal("expected an error for changed inputs")
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, `channels: recorded "conda-forge", now "conda-forge,bioconda"`) ||
+		!strings.Contains(msg, "requirements_sha256") ||
+		strings.Contains(msg, "platforms") {
+		t.Errorf("unexpected error:\n%s", msg)
+	}
+}
+
+func TestProvenanceEnvironmentChannels(t *testing.T) {
+	reqs := filepath.Join(t.TempDir(), "requirements.txt")
+	if err := os.WriteFile(reqs, []byte("python 3.12.*\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	env := &lockEnvironment{
+		name:         "dev",
+		requirements: reqs,
+		channels:     []string{"conda-forge", "bioconda"},
+	}
+	prov, err := makeProvenance("builtin", "", reqs, []string{"conda-forge"},
+		[]string{"linux-64"}, nil, nil, nil, []*lockEnvironment{env})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := strings.Join(prov.EnvironmentChannels, ","); c != "dev=conda-forge,dev=bioconda" {
+		t.Errorf("unexpected environment channels %s", c)
+	}
+	file := &build.File{}
+	setProvenance(file, prov)
+	env.channels = []string{"conda-forge"}
+	changed, err := makeProvenance("builtin", "", reqs, []string{"conda-forge"},
+		[]string{"linux-64"}, nil, nil, nil, []*lockEnvironment{env})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkProvenance("lock.bzl", file, changed); err == nil ||
+		!strings.Contains(err.Error(), "environment_channels") {
+		t.Errorf("expected the changed channels to be reported, got %v", err)
+	}
+}
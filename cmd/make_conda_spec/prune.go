@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// pruneUnreachable removes the packages which cannot be reached through the
+// dependency graph from any of the directly requested packages, for
+// example because they were only needed by an excluded package.  It
+// returns the dist names of the removed packages.
+//
+// Because every remaining package is reachable, all of its dependencies
+// are either still present or were excluded, so the exclude_deps of the
+// generated rules remain consistent.
+//
+// If the dependencies of any reachable package are not known, nothing is
+// pruned, since the packages it depends on would wrongly appear to be
+// unreachable.
+func pruneUnreachable(specs map[string]*PkgSpec, direct map[string]string) ([]string, error) {
+	roots := make([]string, 0, len(direct))
+	for name := range direct {
+		roots = append(roots, name)
+	}
+	reachable := requiredBy(specs, roots)
+	var unknown []string
+	for name := range reachable {
+		if spec := specs[name]; spec != nil && spec.dependsUnknown {
+			unknown = append(unknown, spec.DistName)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf(
+			"cannot prune, because the dependencies of %d packages are not "+
+				"known from the solver or the package cache:\n  %s",
+			len(unknown), strings.Join(unknown, "\n  "))
+	}
+	var pruned []string
+	for name, spec := range specs {
+		if _, ok := reachable[name]; !ok {
+			pruned = append(pruned, spec.DistName)
+			delete(specs, name)
+		}
+	}
+	sort.Strings(pruned)
+	return pruned, nil
+}
+
+// printPruned reports the packages removed by pruneUnreachable.
+func printPruned(w io.Writer, platform string, pruned []string) error {
+	var buf strings.Builder
+	if platform != "" {
+		fmt.Fprintf(&buf, "%s: ", platform)
+	}
+	fmt.Fprintf(&buf, "Pruned %d packages which are no longer required:\n", len(pruned))
+	for _, dist := range pruned {
+		buf.WriteString("  ")
+		buf.WriteString(dist)
+		buf.WriteByte('\n')
+	}
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
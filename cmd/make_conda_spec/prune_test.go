@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPruneUnreachable(t *testing.T) {
+	// jupyter was excluded, leaving its dependencies behind.
+	specs := map[string]*PkgSpec{
+		"numpy":     {Name: "numpy", DistName: "numpy-2.0.0-py312_0", Depends: []string{"python", "__glibc"}},
+		"python":    {Name: "python", DistName: "python-3.12.3-h0", Depends: []string{"zlib", "pip"}},
+		"pip":       {Name: "pip", DistName: "pip-24.0-pyhd8ed1ab_0", Depends: []string{"python"}},
+		"zlib":      {Name: "zlib", DistName: "zlib-1.3.1-h0"},
+		"tornado":   {Name: "tornado", DistName: "tornado-6.4-py312_0", Depends: []string{"python", "zeromq"}},
+		"zeromq":    {Name: "zeromq", DistName: "zeromq-4.3.5-h0", Depends: []string{"libsodium"}},
+		"libsodium": {Name: "libsodium", DistName: "libsodium-1.0.18-h0"},
+	}
+	pruned, err := pruneUnreachable(specs, map[string]string{
+		"numpy":   "numpy >=2",
+		"jupyter": "jupyter",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(pruned, ","); got !=
+		"libsodium-1.0.18-h0,tornado-6.4-py312_0,zeromq-4.3.5-h0" {
+		t.Errorf("unexpected pruned packages %s", got)
+	}
+	if len(specs) != 4 || specs["zlib"] == nil || specs["pip"] == nil {
+		t.Errorf("unexpected remaining packages %v", specs)
+	}
+	for _, spec := range specs {
+		for _, d := range spec.Depends {
+			if _, ok := specs[d]; !ok && !strings.HasPrefix(d, "__") {
+				t.Errorf("%s depends on pruned package %s", spec.Name, d)
+			}
+		}
+	}
+	var buf strings.Builder
+	if err := printPruned(&buf, "linux-64", pruned[:1]); err != nil {
+		t.Fatal(err)
+	}
+	const want = "linux-64: Pruned 1 packages which are no longer required:\n  libsodium-1.0.18-h0\n"
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected report %q", got)
+	}
+}
+
+func TestPruneUnknownDepends(t *testing.T) {
+	// python was linked from the package cache, so conda did not report
+	// its dependencies.
+	specs := map[string]*PkgSpec{
+		"numpy":  {Name: "numpy", DistName: "numpy-2.0.0-py312_0", Depends: []string{"python"}},
+		"python": {Name: "python", DistName: "python-3.12.3-h0", dependsUnknown: true},
+		"zlib":   {Name: "zlib", DistName: "zlib-1.3.1-h0"},
+	}
+	if _, err := pruneUnreachable(specs, map[string]string{"numpy": "numpy"}); err == nil ||
+		!strings.Contains(err.Error(), "python-3.12.3-h0") {
+		t.Errorf("expected an error naming python, got %v", err)
+	}
+	if len(specs) != 3 {
+		t.Errorf("expected nothing to be pruned, got %v", specs)
+	}
+	pkgDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(pkgDir, "python-3.12.3-h0", "info"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(pkgDir, "python-3.12.3-h0", "info", "index.json"),
+		[]byte(`{"name": "python", "depends": ["zlib >=1.3.1,<2.0a0"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fillDepends(specs, nil, pkgDir)
+	if d := strings.Join(specs["python"].Depends, ","); d != "zlib" {
+		t.Errorf("unexpected python depends %s", d)
+	}
+	pruned, err := pruneUnreachable(specs, map[string]string{"numpy": "numpy"})
+	if err != nil || len(pruned) != 0 {
+		t.Errorf("expected nothing to be pruned, got %v, %v", pruned, err)
+	}
+}
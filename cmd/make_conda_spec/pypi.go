@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/10XGenomics/rules_conda/buildutil"
+	"github.com/bazelbuild/buildtools/build"
+)
+
+// readPypiNames reads a table mapping conda package names to the names of
+// the PyPI distributions they provide.  Each line has a conda package name
+// followed by one or more PyPI names, separated by whitespace.  Blank lines
+// and lines starting with `#` are ignored.
+func readPypiNames(fn string) (map[string][]string, error) {
+	if fn == "" {
+		return nil, nil
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names := make(map[string][]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: no PyPI names for %s", fn, line, fields[0])
+		}
+		names[fields[0]] = append(names[fields[0]], fields[1:]...)
+	}
+	return names, scanner.Err()
+}
+
+// The locations of python distribution metadata files within an extracted
+// conda package.  noarch: python packages put site-packages at the top level.
+var distMetadataGlobs = [...]string{
+	"lib/python*/site-packages/*.dist-info/METADATA",
+	"lib/python*/site-packages/*.egg-info/PKG-INFO",
+	"Lib/site-packages/*.dist-info/METADATA",
+	"site-packages/*.dist-info/METADATA",
+	"site-packages/*.egg-info/PKG-INFO",
+}
+
+// distInfoNames returns the PyPI distribution names declared by the python
+// metadata in the extracted package in the package cache directory, if it
+// has been extracted there.
+func distInfoNames(pkgDir, distName string) []string {
+	var names []string
+	for _, pattern := range distMetadataGlobs {
+		files, _ := filepath.Glob(filepath.Join(pkgDir, distName, pattern))
+		for _, fn := range files {
+			if name := metadataName(fn); name != "" && !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// metadataName reads the Name header from a python core metadata file.
+func metadataName(fn string) string {
+	f, err := os.Open(fn)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			// The end of the headers.
+			break
+		}
+		if key, value, ok := strings.Cut(line, ":"); ok && key == "Name" {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// pypiNames returns the PyPI distribution names for each package, from the
+// table if the package is listed there, or otherwise from the metadata of
+// the extracted packages in the package cache directory.  It also returns
+// the sorted dist names of the packages which are not in the table and
+// have not been extracted there, so could not be checked.
+func pypiNames(specs map[string]*PkgSpec, table map[string][]string,
+	pkgDir string) (map[string][]string, []string) {
+	names := make(map[string][]string)
+	var missing []string
+	for name, spec := range specs {
+		if pypi, ok := table[name]; ok {
+			names[name] = pypi
+			continue
+		}
+		found := false
+		for _, dist := range specDists(spec) {
+			if !isExtracted(pkgDir, dist) {
+				continue
+			}
+			found = true
+			if pypi := distInfoNames(pkgDir, dist); len(pypi) > 0 {
+				names[name] = pypi
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, spec.DistName)
+		}
+	}
+	sort.Strings(missing)
+	return names, missing
+}
+
+// specDists returns the dist names of the package on every platform.
+func specDists(spec *PkgSpec) []string {
+	dists := []string{spec.DistName}
+	for _, p := range spec.platformNames() {
+		dists = append(dists, spec.Platforms[p].DistName)
+	}
+	return dists
+}
+
+// isExtracted returns true if the package has been extracted in the
+// package cache directory, so its metadata can be read.
+func isExtracted(pkgDir, distName string) bool {
+	if distName == "" {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(pkgDir, distName, "info"))
+	return err == nil && info.IsDir()
+}
+
+// warnMissingMetadata reports the packages whose metadata was not found in
+// the package cache directory.
+func warnMissingMetadata(w io.Writer, pkgDir, purpose string, missing []string) {
+	if len(missing) > 0 {
+		fmt.Fprintf(w,
+			"WARNING: no package metadata in %s for %d packages, "+
+				"so they were not checked for %s:\n  %s\n",
+			pkgDir, len(missing), purpose, strings.Join(missing, "\n  "))
+	}
+}
+
+// defaultAlias returns the alias which conda_environment_repository adds
+// automatically for a package.
+func defaultAlias(pkg string) string {
+	return distNameClean.Replace(pkg)
+}
+
+// pipAliases returns aliases from the PyPI name of each package to the
+// package, for those which differ from the package name.  Aliases which
+// would collide with a package name, or which are claimed by more than one
+// package, are reported to w and omitted.
+func pipAliases(w io.Writer, pkgs []string, pypi map[string][]string) map[string]string {
+	// Target names which are already taken, mapped to the package which
+	// takes them.
+	taken := make(map[string]string, 2*len(pkgs))
+	for _, pkg := range pkgs {
+		taken[pkg] = pkg
+		taken[defaultAlias(pkg)] = pkg
+	}
+	pkgs = append([]string(nil), pkgs...)
+	sort.Strings(pkgs)
+	aliases := make(map[string]string)
+	claims := make(map[string][]string)
+	for _, pkg := range pkgs {
+		for _, name := range pypi[pkg] {
+			if name == pkg || name == defaultAlias(pkg) {
+				continue
+			}
+			if other, ok := taken[name]; ok {
+				if other != pkg {
+					fmt.Fprintf(w,
+						"WARNING: PyPI name %s of %s collides with package %s; "+
+							"not adding an alias.\n",
+						name, pkg, other)
+				}
+				continue
+			}
+			claims[name] = append(claims[name], pkg)
+			aliases[name] = pkg
+		}
+	}
+	for _, name := range sortedKeys(claims) {
+		if claimants := claims[name]; len(claimants) > 1 {
+			fmt.Fprintf(w,
+				"WARNING: PyPI name %s is provided by %s; "+
+					"not adding an alias.\n",
+				name, strings.Join(claimants, " and "))
+			delete(aliases, name)
+		}
+	}
+	return aliases
+}
+
+// mergeAliases adds the aliases to the dict of existing aliases, which
+// take precedence.  Added aliases are marked as detected, and previously
+// detected aliases are removed if their package is no longer one of pkgs,
+// while aliases added by hand are left untouched.  Conflicting existing
+// aliases are reported to w.
+func mergeAliases(w io.Writer, dict *build.DictExpr, aliases map[string]string,
+	pkgs map[string]struct{}) *build.DictExpr {
+	if dict == nil {
+		dict = &build.DictExpr{ForceMultiLine: true}
+	}
+	existing := make(map[string]string, len(dict.List))
+	kept := dict.List[:0]
+	for _, kv := range dict.List {
+		actual := stringValue(kv.Value)
+		if _, ok := pkgs[actual]; !ok && isDetected(kv) {
+			continue
+		}
+		existing[stringValue(kv.Key)] = actual
+		kept = append(kept, kv)
+	}
+	dict.List = kept
+	added := false
+	for _, name := range sortedKeys(aliases) {
+		actual := aliases[name]
+		if old, ok := existing[name]; ok {
+			if old != actual {
+				fmt.Fprintf(w,
+					"WARNING: existing alias %s for %s collides with the "+
+						"PyPI name of %s; keeping the existing alias.\n",
+					name, old, actual)
+			}
+			continue
+		}
+		kv := &build.KeyValueExpr{
+			Key:   buildutil.StrExpr(name),
+			Value: buildutil.StrExpr(actual),
+		}
+		kv.Comments.Suffix = []build.Comment{{Token: detectedComment}}
+		dict.List = append(dict.List, kv)
+		added = true
+	}
+	if added {
+		dict.ForceMultiLine = true
+		sort.SliceStable(dict.List, func(i, j int) bool {
+			return stringValue(dict.List[i].Key) < stringValue(dict.List[j].Key)
+		})
+	}
+	return dict
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/10XGenomics/rules_conda/buildutil"
+	"github.com/bazelbuild/buildtools/build"
+)
+
+func TestPypiNames(t *testing.T) {
+	dir := t.TempDir()
+	write := func(fn, content string) {
+		t.Helper()
+		fn = filepath.Join(dir, fn)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("pyyaml-6.0.1-py312h98912ed_1/info/index.json", "{}")
+	write("attrs-23.2.0-pyh71513ae_0/info/index.json", "{}")
+	write("pyyaml-6.0.1-py312h98912ed_1/lib/python3.12/site-packages/"+
+		"PyYAML-6.0.1.dist-info/METADATA",
+		"Metadata-Version: 2.1\nName: PyYAML\nVersion: 6.0.1\n\nName: not a header\n")
+	write("attrs-23.2.0-pyh71513ae_0/site-packages/attrs-23.2.0.dist-info/METADATA",
+		"Metadata-Version: 2.1\nName: attrs\n")
+	write("pypi_names.txt", "# conda name, then PyPI names\npy-opencv opencv-python\n\n")
+	table, err := readPypiNames(filepath.Join(dir, "pypi_names.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	specs := map[string]*PkgSpec{
+		"pyyaml":    {Name: "pyyaml", DistName: "pyyaml-6.0.1-py312h98912ed_1"},
+		"attrs":     {Name: "attrs", DistName: "attrs-23.2.0-pyh71513ae_0"},
+		"py-opencv": {Name: "py-opencv", DistName: "py-opencv-4.9.0-py312h0"},
+		"zlib":      {Name: "zlib", DistName: "zlib-1.3.1-h0"},
+	}
+	write("zlib-1.3.1-h0/info/index.json", "{}")
+	specs["numpy"] = &PkgSpec{Name: "numpy", DistName: "numpy-1.26.4-py312h0"}
+	names, missing := pypiNames(specs, table, dir)
+	if m := strings.Join(missing, ","); m != "numpy-1.26.4-py312h0" {
+		t.Errorf("unexpected packages without metadata %s", m)
+	}
+	if len(names) != 3 ||
+		strings.Join(names["pyyaml"], ",") != "PyYAML" ||
+		strings.Join(names["attrs"], ",") != "attrs" ||
+		strings.Join(names["py-opencv"], ",") != "opencv-python" {
+		t.Errorf("unexpected PyPI names %v", names)
+	}
+
+	// Add some collisions.
+	names["importlib-metadata"] = []string{"importlib-metadata"}
+	names["importlib_metadata"] = []string{"importlib-metadata"}
+	names["opencv"] = []string{"opencv-python"}
+	names["zlib"] = []string{"attrs"}
+	var buf strings.Builder
+	aliases := pipAliases(&buf, []string{
+		"attrs",
+		"importlib-metadata",
+		"importlib_metadata",
+		"opencv",
+		"py-opencv",
+		"pyyaml",
+		"zlib",
+	}, names)
+	if len(aliases) != 1 || aliases["PyYAML"] != "pyyaml" {
+		t.Errorf("unexpected aliases %v", aliases)
+	}
+	if got := buf.String(); got != "WARNING: PyPI name importlib-metadata of "+
+		"importlib_metadata collides with package importlib-metadata; "+
+		"not adding an alias.\n"+
+		"WARNING: PyPI name attrs of zlib collides with package attrs; "+
+		"not adding an alias.\n"+
+		"WARNING: PyPI name opencv-python is provided by opencv and "+
+		"py-opencv; not adding an alias.\n" {
+		t.Errorf("unexpected warnings:\n%s", got)
+	}
+
+	buf.Reset()
+	dict := &build.DictExpr{List: []*build.KeyValueExpr{{
+		Key:   buildutil.StrExpr("yaml"),
+		Value: buildutil.StrExpr("pyyaml"),
+	}, {
+		Key:   buildutil.StrExpr("PyYAML"),
+		Value: buildutil.StrExpr("ruamel.yaml"),
+	}}}
+	stale := &build.KeyValueExpr{
+		Key:   buildutil.StrExpr("Pillow"),
+		Value: buildutil.StrExpr("pillow"),
+	}
+	stale.Comments.Suffix = []build.Comment{{Token: detectedComment}}
+	dict.List = append(dict.List, stale, &build.KeyValueExpr{
+		Key:   buildutil.StrExpr("Jinja2"),
+		Value: buildutil.StrExpr("jinja2"),
+	})
+	dict = mergeAliases(&buf, dict, map[string]string{
+		"PyYAML":        "pyyaml",
+		"opencv-python": "py-opencv",
+	}, map[string]struct{}{
+		"pyyaml":      {},
+		"py-opencv":   {},
+		"ruamel.yaml": {},
+	})
+	var merged []string
+	for _, kv := range dict.List {
+		merged = append(merged, stringValue(kv.Key)+"="+stringValue(kv.Value))
+	}
+	// The detected alias for pillow is removed, since pillow is gone, but
+	// the one for jinja2 was added by hand.
+	if got := strings.Join(merged, ","); got !=
+		"Jinja2=jinja2,PyYAML=ruamel.yaml,opencv-python=py-opencv,yaml=pyyaml" {
+		t.Errorf("unexpected merged aliases %s", got)
+	}
+	for _, kv := range dict.List {
+		if detected := isDetected(kv); detected !=
+			(stringValue(kv.Key) == "opencv-python") {
+			t.Errorf("alias %s detected: %v", stringValue(kv.Key), detected)
+		}
+	}
+	if !strings.Contains(buf.String(), "existing alias PyYAML for ruamel.yaml") {
+		t.Errorf("expected a collision warning, got %q", buf.String())
+	}
+}
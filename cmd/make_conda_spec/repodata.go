@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A package record from a channel's repodata.json.
+type repoRecord struct {
+	Name        string   `json:"name"`
+	Version     string   `json:"version"`
+	Build       string   `json:"build"`
+	BuildNumber int      `json:"build_number"`
+	Depends     []string `json:"depends"`
+	Constrains  []string `json:"constrains"`
+	Sha256      string   `json:"sha256"`
+	Md5         string   `json:"md5"`
+	Size        int64    `json:"size"`
+	Subdir      string   `json:"subdir"`
+	Timestamp   int64    `json:"timestamp"`
+
+	// The file name of the package archive.
+	fileName string
+	// The channel this record was loaded from.
+	channel *repoChannel
+	// The subdirectory of the channel this record was loaded from.
+	subdir  string
+	version condaVersion
+	// Parsed versions of Depends and Constrains.
+	depends    []*MatchSpec
+	constrains []*MatchSpec
+}
+
+// The dist name of the package, e.g. `python-3.12.0-hab00c5b_0_cpython`.
+func (r *repoRecord) distName() string {
+	if n, ok := strings.CutSuffix(r.fileName, ".tar.bz2"); ok {
+		return n
+	}
+	return strings.TrimSuffix(r.fileName, ".conda")
+}
+
+func (r *repoRecord) baseUrl() string {
+	return r.channel.subdirUrl(r.subdir)
+}
+
+// A channel from which packages can be resolved.
+type repoChannel struct {
+	// The channel as specified on the command line.
+	name string
+	// The local directory containing the channel.
+	dir string
+	// The base URL for the channel, which may differ from the local
+	// directory if the repodata specifies a base_url.
+	url string
+	// Overridden base URLs for each subdir, from `info.base_url` in the
+	// repodata.
+	baseUrls map[string]string
+}
+
+func (c *repoChannel) subdirUrl(subdir string) string {
+	if u := c.baseUrls[subdir]; u != "" {
+		return u
+	}
+	return c.url + "/" + subdir
+}
+
+// localChannel resolves a channel given as a `file://` URL or a path to a
+// local directory.
+func localChannel(channel string) (*repoChannel, error) {
+	dir := channel
+	if strings.HasPrefix(channel, "file://") {
+		u, err := url.Parse(channel)
+		if err != nil {
+			return nil, fmt.Errorf("invalid channel URL %q: %w", channel, err)
+		}
+		dir = u.Path
+	} else if strings.Contains(channel, "://") {
+		return nil, fmt.Errorf(
+			"channel %q is not local; the builtin solver only supports "+
+				"file:// URLs and directories", channel)
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("channel %q: %w", channel, err)
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("channel %q is not a directory", channel)
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &repoChannel{
+		name:     channel,
+		dir:      dir,
+		url:      (&url.URL{Scheme: "file", Path: filepath.ToSlash(dir)}).String(),
+		baseUrls: make(map[string]string),
+	}, nil
+}
+
+// loadSubdir reads the repodata.json for the given subdir of the channel,
+// keeping the records for archives of the given format.  It returns nil,
+// without error, if the channel does not have that subdir.
+func (c *repoChannel) loadSubdir(subdir string, format archiveFormat) ([]*repoRecord, error) {
+	b, err := os.ReadFile(filepath.Join(c.dir, subdir, "repodata.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var repodata struct {
+		Info struct {
+			Subdir  string `json:"subdir"`
+			BaseUrl string `json:"base_url"`
+		} `json:"info"`
+		Packages      map[string]*repoRecord `json:"packages"`
+		PackagesConda map[string]*repoRecord `json:"packages.conda"`
+	}
+	if err := json.Unmarshal(b, &repodata); err != nil {
+		return nil, fmt.Errorf("parsing repodata for %s/%s: %w", c.name, subdir, err)
+	}
+	if repodata.Info.BaseUrl != "" {
+		c.baseUrls[subdir] = strings.TrimSuffix(repodata.Info.BaseUrl, "/")
+	}
+	// Prefer .conda archives where both are available, as mamba does.
+	byDist := make(map[string]*repoRecord,
+		len(repodata.Packages)+len(repodata.PackagesConda))
+	if format.useRecord(extTarBz2) {
+		for fn, r := range repodata.Packages {
+			r.fileName = fn
+			byDist[r.distName()] = r
+		}
+	}
+	if format.useRecord(extConda) {
+		for fn, r := range repodata.PackagesConda {
+			r.fileName = fn
+			byDist[r.distName()] = r
+		}
+	}
+	records := make([]*repoRecord, 0, len(byDist))
+	for _, r := range byDist {
+		r.channel = c
+		r.subdir = subdir
+		if r.Subdir == "" {
+			r.Subdir = subdir
+		}
+		r.version = parseVersion(r.Version)
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// parseDeps parses the depends and constrains lists of the record.  They are
+// only stored once both parse successfully, so that a failure is reported
+// again on every call rather than leaving the record partly parsed.
+func (r *repoRecord) parseDeps() error {
+	if r.depends != nil || r.constrains != nil {
+		return nil
+	}
+	depends := make([]*MatchSpec, 0, len(r.Depends))
+	for _, d := range r.Depends {
+		spec, err := ParseMatchSpec(d)
+		if err != nil {
+			return fmt.Errorf("%s: dependency %q: %w", r.fileName, d, err)
+		}
+		depends = append(depends, spec)
+	}
+	constrains := make([]*MatchSpec, 0, len(r.Constrains))
+	for _, d := range r.Constrains {
+		spec, err := ParseMatchSpec(d)
+		if err != nil {
+			return fmt.Errorf("%s: constraint %q: %w", r.fileName, d, err)
+		}
+		constrains = append(constrains, spec)
+	}
+	r.depends, r.constrains = depends, constrains
+	return nil
+}
+
+// A set of packages available to the solver, indexed by name.
+//
+// Candidates for each name are ordered by preference: channel priority
+// first, and then by descending version, build number, and timestamp.
+type repoIndex map[string][]*repoRecord
+
+// loadIndex loads the repodata for the given channels, for the given
+// architecture and noarch.
+//
+// Channel priority is strict: if a package is found in a channel, then
+// candidates from lower-priority channels are ignored.
+func loadIndex(channels []string, arch string, format archiveFormat) (repoIndex, error) {
+	index := make(repoIndex)
+	for _, ch := range channels {
+		c, err := localChannel(ch)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		chanIndex := make(repoIndex)
+		for _, subdir := range []string{arch, "noarch"} {
+			records, err := c.loadSubdir(subdir, format)
+			if err != nil {
+				return nil, err
+			}
+			if records != nil {
+				found = true
+			}
+			for _, r := range records {
+				chanIndex[r.Name] = append(chanIndex[r.Name], r)
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf(
+				"channel %q has no repodata.json for %s or noarch", ch, arch)
+		}
+		for name, records := range chanIndex {
+			if _, ok := index[name]; !ok {
+				index[name] = records
+			}
+		}
+	}
+	for _, records := range index {
+		sort.Slice(records, func(i, j int) bool {
+			a, b := records[i], records[j]
+			if c := a.version.compare(&b.version); c != 0 {
+				return c > 0
+			}
+			if a.BuildNumber != b.BuildNumber {
+				return a.BuildNumber > b.BuildNumber
+			}
+			if a.Timestamp != b.Timestamp {
+				return a.Timestamp > b.Timestamp
+			}
+			return a.fileName < b.fileName
+		})
+	}
+	return index, nil
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The maximum number of candidate packages the solver will try before
+// giving up.
+const maxSolverSteps = 1000000
+
+// readRequirements parses a requirements file in the format accepted by
+// `conda create --file`.
+func readRequirements(requirements string) ([]*MatchSpec, error) {
+	f, err := os.Open(requirements)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var specs []*MatchSpec
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		spec, err := ParseMatchSpec(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", requirements, line, err)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, scanner.Err()
+}
+
+// virtualPackages returns the virtual packages which are assumed to be
+// present on the target platform.
+//
+// As with conda, the versions can be overridden with environment variables
+// such as `CONDA_OVERRIDE_GLIBC`, or by the given overrides.  Setting an
+// explicit override to the empty string removes the package, while an empty
+// environment variable is ignored.
+func virtualPackages(arch string, overrides virtualOverrides) []*repoRecord {
+	platform, cpu, _ := strings.Cut(arch, "-")
+	virtual := func(name, version, build string) *repoRecord {
+		if v, ok := overrides.lookup(name); ok {
+			if v == "" {
+				return nil
+			}
+			version = v
+		} else if version == "" {
+			return nil
+		}
+		return &repoRecord{
+			Name:     name,
+			Version:  version,
+			Build:    build,
+			fileName: name + "-" + version + "-" + build,
+			version:  parseVersion(version),
+		}
+	}
+	switch cpu {
+	case "64":
+		cpu = "x86_64"
+	case "32":
+		cpu = "x86"
+	}
+	var result []*repoRecord
+	add := func(r *repoRecord) {
+		if r != nil {
+			result = append(result, r)
+		}
+	}
+	add(virtual("__archspec", "1", cpu))
+	add(virtual("__cuda", "", "0"))
+	switch platform {
+	case "linux":
+		add(virtual("__unix", "0", "0"))
+		add(virtual("__linux", "0", "0"))
+		add(virtual("__glibc", "2.17", "0"))
+	case "osx":
+		add(virtual("__unix", "0", "0"))
+		add(virtual("__osx", "11.0", "0"))
+	case "win":
+		add(virtual("__win", "0", "0"))
+	}
+	return result
+}
+
+// A constraint on the candidates for a package.
+type constraint struct {
+	spec *MatchSpec
+	// The package which imposed this constraint, or nil if it was requested.
+	from *repoRecord
+}
+
+func (c constraint) String() string {
+	if c.from == nil {
+		return c.spec.String() + " (requested)"
+	}
+	return c.spec.String() + " (required by " + c.from.distName() + ")"
+}
+
+type solver struct {
+	index    repoIndex
+	assigned map[string]*repoRecord
+	// Constraints on each package name, from the requested specs and the
+	// dependencies and constraints of assigned packages.
+	constraints map[string][]constraint
+	steps       int
+	// The package with the deepest failure, for error reporting.
+	failed      string
+	failedDepth int
+	failedCons  []constraint
+}
+
+func newSolver(index repoIndex, arch string, virtual virtualOverrides) *solver {
+	s := &solver{
+		index:       index,
+		assigned:    make(map[string]*repoRecord, len(index)),
+		constraints: make(map[string][]constraint),
+	}
+	for _, v := range virtualPackages(arch, virtual) {
+		s.assigned[v.Name] = v
+	}
+	return s
+}
+
+func channelMatches(spec *MatchSpec, r *repoRecord) bool {
+	if spec.Channel == "" || r.channel == nil {
+		return true
+	}
+	ch := strings.TrimSuffix(spec.Channel, "/"+r.subdir)
+	return ch == r.channel.name ||
+		strings.HasSuffix(r.channel.url, "/"+ch) ||
+		r.channel.url == ch
+}
+
+func (s *solver) allowed(r *repoRecord, cons []constraint) bool {
+	for _, c := range cons {
+		if !c.spec.matchVersion(&r.version, r.Build) ||
+			!channelMatches(c.spec, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// compatible returns true if the dependencies and constraints of the
+// candidate are consistent with the packages already assigned.
+func (s *solver) compatible(r *repoRecord) bool {
+	for _, specs := range [...][]*MatchSpec{r.depends, r.constrains} {
+		for _, d := range specs {
+			if a := s.assigned[d.Name]; a != nil &&
+				!(d.matchVersion(&a.version, a.Build) && channelMatches(d, a)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s *solver) fail(name string) {
+	if len(s.assigned) >= s.failedDepth {
+		s.failed = name
+		s.failedDepth = len(s.assigned)
+		s.failedCons = append(s.failedCons[:0], s.constraints[name]...)
+	}
+}
+
+var errTooManySteps = errors.New("exceeded the maximum number of solver steps")
+
+// An error reporting that the requirements cannot be satisfied.
+type unsatisfiableError struct {
+	msg string
+}
+
+func (err unsatisfiableError) Error() string {
+	return err.msg
+}
+
+func (s *solver) search(queue []string) (bool, error) {
+	for len(queue) > 0 && s.assigned[queue[0]] != nil {
+		queue = queue[1:]
+	}
+	if len(queue) == 0 {
+		return true, nil
+	}
+	name, rest := queue[0], queue[1:]
+	cons := s.constraints[name]
+	for _, r := range s.index[name] {
+		if !s.allowed(r, cons) {
+			continue
+		}
+		if err := r.parseDeps(); err != nil {
+			fmt.Fprintln(os.Stderr, "WARNING: skipping candidate:", err)
+			continue
+		}
+		if !s.compatible(r) {
+			continue
+		}
+		if s.steps++; s.steps > maxSolverSteps {
+			return false, errTooManySteps
+		}
+		s.assigned[name] = r
+		added := make([]string, 0, len(r.depends)+len(r.constrains))
+		next := make([]string, len(rest), len(rest)+len(r.depends))
+		copy(next, rest)
+		for _, d := range r.depends {
+			s.constraints[d.Name] = append(s.constraints[d.Name], constraint{d, r})
+			added = append(added, d.Name)
+			next = append(next, d.Name)
+		}
+		for _, d := range r.constrains {
+			s.constraints[d.Name] = append(s.constraints[d.Name], constraint{d, r})
+			added = append(added, d.Name)
+		}
+		if ok, err := s.search(next); ok || err != nil {
+			return ok, err
+		}
+		for i := len(added) - 1; i >= 0; i-- {
+			n := added[i]
+			s.constraints[n] = s.constraints[n][:len(s.constraints[n])-1]
+		}
+		delete(s.assigned, name)
+	}
+	s.fail(name)
+	return false, nil
+}
+
+// solve finds a set of packages satisfying the given specs.
+func (s *solver) solve(specs []*MatchSpec) (map[string]*repoRecord, error) {
+	queue := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		s.constraints[spec.Name] = append(s.constraints[spec.Name],
+			constraint{spec: spec})
+		queue = append(queue, spec.Name)
+	}
+	// The virtual packages are assigned before searching, so requests for
+	// them must be checked here.
+	for _, spec := range specs {
+		if a := s.assigned[spec.Name]; a != nil &&
+			!spec.matchVersion(&a.version, a.Build) {
+			return nil, unsatisfiableError{fmt.Sprintf(
+				"the virtual package %s does not satisfy\n  %s",
+				a.distName(), constraint{spec: spec})}
+		}
+	}
+	ok, err := s.search(queue)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, s.failure()
+	}
+	result := make(map[string]*repoRecord, len(s.assigned))
+	for name, r := range s.assigned {
+		if r.channel != nil {
+			result[name] = r
+		}
+	}
+	return result, nil
+}
+
+func (s *solver) failure() error {
+	var sb strings.Builder
+	if len(s.index[s.failed]) == 0 {
+		fmt.Fprintf(&sb, "nothing provides %s", s.failed)
+	} else {
+		fmt.Fprintf(&sb, "could not find a version of %s satisfying all of", s.failed)
+	}
+	cons := make([]string, len(s.failedCons))
+	for i, c := range s.failedCons {
+		cons[i] = c.String()
+	}
+	sort.Strings(cons)
+	for _, c := range cons {
+		sb.WriteString("\n  ")
+		sb.WriteString(c)
+	}
+	return unsatisfiableError{sb.String()}
+}
+
+// pkgSpec converts the record into the form produced by parsing the
+// output of `conda create --json`.  If hash is set, the checksums are
+// verified against the package file, if it is in the channel directory.
+func (r *repoRecord) pkgSpec(hash bool) (*PkgSpec, error) {
+	deps := make([]string, len(r.depends))
+	for i, d := range r.depends {
+		deps[i] = d.Name
+	}
+	spec := &PkgSpec{
+		Name:     r.Name,
+		Channel:  r.channel.name,
+		Depends:  deps,
+		DistName: r.distName(),
+		Platform: r.Subdir,
+		Version:  r.Version,
+		BaseUrl:  r.baseUrl(),
+		Url:      r.baseUrl() + "/" + r.fileName,
+		Sha256:   r.Sha256,
+		Md5:      r.Md5,
+		Size:     r.Size,
+		Build:    r.Build,
+	}
+	spec.DependSpecs = r.Depends
+	if !hash {
+		return spec, nil
+	}
+	fn := filepath.Join(r.channel.dir, r.subdir, r.fileName)
+	spec.hashSource = filepath.Join(r.channel.dir, r.subdir, "repodata.json")
+	if h, err := computeFileHashes(fn); err == nil {
+		if err := spec.checkHashes(h, fn); err != nil {
+			return nil, err
+		}
+	} else if spec.Sha256 == "" {
+		return nil, fmt.Errorf(
+			"no sha256 in repodata for %s, and could not compute it: %w",
+			r.fileName, err)
+	}
+	return spec, nil
+}
+
+// solveBuiltin resolves the requirements against the repodata.json in the
+// given local channels, without using conda.
+func solveBuiltin(requirements string, channels []string, arch string,
+	excludeList []string, opts *lockOptions) (map[string]*PkgSpec, error) {
+	if requirements == "" {
+		return nil, errors.New("a requirements file is required")
+	}
+	reqs, err := readRequirements(requirements)
+	if err != nil {
+		return nil, err
+	}
+	index, err := loadIndex(channels, arch, opts.format)
+	if err != nil {
+		return nil, err
+	}
+	records, err := newSolver(index, arch, opts.virtual).solve(reqs)
+	if err != nil {
+		return nil, err
+	}
+	specs := make(map[string]*PkgSpec, len(records))
+	for name, r := range records {
+		if specs[name], err = r.pkgSpec(!opts.resolveOnly); err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range excludeList {
+		delete(specs, e)
+	}
+	return specs, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeRequirements(t *testing.T, reqs ...string) string {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), "requirements.txt")
+	if err := os.WriteFile(fn,
+		[]byte(strings.Join(reqs, "\n")+"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func TestSolveBuiltin(t *testing.T) {
+	reqs := writeRequirements(t,
+		"# A comment",
+		"numpy",
+		"python 3.11.*",
+		"click",
+	)
+	specs, err := solveBuiltin(reqs, []string{"testdata/channel"},
+		"linux-64", []string{"libgcc-ng"}, &lockOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{
+		"click":      "click-8.1.7-unix_pyh707e725_0",
+		"libzlib":    "libzlib-1.3.1-h4ab18f5_1",
+		"numpy":      "numpy-1.26.4-py311h64a7726_0",
+		"python":     "python-3.11.8-hab00c5b_0_cpython",
+		"python_abi": "python_abi-3.11-4_cp311",
+	}
+	if len(specs) != len(expect) {
+		t.Errorf("expected %d packages, got %d", len(expect), len(specs))
+	}
+	for name, dist := range expect {
+		if spec := specs[name]; spec == nil {
+			t.Errorf("missing %s", name)
+		} else if spec.DistName != dist {
+			t.Errorf("expected %s, got %s", dist, spec.DistName)
+		}
+	}
+	click := specs["click"]
+	if click == nil {
+		t.FailNow()
+	}
+	if !strings.HasPrefix(click.BaseUrl, "file:///") ||
+		!strings.HasSuffix(click.BaseUrl, "/testdata/channel/noarch") {
+		t.Errorf("unexpected base url %s", click.BaseUrl)
+	}
+	if click.Url != click.BaseUrl+"/click-8.1.7-unix_pyh707e725_0.conda" {
+		t.Errorf("expected the .conda archive, got %s", click.Url)
+	}
+	if click.Sha256 != "43e91a1d3a7b9e1e7c7d4b55a2ed7a7ca0c1e6bb1cd7b4e1f0b8c8a1e96a8b71" {
+		t.Errorf("wrong sha256 %s", click.Sha256)
+	}
+	if strings.Join(click.Depends, ",") != "__unix,python" {
+		t.Errorf("unexpected depends %v", click.Depends)
+	}
+}
+
+func TestSolveBuiltinConflict(t *testing.T) {
+	reqs := writeRequirements(t, "numpy <1.26", "python 3.12.*")
+	_, err := solveBuiltin(reqs, []string{"testdata/channel"},
+		"linux-64", nil, &lockOptions{})
+	if err == nil {
+		t.Fatal("expected a conflict")
+	}
+	if unsat := (unsatisfiableError{}); !errors.As(err, &unsat) {
+		t.Errorf("conflict was not reported as unsatisfiable: %v", err)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "python 3.12.* (requested)") ||
+		!strings.Contains(msg, "required by numpy-1.25.2") {
+		t.Errorf("error did not explain the conflict: %v", err)
+	}
+}
+
+func TestSolveBuiltinVirtual(t *testing.T) {
+	reqs := writeRequirements(t, "cudapkg")
+	t.Setenv("CONDA_OVERRIDE_CUDA", "")
+	specs, err := solveBuiltin(reqs, []string{"testdata/channel"},
+		"linux-64", nil, &lockOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := specs["cudapkg"].Build; b != "cpu_0" {
+		t.Errorf("expected cpu build without cuda, got %s", b)
+	}
+	t.Setenv("CONDA_OVERRIDE_CUDA", "12.2")
+	specs, err = solveBuiltin(reqs, []string{"testdata/channel"},
+		"linux-64", nil, &lockOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := specs["cudapkg"].Build; b != "cuda_0" {
+		t.Errorf("expected cuda build, got %s", b)
+	}
+	specs, err = solveBuiltin(reqs, []string{"testdata/channel"},
+		"linux-64", nil, &lockOptions{virtual: virtualOverrides{"__cuda": ""}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := specs["cudapkg"].Build; b != "cpu_0" {
+		t.Errorf("expected the override to take precedence, got %s", b)
+	}
+}
+
+func TestSolveBuiltinVirtualRequest(t *testing.T) {
+	reqs := writeRequirements(t, "click", "__glibc >=2.28")
+	_, err := solveBuiltin(reqs, []string{"testdata/channel"},
+		"linux-64", nil, &lockOptions{})
+	if unsat := (unsatisfiableError{}); !errors.As(err, &unsat) ||
+		!strings.Contains(err.Error(), "__glibc >=2.28 (requested)") {
+		t.Errorf("expected the glibc request to be unsatisfiable, got %v", err)
+	}
+	if _, err := solveBuiltin(reqs, []string{"testdata/channel"}, "linux-64", nil,
+		&lockOptions{virtual: virtualOverrides{"__glibc": "2.28"}}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSolveBuiltinRemoteChannel(t *testing.T) {
+	reqs := writeRequirements(t, "numpy")
+	if _, err := solveBuiltin(reqs, []string{"conda-forge"},
+		"linux-64", nil, &lockOptions{}); err == nil {
+		t.Error("expected an error for a missing local channel")
+	}
+	if _, err := solveBuiltin(reqs, []string{"https://conda.anaconda.org/conda-forge"},
+		"linux-64", nil, &lockOptions{}); err == nil {
+		t.Error("expected an error for a remote channel")
+	}
+}
+
+func TestParseDepsError(t *testing.T) {
+	r := &repoRecord{
+		fileName:   "bad-1.0-0.conda",
+		Depends:    []string{"python >=3.8"},
+		Constrains: []string{"numpy >="},
+	}
+	for i := 0; i < 2; i++ {
+		if err := r.parseDeps(); err == nil {
+			t.Fatalf("expected an error on call %d", i+1)
+		}
+		if r.depends != nil || r.constrains != nil {
+			t.Errorf("partly parsed dependencies were kept")
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+)
+
+// requiredBy returns the given packages and everything they transitively
+// depend on in the solution.
+func requiredBy(specs map[string]*PkgSpec, names []string) map[string]struct{} {
+	result := make(map[string]struct{}, len(names))
+	queue := append([]string(nil), names...)
+	for len(queue) > 0 {
+		name := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if _, ok := result[name]; ok {
+			continue
+		}
+		result[name] = struct{}{}
+		if spec := specs[name]; spec != nil {
+			queue = append(queue, spec.Depends...)
+		}
+	}
+	return result
+}
+
+// lockPins returns exact match specs for the locked version of each package
+// in the solution which is not being freed.
+func lockPins(locked map[string]map[string]*lockedPackage,
+	specs map[string]*PkgSpec, freed map[string]struct{},
+	arch string) []string {
+	pins := make([]string, 0, len(specs))
+	for name := range specs {
+		if _, ok := freed[name]; ok {
+			continue
+		}
+		dist := lockedDist(locked, name, arch)
+		if dist == "" {
+			// New package, so there is nothing to pin it to.
+			continue
+		}
+		_, version, build := splitDistName(dist)
+		if version == "" || build == "" {
+			continue
+		}
+		pins = append(pins, name+" "+version+" "+build)
+	}
+	sort.Strings(pins)
+	return pins
+}
+
+// writePinnedRequirements writes a copy of the requirements file with the
+// given pins appended, and returns its name.
+func writePinnedRequirements(requirements string, pins []string) (string, error) {
+	b, err := os.ReadFile(requirements)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp("", "requirements*.txt")
+	if err != nil {
+		return "", err
+	}
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		b = append(b, '\n')
+	}
+	b = append(b, "# Pinned from the existing lock file.\n"...)
+	for _, pin := range pins {
+		b = append(append(b, pin...), '\n')
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// lockedDist returns the dist name of the locked package for the
+// architecture, or the empty string if it is not locked.
+func lockedDist(locked map[string]map[string]*lockedPackage, name, arch string) string {
+	pkg := locked[name][arch]
+	if pkg == nil {
+		pkg = locked[name][""]
+	}
+	if pkg == nil {
+		return ""
+	}
+	return pkg.DistName
+}
+
+// distMatches returns true if the package with the given dist name
+// satisfies the spec.
+func distMatches(spec *MatchSpec, dist string) bool {
+	_, version, build := splitDistName(dist)
+	v := parseVersion(version)
+	return spec.matchVersion(&v, build)
+}
+
+// freedPins returns the packages to release from their locked versions in
+// order to update the given packages.  Besides the packages being
+// updated, a package is released if its locked version does not satisfy a
+// requirement or a dependency of a released package in the new solution,
+// or if its dependencies are not satisfied by the new version of a
+// released package.  Everything else stays pinned, even if a newer version
+// is available.
+func freedPins(locked map[string]map[string]*lockedPackage,
+	specs map[string]*PkgSpec, updateList []string, reqs []*MatchSpec,
+	arch string) map[string]struct{} {
+	freed := make(map[string]struct{}, len(updateList))
+	queue := append([]string(nil), updateList...)
+	conflicts := func(spec *MatchSpec) bool {
+		dist := lockedDist(locked, spec.Name, arch)
+		return dist != "" && !distMatches(spec, dist)
+	}
+	for _, req := range reqs {
+		if conflicts(req) {
+			queue = append(queue, req.Name)
+		}
+	}
+	for len(queue) > 0 {
+		name := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if _, ok := freed[name]; ok {
+			continue
+		}
+		freed[name] = struct{}{}
+		spec := specs[name]
+		if spec == nil {
+			continue
+		}
+		for _, d := range spec.DependSpecs {
+			if dep, err := ParseMatchSpec(d); err == nil && conflicts(dep) {
+				queue = append(queue, dep.Name)
+			}
+		}
+		// The dependencies of a pinned package are only known if the new
+		// solution has the same build of it as the lock.
+		for other, o := range specs {
+			if _, ok := freed[other]; ok ||
+				o.DistName != lockedDist(locked, other, arch) {
+				continue
+			}
+			for _, d := range o.DependSpecs {
+				if dep, err := ParseMatchSpec(d); err == nil &&
+					dep.Name == name && !distMatches(dep, spec.DistName) {
+					queue = append(queue, other)
+					break
+				}
+			}
+		}
+	}
+	return freed
+}
+
+// solveUpdate solves the environment while keeping every locked package
+// pinned, except for the packages being updated and those whose locked
+// versions conflict with them.
+//
+// The environment is first solved without pins, and without fetching
+// checksums, to find the new versions and dependencies of the packages
+// being updated.  It is then solved again with everything else pinned to
+// the versions in the existing lock.
+func solveUpdate(solver, requirements, conda string, channelList []string,
+	arch string, excludeList, updateList []string,
+	locked map[string]map[string]*lockedPackage,
+	opts *lockOptions) map[string]*PkgSpec {
+	if specs, err := readLockInput(requirements, arch, nil); err == nil && specs != nil {
+		log.Fatalln("Packages cannot be updated when the requirements are " +
+			"an already-solved package list.")
+	}
+	resolveOpts := *opts
+	resolveOpts.resolveOnly = true
+	specs := solve(solver, requirements, conda, channelList, arch, nil, &resolveOpts)
+	for _, name := range updateList {
+		if specs[name] == nil {
+			fmt.Fprintln(os.Stderr, "WARNING:", name,
+				"is not in the solution, so cannot be updated.")
+		}
+	}
+	// The requirements were already accepted by the solver, so any which
+	// cannot be parsed here are only not checked against the lock.
+	reqs, _ := readRequirements(requirements)
+	pins := lockPins(locked, specs,
+		freedPins(locked, specs, updateList, reqs, arch), arch)
+	if len(pins) == 0 {
+		return solve(solver, requirements, conda, channelList, arch, excludeList, opts)
+	}
+	fmt.Fprintln(os.Stderr, "Solving again with", len(pins),
+		"packages pinned to their locked versions...")
+	pinned, err := writePinnedRequirements(requirements, pins)
+	if err != nil {
+		log.Fatalln("Failed writing pinned requirements:\n", err)
+	}
+	defer os.Remove(pinned)
+	return solve(solver, pinned, conda, channelList, arch, excludeList, opts)
+}
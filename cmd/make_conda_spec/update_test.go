@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRequiredBy(t *testing.T) {
+	specs := map[string]*PkgSpec{
+		"numpy":  {Name: "numpy", Depends: []string{"python", "libgcc-ng"}},
+		"python": {Name: "python", Depends: []string{"__glibc", "libzlib"}},
+		"click":  {Name: "click", Depends: []string{"python"}},
+	}
+	req := requiredBy(specs, []string{"numpy"})
+	for _, name := range []string{"numpy", "python", "libgcc-ng", "libzlib"} {
+		if _, ok := req[name]; !ok {
+			t.Errorf("expected %s to be required", name)
+		}
+	}
+	if _, ok := req["click"]; ok {
+		t.Error("click is not required by numpy")
+	}
+}
+
+func TestSolveUpdate(t *testing.T) {
+	reqs := writeRequirements(t, "numpy", "python 3.11.*")
+	locked := map[string]map[string]*lockedPackage{
+		"libzlib": {"": {DistName: "libzlib-1.2.13-hd590300_5"}},
+		"numpy":   {"": {DistName: "numpy-1.25.2-py311h64a7726_0"}},
+		"python":  {"": {DistName: "python-3.11.8-hab00c5b_0_cpython"}},
+	}
+	specs := solveUpdate("builtin", reqs, "", []string{"testdata/channel"},
+		"linux-64", nil, []string{"libzlib"}, locked, &lockOptions{})
+	if d := specs["numpy"].DistName; d != "numpy-1.25.2-py311h64a7726_0" {
+		t.Errorf("expected numpy to stay pinned, got %s", d)
+	}
+	if d := specs["libzlib"].DistName; d != "libzlib-1.3.1-h4ab18f5_1" {
+		t.Errorf("expected libzlib to be updated, got %s", d)
+	}
+	pins := lockPins(locked, specs,
+		freedPins(locked, specs, []string{"libzlib"}, nil, "linux-64"), "linux-64")
+	if s := strings.Join(pins, ","); s != "numpy 1.25.2 py311h64a7726_0,"+
+		"python 3.11.8 hab00c5b_0_cpython" {
+		t.Errorf("unexpected pins %s", s)
+	}
+}
+
+func TestSolveUpdateKeepsDependencies(t *testing.T) {
+	locked := map[string]map[string]*lockedPackage{
+		"libgcc-ng":  {"": {DistName: "libgcc-ng-13.2.0-h807b86a_5"}},
+		"libzlib":    {"": {DistName: "libzlib-1.2.13-hd590300_5"}},
+		"numpy":      {"": {DistName: "numpy-1.25.2-py311h64a7726_0"}},
+		"python":     {"": {DistName: "python-3.11.8-hab00c5b_0_cpython"}},
+		"python_abi": {"": {DistName: "python_abi-3.11-4_cp311"}},
+	}
+	// The dependencies of numpy are satisfied by the locked packages, so
+	// libzlib is not updated along with it.
+	reqs := writeRequirements(t, "numpy", "python 3.11.*")
+	specs := solveUpdate("builtin", reqs, "", []string{"testdata/channel"},
+		"linux-64", nil, []string{"numpy"}, locked, &lockOptions{})
+	if d := specs["numpy"].DistName; d != "numpy-1.26.4-py311h64a7726_0" {
+		t.Errorf("expected numpy to be updated, got %s", d)
+	}
+	if d := specs["libzlib"].DistName; d != "libzlib-1.2.13-hd590300_5" {
+		t.Errorf("expected libzlib to stay pinned, got %s", d)
+	}
+	// Updating numpy for python 3.12 also releases python and python_abi,
+	// but not the dependencies of python.
+	reqs = writeRequirements(t, "numpy >=1.26", "python 3.12.*")
+	specs = solveUpdate("builtin", reqs, "", []string{"testdata/channel"},
+		"linux-64", nil, []string{"numpy"}, locked, &lockOptions{})
+	for name, want := range map[string]string{
+		"numpy":      "numpy-1.26.4-py312heda63a1_0",
+		"python":     "python-3.12.3-hab00c5b_0_cpython",
+		"python_abi": "python_abi-3.12-4_cp312",
+		"libzlib":    "libzlib-1.2.13-hd590300_5",
+	} {
+		if d := specs[name].DistName; d != want {
+			t.Errorf("expected %s, got %s", want, d)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A single element of a version component, which is either a number or
+// a string.
+type versionPart struct {
+	num float64
+	str string
+	// True if this part is a string.
+	isStr bool
+}
+
+// The parsed form of a conda version string, following the ordering rules
+// described in the documentation for conda.models.version.VersionOrder.
+type condaVersion struct {
+	source string
+	epoch  int
+	main   [][]versionPart
+	local  [][]versionPart
+}
+
+func parseVersionComponents(s string) [][]versionPart {
+	if s == "" {
+		return nil
+	}
+	s = strings.ReplaceAll(strings.ToLower(s), "-", "_")
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == '.' || r == '_'
+	})
+	result := make([][]versionPart, 0, len(fields))
+	for _, field := range fields {
+		var comp []versionPart
+		for len(field) > 0 {
+			i := 0
+			if field[0] >= '0' && field[0] <= '9' {
+				for i < len(field) && field[i] >= '0' && field[i] <= '9' {
+					i++
+				}
+				n, _ := strconv.ParseFloat(field[:i], 64)
+				comp = append(comp, versionPart{num: n})
+			} else {
+				for i < len(field) && (field[i] < '0' || field[i] > '9') {
+					i++
+				}
+				switch str := field[:i]; str {
+				case "post":
+					// post releases sort after any number.
+					comp = append(comp, versionPart{num: math.Inf(1)})
+				case "dev":
+					// Upper-case sorts before all other (lower case) strings.
+					comp = append(comp, versionPart{str: "DEV", isStr: true})
+				default:
+					comp = append(comp, versionPart{str: str, isStr: true})
+				}
+			}
+			field = field[i:]
+		}
+		if len(comp) > 0 && comp[0].isStr {
+			comp = append([]versionPart{{}}, comp...)
+		}
+		result = append(result, comp)
+	}
+	return result
+}
+
+func parseVersion(s string) condaVersion {
+	v := condaVersion{source: s}
+	s = strings.TrimSpace(s)
+	if e, rest, ok := strings.Cut(s, "!"); ok {
+		v.epoch, _ = strconv.Atoi(e)
+		s = rest
+	}
+	s, local, _ := strings.Cut(s, "+")
+	v.main = parseVersionComponents(s)
+	v.local = parseVersionComponents(local)
+	return v
+}
+
+func (p versionPart) compare(other versionPart) int {
+	switch {
+	case p.isStr && other.isStr:
+		return strings.Compare(p.str, other.str)
+	case p.isStr:
+		// Strings sort before numbers.
+		return -1
+	case other.isStr:
+		return 1
+	case p.num < other.num:
+		return -1
+	case p.num > other.num:
+		return 1
+	}
+	return 0
+}
+
+func compareComponents(a, b [][]versionPart) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var ca, cb []versionPart
+		if i < len(a) {
+			ca = a[i]
+		}
+		if i < len(b) {
+			cb = b[i]
+		}
+		for j := 0; j < len(ca) || j < len(cb); j++ {
+			var pa, pb versionPart
+			if j < len(ca) {
+				pa = ca[j]
+			}
+			if j < len(cb) {
+				pb = cb[j]
+			}
+			if c := pa.compare(pb); c != 0 {
+				return c
+			}
+		}
+	}
+	return 0
+}
+
+// compare returns -1, 0, or 1 depending on whether v sorts before, equal to,
+// or after other.
+func (v *condaVersion) compare(other *condaVersion) int {
+	if v.epoch != other.epoch {
+		if v.epoch < other.epoch {
+			return -1
+		}
+		return 1
+	}
+	if c := compareComponents(v.main, other.main); c != 0 {
+		return c
+	}
+	return compareComponents(v.local, other.local)
+}
+
+// hasPrefix returns true if the version begins with the components of the
+// given prefix, e.g. 1.2.3 has prefix 1.2, but 1.20 does not.
+func (v *condaVersion) hasPrefix(prefix *condaVersion) bool {
+	if v.epoch != prefix.epoch {
+		return false
+	}
+	for i, pc := range prefix.main {
+		var vc []versionPart
+		if i < len(v.main) {
+			vc = v.main[i]
+		}
+		if compareComponents([][]versionPart{vc}, [][]versionPart{pc}) != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/10XGenomics/rules_conda/buildutil"
+	"github.com/bazelbuild/buildtools/build"
+)
+
+// The environment variables which conda reads to override the version of
+// each virtual package.
+var virtualEnvVars = map[string]string{
+	"__archspec": "CONDA_OVERRIDE_ARCHSPEC",
+	"__cuda":     "CONDA_OVERRIDE_CUDA",
+	"__glibc":    "CONDA_OVERRIDE_GLIBC",
+	"__linux":    "CONDA_OVERRIDE_LINUX",
+	"__osx":      "CONDA_OVERRIDE_OSX",
+	"__win":      "CONDA_OVERRIDE_WIN",
+}
+
+// The name of the variable in the lock file which records the virtual
+// package overrides.
+const virtualPackagesVar = "VIRTUAL_PACKAGES"
+
+// Versions for virtual packages, keyed by package name, e.g. `__glibc`,
+// which are used in place of those detected on the host.  An empty version
+// means that the package is absent.
+type virtualOverrides map[string]string
+
+// parseVirtualOverrides parses a comma-separated list of `name=version`
+// pairs.  The leading underscores of the name may be omitted.
+func parseVirtualOverrides(s string) (virtualOverrides, error) {
+	items := splitList(s)
+	if len(items) == 0 {
+		return nil, nil
+	}
+	result := make(virtualOverrides, len(items))
+	for _, item := range items {
+		name, version, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			return nil, fmt.Errorf(
+				"virtual package override %q is not of the form name=version",
+				item)
+		}
+		if !strings.HasPrefix(name, "__") {
+			name = "__" + name
+		}
+		if _, ok := virtualEnvVars[name]; !ok {
+			known := make([]string, 0, len(virtualEnvVars))
+			for k := range virtualEnvVars {
+				known = append(known, k)
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf(
+				"unknown virtual package %s; expected one of %s",
+				name, strings.Join(known, ", "))
+		}
+		result[name] = strings.TrimSpace(version)
+	}
+	return result, nil
+}
+
+// lookup returns the version for a virtual package, if it is overridden
+// either explicitly or by the corresponding environment variable.  An empty
+// environment variable is treated as unset, since wrapper scripts commonly
+// export the variable whether or not a version was configured.
+func (v virtualOverrides) lookup(name string) (string, bool) {
+	if version, ok := v[name]; ok {
+		return version, true
+	}
+	if env := virtualEnvVars[name]; env != "" {
+		if version := os.Getenv(env); version != "" {
+			return version, true
+		}
+	}
+	return "", false
+}
+
+// env sets the environment variables for conda to use the overridden
+// versions, replacing any inherited values for those variables.
+func (v virtualOverrides) env(env []string) []string {
+	if len(v) == 0 {
+		return env
+	}
+	vars := make(map[string]struct{}, len(v))
+	for name := range v {
+		vars[virtualEnvVars[name]] = struct{}{}
+	}
+	result := make([]string, 0, len(env)+len(v))
+	for _, e := range env {
+		name, _, _ := strings.Cut(e, "=")
+		if _, ok := vars[name]; !ok {
+			result = append(result, e)
+		}
+	}
+	for _, name := range v.names() {
+		result = append(result, virtualEnvVars[name]+"="+v[name])
+	}
+	return result
+}
+
+func (v virtualOverrides) names() []string {
+	names := make([]string, 0, len(v))
+	for name := range v {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// readVirtualOverrides returns the virtual package overrides recorded in an
+// existing lock file.
+func readVirtualOverrides(file *build.File) virtualOverrides {
+	dict, ok := moduleVar(file, virtualPackagesVar).(*build.DictExpr)
+	if !ok {
+		return nil
+	}
+	return parseVirtualDict(dict)
+}
+
+func parseVirtualDict(dict *build.DictExpr) virtualOverrides {
+	result := make(virtualOverrides, len(dict.List))
+	for _, kv := range dict.List {
+		if name := stringValue(kv.Key); name != "" {
+			result[name] = stringValue(kv.Value)
+		}
+	}
+	return result
+}
+
+// dict returns the overrides as a Starlark dict, or nil if there are none.
+func (v virtualOverrides) dict() *build.DictExpr {
+	if len(v) == 0 {
+		return nil
+	}
+	dict := &build.DictExpr{ForceMultiLine: true}
+	for _, name := range v.names() {
+		dict.List = append(dict.List, &build.KeyValueExpr{
+			Key:   buildutil.StrExpr(name),
+			Value: buildutil.StrExpr(v[name]),
+		})
+	}
+	return dict
+}
+
+// setVirtualOverrides records the virtual package overrides in the lock
+// file, so that regenerating it gives the same solution on any host.
+func setVirtualOverrides(file *build.File, v virtualOverrides) {
+	var value build.Expr
+	if dict := v.dict(); dict != nil {
+		value = dict
+	}
+	setModuleVar(file, virtualPackagesVar,
+		"Virtual package versions used when solving, instead of those of the host.",
+		value)
+}
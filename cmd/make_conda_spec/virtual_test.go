@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/buildtools/build"
+)
+
+func TestParseVirtualOverrides(t *testing.T) {
+	v, err := parseVirtualOverrides("__glibc=2.28,cuda=12.2,__archspec=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 3 || v["__glibc"] != "2.28" || v["__cuda"] != "12.2" {
+		t.Errorf("unexpected overrides %v", v)
+	}
+	if version, ok := v["__archspec"]; !ok || version != "" {
+		t.Error("expected __archspec to be removed")
+	}
+	if _, err := parseVirtualOverrides("__glibc"); err == nil {
+		t.Error("expected an error for a missing version")
+	}
+	if _, err := parseVirtualOverrides("__foo=1"); err == nil {
+		t.Error("expected an error for an unknown package")
+	}
+	if v, err := parseVirtualOverrides(""); err != nil || v != nil {
+		t.Errorf("expected no overrides, got %v, %v", v, err)
+	}
+}
+
+func TestVirtualOverridesEnv(t *testing.T) {
+	v := virtualOverrides{"__glibc": "2.28", "__cuda": ""}
+	env := v.env([]string{"PATH=/bin", "CONDA_OVERRIDE_GLIBC=2.17"})
+	if got := strings.Join(env, " "); got !=
+		"PATH=/bin CONDA_OVERRIDE_CUDA= CONDA_OVERRIDE_GLIBC=2.28" {
+		t.Errorf("unexpected environment %s", got)
+	}
+	t.Setenv("CONDA_OVERRIDE_LINUX", "5.10")
+	if version, ok := v.lookup("__linux"); !ok || version != "5.10" {
+		t.Errorf("expected the host override, got %q", version)
+	}
+	if version, ok := v.lookup("__glibc"); !ok || version != "2.28" {
+		t.Errorf("expected the explicit override, got %q", version)
+	}
+	t.Setenv("CONDA_OVERRIDE_GLIBC", "")
+	if version, ok := virtualOverrides(nil).lookup("__glibc"); ok {
+		t.Errorf("expected an empty variable to be ignored, got %q", version)
+	}
+}
+
+func TestVirtualOverridesLock(t *testing.T) {
+	file := &build.File{
+		Stmt: []build.Expr{
+			&build.StringExpr{Value: "docstring"},
+			&build.LoadStmt{},
+			&build.DefStmt{Name: "conda_environment"},
+		},
+	}
+	setVirtualOverrides(file, virtualOverrides{"__glibc": "2.28", "__cuda": "12.2"})
+	if _, ok := file.Stmt[2].(*build.AssignExpr); !ok {
+		t.Fatal("expected the overrides after the load statements")
+	}
+	v := readVirtualOverrides(file)
+	if len(v) != 2 || v["__glibc"] != "2.28" || v["__cuda"] != "12.2" {
+		t.Errorf("unexpected overrides %v", v)
+	}
+	setVirtualOverrides(file, virtualOverrides{"__glibc": "2.17"})
+	if v := readVirtualOverrides(file); len(v) != 1 || v["__glibc"] != "2.17" {
+		t.Errorf("unexpected overrides %v", v)
+	}
+	setVirtualOverrides(file, nil)
+	if len(file.Stmt) != 3 || readVirtualOverrides(file) != nil {
+		t.Error("expected the overrides to be removed")
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// The maximum number of dependency paths to print for a package.
+const maxWhyPaths = 100
+
+// whyRoots returns the names of the packages from which dependency paths
+// start.  These are the directly requested packages, if known, and
+// otherwise the packages which nothing else in the solution depends on.
+func whyRoots(specs map[string]*PkgSpec, direct map[string]string) []string {
+	var roots []string
+	for name := range direct {
+		if _, ok := specs[name]; ok {
+			roots = append(roots, name)
+		}
+	}
+	if len(roots) == 0 {
+		needed := make(map[string]struct{}, len(specs))
+		for _, spec := range specs {
+			for _, d := range spec.Depends {
+				if d != spec.Name {
+					needed[d] = struct{}{}
+				}
+			}
+		}
+		for name := range specs {
+			if _, ok := needed[name]; !ok {
+				roots = append(roots, name)
+			}
+		}
+	}
+	sort.Strings(roots)
+	return roots
+}
+
+// dependencyPaths returns the paths through the dependency graph from one
+// of the roots to the target package, up to limit paths.  The second return
+// value is the total number of paths.
+func dependencyPaths(specs map[string]*PkgSpec, roots []string,
+	target string, limit int) ([][]string, int) {
+	edges := reachingEdges(specs, target)
+	var result [][]string
+	var stack []string
+	onStack := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		if len(result) >= limit || onStack[name] {
+			return
+		}
+		stack = append(stack, name)
+		onStack[name] = true
+		if name == target {
+			result = append(result, append([]string(nil), stack...))
+		} else {
+			for _, d := range edges[name] {
+				visit(d)
+			}
+		}
+		onStack[name] = false
+		stack = stack[:len(stack)-1]
+	}
+	count := 0
+	counter := newPathCounter(edges, target)
+	for _, root := range roots {
+		if _, ok := edges[root]; ok {
+			visit(root)
+			count = addPaths(count, counter.count(root))
+		}
+	}
+	return result, count
+}
+
+// reachingEdges returns the sorted, distinct dependencies of each package
+// from which the target can be reached, restricted to those packages.
+// Packages which cannot reach the target are omitted, so that searching
+// for paths never explores them.
+func reachingEdges(specs map[string]*PkgSpec, target string) map[string][]string {
+	if specs[target] == nil {
+		return nil
+	}
+	dependents := make(map[string][]string, len(specs))
+	for name, spec := range specs {
+		for _, d := range spec.Depends {
+			dependents[d] = append(dependents[d], name)
+		}
+	}
+	edges := map[string][]string{target: nil}
+	queue := []string{target}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		for _, d := range dependents[name] {
+			if _, ok := edges[d]; !ok {
+				edges[d] = nil
+				queue = append(queue, d)
+			}
+		}
+	}
+	for name := range edges {
+		if name == target {
+			continue
+		}
+		var deps []string
+		for _, d := range specs[name].Depends {
+			if _, ok := edges[d]; ok {
+				deps = append(deps, d)
+			}
+		}
+		sort.Strings(deps)
+		edges[name] = slices.Compact(deps)
+	}
+	return edges
+}
+
+// pathCounter counts the simple paths to a target package.  Counts are
+// memoized for packages which are not part of a dependency cycle with the
+// packages being visited, so that counting is linear in the size of an
+// acyclic graph rather than in the number of paths.
+type pathCounter struct {
+	edges  map[string][]string
+	target string
+	counts map[string]int
+	// The position on the stack of each package being visited.
+	depth map[string]int
+}
+
+func newPathCounter(edges map[string][]string, target string) *pathCounter {
+	return &pathCounter{
+		edges:  edges,
+		target: target,
+		counts: make(map[string]int, len(edges)),
+		depth:  make(map[string]int),
+	}
+}
+
+func (c *pathCounter) count(name string) int {
+	n, _ := c.visit(name)
+	return n
+}
+
+// visit returns the number of paths from the package to the target which
+// do not pass through a package on the stack, and the lowest stack
+// position of such a package which was skipped.  If that is below the
+// package itself, the count depends on the path taken to reach it, so it
+// is not memoized.
+func (c *pathCounter) visit(name string) (int, int) {
+	if name == c.target {
+		return 1, math.MaxInt
+	}
+	if n, ok := c.counts[name]; ok {
+		return n, math.MaxInt
+	}
+	d := len(c.depth)
+	c.depth[name] = d
+	total, low := 0, math.MaxInt
+	for _, dep := range c.edges[name] {
+		if dd, ok := c.depth[dep]; ok {
+			low = min(low, dd)
+			continue
+		}
+		n, l := c.visit(dep)
+		total = addPaths(total, n)
+		low = min(low, l)
+	}
+	delete(c.depth, name)
+	if low >= d {
+		c.counts[name] = total
+	}
+	return total, low
+}
+
+// addPaths adds path counts, saturating rather than overflowing.
+func addPaths(a, b int) int {
+	if a > math.MaxInt-b {
+		return math.MaxInt
+	}
+	return a + b
+}
+
+// printWhy writes the dependency paths to the target package for one
+// platform.
+func printWhy(w io.Writer, platform, target string,
+	specs map[string]*PkgSpec, direct map[string]string) error {
+	var buf strings.Builder
+	if platform != "" {
+		fmt.Fprintf(&buf, "%s: ", platform)
+	}
+	spec := specs[target]
+	if spec == nil {
+		fmt.Fprintf(&buf, "%s is not in the solution.\n", target)
+		_, err := io.WriteString(w, buf.String())
+		return err
+	}
+	fmt.Fprintf(&buf, "%s is required by:\n", spec.DistName)
+	paths, count := dependencyPaths(specs, whyRoots(specs, direct),
+		target, maxWhyPaths)
+	for _, p := range paths {
+		buf.WriteString("  ")
+		buf.WriteString(strings.Join(p, " -> "))
+		buf.WriteByte('\n')
+	}
+	if count > len(paths) {
+		fmt.Fprintf(&buf, "  ... and %d more\n", count-len(paths))
+	} else if count == 0 {
+		buf.WriteString("  (nothing; it is not reachable from a requested package)\n")
+	}
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+// lockedDepends builds specs for the packages in an existing lock file for
+// one platform, with the dependencies looked up from the repodata in the
+// package cache, or failing that from the extracted packages.  It returns
+// the dist names of packages for which no dependency information was found.
+func lockedDepends(locked map[string]map[string]*lockedPackage,
+	platform, pkgDir string) (map[string]*PkgSpec, []string, error) {
+	caches, err := loadRepodataCaches(pkgDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	specs := make(map[string]*PkgSpec, len(locked))
+	var missing []string
+	for name, pkgs := range locked {
+		pkg := pkgs[platform]
+		if pkg == nil {
+			if pkg = pkgs[""]; pkg == nil {
+				continue
+			}
+		}
+		spec := &PkgSpec{
+			Name:     name,
+			DistName: pkg.DistName,
+		}
+		depends, ok := cachedDepends(caches, pkgDir, pkg.DistName)
+		if !ok {
+			missing = append(missing, pkg.DistName)
+		}
+		for _, d := range depends {
+			name, _, _ := strings.Cut(d, " ")
+			spec.Depends = append(spec.Depends, name)
+		}
+		specs[name] = spec
+	}
+	sort.Strings(missing)
+	return specs, missing, nil
+}
+
+// cachedDepends finds the dependencies of a package from the package cache.
+func cachedDepends(caches []*repodataCache, pkgDir, dist string) ([]string, bool) {
+	for _, cache := range caches {
+		for _, ext := range [...]string{extConda, extTarBz2} {
+			if pkg, ok := cache.Packages[dist+ext]; ok {
+				return pkg.Depends, true
+			}
+		}
+	}
+	f, err := os.Open(path.Join(pkgDir, dist, "info", "index.json"))
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	var index PkgSpec
+	if err := json.NewDecoder(f).Decode(&index); err != nil {
+		return nil, false
+	}
+	return index.Depends, true
+}
+
+// explainLocked prints the dependency paths to the target package in an
+// existing lock file, for each platform.
+func explainLocked(target string, locked map[string]map[string]*lockedPackage,
+	platforms []string, pkgDir string) {
+	if len(locked) == 0 {
+		log.Fatalln("There is no existing lock file to query.")
+	}
+	for _, platform := range platforms {
+		specs, missing, err := lockedDepends(locked, platform, pkgDir)
+		if err != nil {
+			log.Fatalln("Failed reading package cache:\n", err)
+		}
+		if len(missing) > 0 {
+			fmt.Fprintf(os.Stderr,
+				"WARNING: no dependency information in %s for %d packages:\n  %s\n",
+				pkgDir, len(missing), strings.Join(missing, "\n  "))
+		}
+		label := platform
+		if len(platforms) == 1 {
+			label = ""
+		}
+		if err := printWhy(os.Stdout, label, target, specs, nil); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+// explainJsonLock prints the dependency paths to the target package using
+// the dependencies recorded in a json lock file.
+func explainJsonLock(target string, data *jsonLock, platforms []string) {
+	for _, platform := range platforms {
+		label := platform
+		if len(platforms) == 1 {
+			label = ""
+		}
+		if err := printWhy(os.Stdout, label, target,
+			data.specs(platform), nil); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
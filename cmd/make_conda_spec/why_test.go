@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrintWhy(t *testing.T) {
+	specs := map[string]*PkgSpec{
+		"numpy":    {Name: "numpy", DistName: "numpy-2.0.0-py312_0", Depends: []string{"python", "libblas"}},
+		"scipy":    {Name: "scipy", DistName: "scipy-1.14.0-py312_0", Depends: []string{"numpy", "python", "libblas"}},
+		"python":   {Name: "python", DistName: "python-3.12.3-h0", Depends: []string{"zlib", "pip"}},
+		"pip":      {Name: "pip", DistName: "pip-24.0-pyhd8ed1ab_0", Depends: []string{"python"}},
+		"libblas":  {Name: "libblas", DistName: "libblas-3.9.0-h0", Depends: []string{"__glibc"}},
+		"zlib":     {Name: "zlib", DistName: "zlib-1.3.1-h4ab18f5_1"},
+		"unneeded": {Name: "unneeded", DistName: "unneeded-1.0-0"},
+	}
+	var buf strings.Builder
+	if err := printWhy(&buf, "linux-64", "zlib", specs,
+		map[string]string{"scipy": "scipy", "numpy": "numpy >=2"}); err != nil {
+		t.Fatal(err)
+	}
+	const want = `linux-64: zlib-1.3.1-h4ab18f5_1 is required by:
+  numpy -> python -> zlib
+  scipy -> numpy -> python -> zlib
+  scipy -> python -> zlib
+`
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected paths:\n%s", got)
+	}
+	if paths, count := dependencyPaths(specs, whyRoots(specs, nil), "zlib", 1); count != 2 || len(paths) != 1 {
+		t.Errorf("expected 1 of 2 paths, got %d of %d", len(paths), count)
+	}
+	if roots := strings.Join(whyRoots(specs, nil), ","); roots != "scipy,unneeded" {
+		t.Errorf("unexpected roots %s", roots)
+	}
+	buf.Reset()
+	if err := printWhy(&buf, "", "missing", specs, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != "missing is not in the solution.\n" {
+		t.Errorf("unexpected output %q", got)
+	}
+}
+
+func TestDependencyPathsWide(t *testing.T) {
+	// Each of 40 layers has two packages depending on both packages of the
+	// next layer, giving 2^40 paths from the root to the target.
+	specs := map[string]*PkgSpec{
+		"root":   {Name: "root", Depends: []string{"a0", "b0"}},
+		"target": {Name: "target"},
+		"other":  {Name: "other", Depends: []string{"a0"}},
+	}
+	const layers = 40
+	for i := 0; i < layers; i++ {
+		next := []string{"target"}
+		if i+1 < layers {
+			next = []string{fmt.Sprintf("a%d", i+1), fmt.Sprintf("b%d", i+1)}
+		}
+		for _, p := range [...]string{"a", "b"} {
+			name := fmt.Sprintf("%s%d", p, i)
+			specs[name] = &PkgSpec{Name: name, Depends: next}
+		}
+	}
+	paths, count := dependencyPaths(specs, []string{"root"}, "target", 5)
+	if len(paths) != 5 || count != 1<<layers {
+		t.Errorf("expected 5 of %d paths, got %d of %d", 1<<layers, len(paths), count)
+	}
+	if p := paths[0]; len(p) != layers+2 || p[0] != "root" || p[len(p)-1] != "target" {
+		t.Errorf("unexpected path %v", p)
+	}
+}
+
+func TestDependencyPathsCycle(t *testing.T) {
+	specs := map[string]*PkgSpec{
+		"app":    {Name: "app", Depends: []string{"pip", "python"}},
+		"python": {Name: "python", Depends: []string{"pip", "zlib"}},
+		"pip":    {Name: "pip", Depends: []string{"python"}},
+		"zlib":   {Name: "zlib"},
+	}
+	// app -> pip -> python -> zlib and app -> python -> zlib.
+	paths, count := dependencyPaths(specs, []string{"python", "app"}, "zlib", 10)
+	if len(paths) != 3 || count != 3 {
+		t.Errorf("expected 3 paths, got %d of %d: %v", len(paths), count, paths)
+	}
+}
+
+func TestLockedDepends(t *testing.T) {
+	pkgDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(pkgDir, "cache"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(pkgDir, "cache", "abc.json"), []byte(`{
+  "_url": "https://conda.anaconda.org/conda-forge/linux-64",
+  "packages.conda": {
+    "python-3.12.3-h0.conda": {"name": "python", "depends": ["zlib >=1.3.1,<2.0a0"]}
+  }
+}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(pkgDir, "zlib-1.3.1-h0", "info"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(pkgDir, "zlib-1.3.1-h0", "info", "index.json"),
+		[]byte(`{"name": "zlib", "depends": ["libgcc-ng >=12"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	locked := map[string]map[string]*lockedPackage{
+		"python":    {"": {DistName: "python-3.12.3-h0"}},
+		"zlib":      {"linux-64": {DistName: "zlib-1.3.1-h0"}, "osx-arm64": {DistName: "zlib-1.3.1-h1"}},
+		"libgcc-ng": {"linux-64": {DistName: "libgcc-ng-14.1.0-h0"}},
+	}
+	specs, missing, err := lockedDepends(locked, "linux-64", pkgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 1 || missing[0] != "libgcc-ng-14.1.0-h0" {
+		t.Errorf("unexpected missing %v", missing)
+	}
+	if d := specs["python"].Depends; len(d) != 1 || d[0] != "zlib" {
+		t.Errorf("unexpected python depends %v", d)
+	}
+	if d := specs["zlib"].Depends; len(d) != 1 || d[0] != "libgcc-ng" {
+		t.Errorf("unexpected zlib depends %v", d)
+	}
+	paths, _ := dependencyPaths(specs, whyRoots(specs, nil), "libgcc-ng", 10)
+	if len(paths) != 1 || strings.Join(paths[0], " -> ") != "python -> zlib -> libgcc-ng" {
+		t.Errorf("unexpected paths %v", paths)
+	}
+}
@@ -4,20 +4,28 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/10XGenomics/rules_conda/buildutil"
 	"github.com/bazelbuild/buildtools/build"
 )
 
-func makeSpecFunc(specs map[string]*PkgSpec, extras []string,
+func makeSpecFunc(env *lockEnvironment, extras, platforms []string,
 	existing *build.Function) build.Function {
+	specs := env.specs
 	allSpecs := make(map[string]struct{}, len(specs)+len(extras))
 	specList := make([]*PkgSpec, 0, len(specs))
+	// The packages whose repositories are declared by this macro.
+	repoSpecs := make([]*PkgSpec, 0, len(specs))
 	for _, spec := range specs {
 		specList = append(specList, spec)
 		allSpecs[spec.Name] = struct{}{}
+		if _, ok := env.declared[spec.Name]; !ok {
+			repoSpecs = append(repoSpecs, spec)
+		}
 	}
 	for _, pkg := range extras {
 		allSpecs[pkg] = struct{}{}
@@ -25,6 +33,9 @@ func makeSpecFunc(specs map[string]*PkgSpec, extras []string,
 	sort.Slice(specList, func(i, j int) bool {
 		return specList[i].DistName < specList[j].DistName
 	})
+	sort.Slice(repoSpecs, func(i, j int) bool {
+		return repoSpecs[i].DistName < repoSpecs[j].DistName
+	})
 
 	var condaRepo *build.StringExpr
 	if existing != nil {
@@ -35,7 +46,7 @@ func makeSpecFunc(specs map[string]*PkgSpec, extras []string,
 		}
 	}
 	if condaRepo == nil {
-		condaRepo = buildutil.StrExpr(buildutil.DefaultCondaRepo)
+		condaRepo = buildutil.StrExpr(env.repo())
 	}
 
 	docstring := `Create remote repositories to download each conda package.
@@ -44,7 +55,15 @@ func makeSpecFunc(specs map[string]*PkgSpec, extras []string,
     general, other targets should depend on targets in the ` +
 		"`@" + condaRepo.Value + "`" + `
     repository, rather than individual package repositories.
-
+`
+	if len(env.declared) > 0 {
+		docstring += `
+    Packages shared with an earlier environment are downloaded by the
+    repositories created by the macro for that environment, which must
+    also be called.
+`
+	}
+	docstring += `
     Args:
         name (string): The name of the top level distribution repo.
     `
@@ -58,6 +77,14 @@ func makeSpecFunc(specs map[string]*PkgSpec, extras []string,
 		existingBody = existing.Body
 	}
 	repoCall, pkgListExpr, aliases := getRepoCall(existingBody)
+	if env.aliases != nil {
+		aliases = mergeAliases(os.Stderr, aliases, env.aliases, allSpecs)
+		if len(aliases.List) > 0 {
+			updateValue("aliases", aliases, repoCall)
+		} else {
+			unsetStr("aliases", repoCall)
+		}
+	}
 	if aliases != nil {
 		for _, pair := range aliases.List {
 			if key, ok := pair.Key.(*build.StringExpr); ok {
@@ -65,22 +92,81 @@ func makeSpecFunc(specs map[string]*PkgSpec, extras []string,
 			}
 		}
 	}
-	for _, spec := range specList {
+	// Hand-maintained repositories marked with `# keep` are kept even if
+	// they are no longer part of the solution.
+	kept := keptRepos(os.Stderr, existingBody, repoSpecs)
+	keptPkgs := keptPackages(kept, pkgListExpr.List)
+	var oldPlatformPkgs *build.DictExpr
+	if attr := getAttr("platform_packages", repoCall.List); attr != nil {
+		oldPlatformPkgs, _ = attr.RHS.(*build.DictExpr)
+	}
+	keptPlatformPkgs := make(map[string][]string)
+	if oldPlatformPkgs != nil {
+		for _, kv := range oldPlatformPkgs.List {
+			if list, ok := kv.Value.(*build.ListExpr); ok {
+				if pkgs := keptPackages(kept, list.List); len(pkgs) > 0 {
+					keptPlatformPkgs[stringValue(kv.Key)] = pkgs
+				}
+			}
+		}
+	}
+	for _, pkg := range keptPkgs {
+		allSpecs[pkg] = struct{}{}
+	}
+	for _, pkgs := range keptPlatformPkgs {
+		for _, pkg := range pkgs {
+			allSpecs[pkg] = struct{}{}
+		}
+	}
+	for _, spec := range repoSpecs {
 		var rule *build.CallExpr
 		rule, existingBody = spec.searchExistingCall(existingBody, allSpecs)
 		updateIdent("conda_repo", "name", rule)
+		if _, ok := env.shared[spec.Name]; ok {
+			updateIdent("shared", "True", rule)
+		} else {
+			unsetStr("shared", rule)
+		}
+		for len(kept) > 0 && repoCallName(kept[0]) < spec.repoName() {
+			body = append(body, kept[0])
+			kept = kept[1:]
+		}
 		body = append(body, rule)
 	}
+	for _, c := range kept {
+		body = append(body, c)
+	}
 	var oldPkgList []build.Expr
 	oldPkgList = pkgListExpr.List
 	pkgList := make([]build.Expr, 0, len(specList)+len(extras))
+	platformPkgs := make(map[string][]string)
 	var pyVersion string
+	pkgNames := make([]string, 0, len(specList)+len(keptPkgs))
 	for _, spec := range specList {
 		if spec.Name == "python" {
 			pyVersion = spec.Version
 		}
+		if len(spec.Platforms) > 0 && len(spec.Platforms) < len(platforms) {
+			// Not available on every platform.
+			for p := range spec.Platforms {
+				platformPkgs[p] = append(platformPkgs[p], spec.Name)
+			}
+			continue
+		}
+		pkgNames = append(pkgNames, spec.Name)
+	}
+	for p, pkgs := range keptPlatformPkgs {
+		platformPkgs[p] = append(platformPkgs[p], pkgs...)
+	}
+	for _, pkg := range keptPkgs {
+		if !slices.Contains(extras, pkg) {
+			pkgNames = append(pkgNames, pkg)
+		}
+	}
+	sort.Strings(pkgNames)
+	for _, pkg := range pkgNames {
 		var str *build.StringExpr
-		str, oldPkgList = updateSortedList(spec.Name, oldPkgList)
+		str, oldPkgList = updateSortedList(pkg, oldPkgList)
 		pkgList = append(pkgList, str)
 	}
 	for _, pkg := range extras {
@@ -93,6 +179,14 @@ func makeSpecFunc(specs map[string]*PkgSpec, extras []string,
 		pkgList = append(pkgList, str)
 	}
 	pkgListExpr.List = pkgList
+	if env.executables != nil {
+		updateExecutables(repoCall, env.executables, env.unchecked)
+	}
+	if len(platformPkgs) > 0 {
+		updateValue("platform_packages", platformDict(platformPkgs), repoCall)
+	} else {
+		unsetStr("platform_packages", repoCall)
+	}
 	if pyVersion != "" && pyVersion[0] >= '2' && pyVersion[0] <= '9' {
 		fmt.Fprint(os.Stderr,
 			"Setting `py_version` ", pyVersion[:1],
@@ -100,18 +194,22 @@ func makeSpecFunc(specs map[string]*PkgSpec, extras []string,
 		updateValue("py_version", &build.LiteralExpr{Token: pyVersion[:1]}, repoCall)
 	}
 	body = append(body, repoCall)
-	body = append(body, &build.CallExpr{
-		X: &build.Ident{Name: "native.register_toolchains"},
-		List: []build.Expr{
-			&build.CallExpr{
-				X: &build.DotExpr{
-					X:    buildutil.StrExpr("@{}//:python_toolchain"),
-					Name: "format",
+	// Only the primary environment registers its python toolchain, since
+	// toolchain resolution would otherwise be ambiguous.
+	if env.name == "" {
+		body = append(body, &build.CallExpr{
+			X: &build.Ident{Name: "native.register_toolchains"},
+			List: []build.Expr{
+				&build.CallExpr{
+					X: &build.DotExpr{
+						X:    buildutil.StrExpr("@{}//:python_toolchain"),
+						Name: "format",
+					},
+					List: []build.Expr{&build.Ident{Name: "name"}},
 				},
-				List: []build.Expr{&build.Ident{Name: "name"}},
 			},
-		},
-	})
+		})
+	}
 	var existingComments build.Comments
 	if existing != nil {
 		existingComments = existing.Comments
@@ -237,14 +335,79 @@ To use, add
 	file.Stmt = append(stmt, file.Stmt...)
 }
 
-func writeSpecs(specs map[string]*PkgSpec, extras []string, outName string) error {
-	var file *build.File
-	if b, err := os.ReadFile(outName); err == nil {
-		file, err = build.ParseBzl(outName, b)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "WARNING: Existing file found, but could not be parsed.")
+// moduleVar returns the value assigned to a top-level variable in the lock
+// file, or nil if there is no such assignment.
+func moduleVar(file *build.File, name string) build.Expr {
+	if file == nil {
+		return nil
+	}
+	for _, expr := range file.Stmt {
+		if assign, ok := expr.(*build.AssignExpr); ok &&
+			buildutil.Ident(assign.LHS) == name {
+			return assign.RHS
+		}
+	}
+	return nil
+}
+
+// setModuleVar assigns a top-level variable in the lock file, after the
+// load statements, or removes the assignment if the value is nil.  The
+// comment is added if the assignment is new.
+func setModuleVar(file *build.File, name, comment string, value build.Expr) {
+	for i, expr := range file.Stmt {
+		assign, ok := expr.(*build.AssignExpr)
+		if !ok || buildutil.Ident(assign.LHS) != name {
+			continue
 		}
+		if value == nil {
+			file.Stmt = append(file.Stmt[:i], file.Stmt[i+1:]...)
+		} else {
+			assign.RHS = value
+		}
+		return
+	}
+	if value == nil {
+		return
 	}
+	assign := &build.AssignExpr{
+		LHS: &build.Ident{Name: name},
+		Op:  "=",
+		RHS: value,
+	}
+	assign.Comments.Before = []build.Comment{{Token: "# " + comment}}
+	start := 0
+	for i, expr := range file.Stmt {
+		switch expr.(type) {
+		case *build.StringExpr, *build.LoadStmt, *build.AssignExpr:
+			start = i + 1
+		}
+		if _, ok := expr.(*build.DefStmt); ok {
+			break
+		}
+	}
+	file.Stmt = append(
+		append(file.Stmt[:start:start], assign),
+		file.Stmt[start:]...)
+}
+
+// readLock parses the existing lock file, if there is one.
+func readLock(outName string) *build.File {
+	b, err := os.ReadFile(outName)
+	if err != nil {
+		return nil
+	}
+	file, err := build.ParseBzl(outName, b)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "WARNING: Existing file found, but could not be parsed.")
+		return nil
+	}
+	return file
+}
+
+// renderSpecs updates the existing lock file, or creates a new one, and
+// returns the formatted content.
+func renderSpecs(file *build.File, envs []*lockEnvironment,
+	extras, platforms []string, outName string, prov *lockProvenance) []byte {
 	if file == nil {
 		file = &build.File{
 			Path: path.Base(outName),
@@ -259,23 +422,120 @@ func writeSpecs(specs map[string]*PkgSpec, extras []string, outName string) erro
 		"//rules:conda_package_repository.bzl",
 		"conda_package_repository",
 		file)
-	addSpecFunc(specs, extras, file)
-	return os.WriteFile(
-		outName,
-		build.Format(file), 0666)
+	setVirtualOverrides(file, prov.Virtual)
+	setProvenance(file, prov)
+	removeStaleEnvironments(file, envs)
+	for _, env := range envs {
+		addSpecFunc(env, extras, platforms, file)
+	}
+	return build.Format(file)
+}
+
+// renderThin updates the existing lock file, or creates a new one, with a
+// conda_environment macro which creates the repositories from the embedded
+// lock data, and returns the formatted content.
+func renderThin(file *build.File, data *jsonLock, extras []string,
+	outName string, prov *lockProvenance) ([]byte, error) {
+	if file == nil {
+		file = &build.File{
+			Path: path.Base(outName),
+			Type: build.TypeBzl,
+		}
+	}
+	docstring(outName, file)
+	// The repository rules are not used directly.
+	stmts := file.Stmt[:0]
+	for _, expr := range file.Stmt {
+		if load, ok := expr.(*build.LoadStmt); ok && load.Module != nil {
+			switch load.Module.Value {
+			case "@" + buildutil.BazelRulesConda + "//rules:conda_environment.bzl",
+				"@" + buildutil.BazelRulesConda + "//rules:conda_package_repository.bzl":
+				continue
+			}
+		}
+		stmts = append(stmts, expr)
+	}
+	file.Stmt = stmts
+	loadRule("@"+buildutil.BazelRulesConda+
+		"//rules:conda_lock.bzl",
+		"conda_lock_environment", file)
+	setVirtualOverrides(file, prov.Virtual)
+	setProvenance(file, prov)
+	lock, err := data.expr()
+	if err != nil {
+		return nil, err
+	}
+	setModuleVar(file, lockDataVar,
+		"The packages for each platform, as written to the json lock file.",
+		lock)
+	condaRepo := buildutil.StrExpr(buildutil.DefaultCondaRepo)
+	var def *build.DefStmt
+	for _, expr := range file.Stmt {
+		if d, ok := expr.(*build.DefStmt); ok && d.Name == "conda_environment" {
+			def = d
+			if attr := getAttr("name", d.Params); attr != nil {
+				if s, ok := attr.RHS.(*build.StringExpr); ok && s.Value != "" {
+					condaRepo = s
+				}
+			}
+			break
+		}
+	}
+	if def == nil {
+		def = &build.DefStmt{
+			Name:           "conda_environment",
+			ForceMultiLine: true,
+		}
+		file.Stmt = append(file.Stmt, def)
+	}
+	call := &build.CallExpr{
+		X: &build.Ident{Name: "conda_lock_environment"},
+		List: []build.Expr{
+			buildutil.Attr("name", &build.Ident{Name: "name"}),
+			buildutil.Attr("lock", &build.Ident{Name: lockDataVar}),
+		},
+		ForceMultiLine: true,
+	}
+	if len(extras) > 0 {
+		sorted := append([]string(nil), extras...)
+		sort.Strings(sorted)
+		call.List = append(call.List, buildutil.StrListAttr("extra_packages", sorted...))
+	}
+	def.Function = build.Function{
+		Params: []build.Expr{
+			&build.AssignExpr{
+				LHS: &build.Ident{Name: "name"},
+				Op:  "=",
+				RHS: condaRepo,
+			},
+		},
+		Comments: def.Function.Comments,
+		Body: []build.Expr{
+			&build.StringExpr{
+				Value: `Create remote repositories to download each conda package.
+
+    Args:
+        name (string): The name of the top level distribution repo.
+    `,
+				TripleQuote: true,
+			},
+			call,
+		},
+	}
+	return build.Format(file), nil
 }
 
-func addSpecFunc(specs map[string]*PkgSpec, extras []string, file *build.File) {
+func addSpecFunc(env *lockEnvironment, extras, platforms []string, file *build.File) {
 	for _, expr := range file.Stmt {
-		if def, ok := expr.(*build.DefStmt); ok && def.Name == "conda_environment" {
-			def.Function = makeSpecFunc(specs, extras, &def.Function)
+		if def, ok := expr.(*build.DefStmt); ok && def.Name == env.macro() {
+			def.Function = makeSpecFunc(env, extras, platforms, &def.Function)
 			return
 		}
 	}
 	file.Stmt = append(file.Stmt,
 		&build.DefStmt{
-			Name:           "conda_environment",
-			Function:       makeSpecFunc(specs, extras, nil),
+			Name:           env.macro(),
+			Function:       makeSpecFunc(env, extras, platforms, nil),
 			ForceMultiLine: true,
 		})
 }
@@ -320,12 +580,24 @@ func (spec *PkgSpec) searchExistingCall(body []build.Expr,
 }
 
 func (spec *PkgSpec) repoRule(rn string, allSpecs map[string]struct{}) *build.CallExpr {
+	if len(spec.Platforms) > 0 {
+		c := build.CallExpr{
+			X: &build.Ident{Name: "conda_package_repository"},
+			List: []build.Expr{
+				buildutil.StrAttr("name", rn),
+			},
+			ForceMultiLine: true,
+		}
+		spec.updatePlatforms(&c)
+		spec.excludeDeps(&c, allSpecs)
+		return &c
+	}
 	c := build.CallExpr{
 		X: &build.Ident{Name: "conda_package_repository"},
 		List: []build.Expr{
 			buildutil.StrAttr("name", rn),
 			buildutil.Attr("base_urls", buildutil.ListExpr(
-				buildutil.StrExprList(spec.BaseUrl)...)),
+				buildutil.StrExprList(spec.baseUrls()...)...)),
 			buildutil.StrAttr("dist_name", spec.DistName),
 			buildutil.StrAttr("sha256", spec.Sha256),
 		},
@@ -335,12 +607,32 @@ func (spec *PkgSpec) repoRule(rn string, allSpecs map[string]struct{}) *build.Ca
 		c.List = append(c.List,
 			buildutil.StrAttr("archive_type", "conda"))
 	}
+	spec.updateMd5Size(&c)
 	spec.excludeDeps(&c, allSpecs)
 	return &c
 }
 
+// updateMd5Size sets the md5 and size attributes, if they are known.
+func (spec *PkgSpec) updateMd5Size(c *build.CallExpr) {
+	if spec.Md5 != "" {
+		updateStr("md5", spec.Md5, c)
+	} else {
+		unsetStr("md5", c)
+	}
+	if spec.Size != 0 {
+		updateStr("size", strconv.FormatInt(spec.Size, 10), c)
+	} else {
+		unsetStr("size", c)
+	}
+}
+
 func (spec *PkgSpec) updateUrl(c *build.CallExpr) {
-	ensureInList("base_urls", spec.BaseUrl, c)
+	if len(spec.BaseUrls) > 0 {
+		updateValue("base_urls", buildutil.ListExpr(
+			buildutil.StrExprList(spec.BaseUrls...)...), c)
+	} else {
+		ensureInList("base_urls", spec.BaseUrl, c)
+	}
 }
 
 func ensureInList(attr, value string, c *build.CallExpr) {
@@ -431,6 +723,20 @@ func updateValue(key string, value build.Expr, c *build.CallExpr) {
 }
 
 func (spec *PkgSpec) updateRule(c *build.CallExpr, allSpecs map[string]struct{}) *build.CallExpr {
+	if len(spec.Platforms) > 0 {
+		for _, attr := range [...]string{
+			"base_urls", "dist_name", "sha256", "archive_type",
+			"md5", "size",
+		} {
+			unsetStr(attr, c)
+		}
+		spec.updatePlatforms(c)
+		spec.excludeDeps(c, allSpecs)
+		return c
+	}
+	for _, attr := range platformAttrs {
+		unsetStr(attr, c)
+	}
 	spec.updateUrl(c)
 	updateStr("dist_name", spec.DistName, c)
 	updateStr("sha256", spec.Sha256, c)
@@ -439,10 +745,141 @@ func (spec *PkgSpec) updateRule(c *build.CallExpr, allSpecs map[string]struct{})
 	} else if strings.HasSuffix(spec.Url, ".tar.bz2") {
 		unsetStr("archive_type", c)
 	}
+	spec.updateMd5Size(c)
 	spec.excludeDeps(c, allSpecs)
 	return c
 }
 
+// Attributes of conda_package_repository used for packages which differ
+// between platforms.
+var platformAttrs = [...]string{
+	"platform_base_urls",
+	"platform_dist_names",
+	"platform_sha256",
+	"platform_archive_types",
+	"platform_md5",
+	"platform_size",
+}
+
+// updatePlatforms sets the per-platform attributes for a package which
+// differs between platforms.  Unless mirrors are configured, existing
+// mirror URLs are kept if they include the URL for the platform.
+func (spec *PkgSpec) updatePlatforms(c *build.CallExpr) {
+	var existingUrls *build.DictExpr
+	if v := getAttr("platform_base_urls", c.List); v != nil {
+		existingUrls, _ = v.RHS.(*build.DictExpr)
+	}
+	platforms := spec.platformNames()
+	urls := make([]*build.KeyValueExpr, 0, len(platforms))
+	dists := make([]*build.KeyValueExpr, 0, len(platforms))
+	shas := make([]*build.KeyValueExpr, 0, len(platforms))
+	var types, md5s, sizes []*build.KeyValueExpr
+	for _, p := range platforms {
+		pspec := spec.Platforms[p]
+		var urlList build.Expr = buildutil.ListExpr(
+			buildutil.StrExprList(pspec.baseUrls()...)...)
+		if old := dictValue(existingUrls, p); old != nil && len(pspec.BaseUrls) == 0 {
+			if list, ok := old.(*build.ListExpr); ok {
+				for _, e := range list.List {
+					if s, ok := e.(*build.StringExpr); ok && s.Value == pspec.BaseUrl {
+						urlList = list
+						break
+					}
+				}
+			}
+		}
+		urls = append(urls, &build.KeyValueExpr{
+			Key: buildutil.StrExpr(p), Value: urlList,
+		})
+		dists = append(dists, &build.KeyValueExpr{
+			Key: buildutil.StrExpr(p), Value: buildutil.StrExpr(pspec.DistName),
+		})
+		shas = append(shas, &build.KeyValueExpr{
+			Key: buildutil.StrExpr(p), Value: buildutil.StrExpr(pspec.Sha256),
+		})
+		if strings.HasSuffix(pspec.Url, ".conda") {
+			types = append(types, &build.KeyValueExpr{
+				Key: buildutil.StrExpr(p), Value: buildutil.StrExpr("conda"),
+			})
+		}
+		if pspec.Md5 != "" {
+			md5s = append(md5s, &build.KeyValueExpr{
+				Key: buildutil.StrExpr(p), Value: buildutil.StrExpr(pspec.Md5),
+			})
+		}
+		if pspec.Size != 0 {
+			sizes = append(sizes, &build.KeyValueExpr{
+				Key:   buildutil.StrExpr(p),
+				Value: buildutil.StrExpr(strconv.FormatInt(pspec.Size, 10)),
+			})
+		}
+	}
+	updateValue("platform_base_urls",
+		&build.DictExpr{List: urls, ForceMultiLine: true}, c)
+	updateValue("platform_dist_names",
+		&build.DictExpr{List: dists, ForceMultiLine: true}, c)
+	updateValue("platform_sha256",
+		&build.DictExpr{List: shas, ForceMultiLine: true}, c)
+	if len(types) > 0 {
+		updateValue("platform_archive_types",
+			&build.DictExpr{List: types, ForceMultiLine: true}, c)
+	} else {
+		unsetStr("platform_archive_types", c)
+	}
+	for _, d := range [...]struct {
+		attr string
+		list []*build.KeyValueExpr
+	}{
+		{"platform_md5", md5s},
+		{"platform_size", sizes},
+	} {
+		if len(d.list) > 0 {
+			updateValue(d.attr,
+				&build.DictExpr{List: d.list, ForceMultiLine: true}, c)
+		} else {
+			unsetStr(d.attr, c)
+		}
+	}
+}
+
+func dictValue(dict *build.DictExpr, key string) build.Expr {
+	if dict == nil {
+		return nil
+	}
+	for _, kv := range dict.List {
+		if k, ok := kv.Key.(*build.StringExpr); ok && k.Value == key {
+			return kv.Value
+		}
+	}
+	return nil
+}
+
+// platformDict builds a dict expression mapping each platform to a sorted
+// list of strings.
+func platformDict(values map[string][]string) *build.DictExpr {
+	platforms := make([]string, 0, len(values))
+	for p := range values {
+		platforms = append(platforms, p)
+	}
+	sort.Strings(platforms)
+	dict := &build.DictExpr{
+		List:           make([]*build.KeyValueExpr, 0, len(platforms)),
+		ForceMultiLine: true,
+	}
+	for _, p := range platforms {
+		list := append([]string(nil), values[p]...)
+		sort.Strings(list)
+		dict.List = append(dict.List, &build.KeyValueExpr{
+			Key: buildutil.StrExpr(p),
+			Value: &build.ListExpr{
+				List:           buildutil.StrExprList(list...),
+				ForceMultiLine: true,
+			},
+		})
+	}
+	return dict
+}
+
 func (spec *PkgSpec) excludeDeps(c *build.CallExpr, allSpecs map[string]struct{}) {
 	for _, d := range spec.Depends {
 		if strings.HasPrefix(d, "__") {
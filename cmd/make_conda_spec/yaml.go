@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// This file implements a parser for the subset of YAML used by conda lock
+// files and environment files: block mappings and sequences, plain and
+// quoted scalars, and simple flow sequences and mappings.
+//
+// Mappings are parsed to map[string]any, sequences to []any, and scalars
+// to string.  Empty values are nil.
+
+type yamlLine struct {
+	num     int
+	indent  int
+	content string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func parseYaml(r io.Reader) (any, error) {
+	var p yamlParser
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16*1024*1024)
+	for num := 1; scanner.Scan(); num++ {
+		text := strings.TrimRight(stripYamlComment(scanner.Text()), " \t\r")
+		content := strings.TrimLeft(text, " ")
+		if content == "" || content == "---" || content == "..." {
+			continue
+		}
+		p.lines = append(p.lines, yamlLine{
+			num:     num,
+			indent:  len(text) - len(content),
+			content: content,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+	v, err := p.parseNode(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, p.errorf("unexpected content %q", p.lines[p.pos].content)
+	}
+	return v, nil
+}
+
+// stripYamlComment removes a trailing comment, if it is not in a quoted
+// string.
+func stripYamlComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case c == '\'' || c == '"':
+			if i == 0 || s[i-1] == ' ' || s[i-1] == ':' ||
+				s[i-1] == '-' || s[i-1] == '[' || s[i-1] == '{' ||
+				s[i-1] == ',' {
+				quote = c
+			}
+		case c == '#':
+			if i == 0 || s[i-1] == ' ' || s[i-1] == '\t' {
+				return s[:i]
+			}
+		}
+	}
+	return s
+}
+
+func (p *yamlParser) errorf(format string, args ...any) error {
+	line := 0
+	if p.pos < len(p.lines) {
+		line = p.lines[p.pos].num
+	} else if len(p.lines) > 0 {
+		line = p.lines[len(p.lines)-1].num
+	}
+	return fmt.Errorf("yaml line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func isSeqItem(content string) bool {
+	return content == "-" || strings.HasPrefix(content, "- ")
+}
+
+// parseNode parses the block node starting at the current line, which must
+// have the given indentation.
+func (p *yamlParser) parseNode(indent int) (any, error) {
+	line := p.lines[p.pos]
+	if isSeqItem(line.content) {
+		return p.parseSeq(indent)
+	}
+	if _, _, ok := splitYamlKey(line.content); ok {
+		return p.parseMap(indent)
+	}
+	p.pos++
+	return parseYamlScalar(line.content)
+}
+
+func (p *yamlParser) parseSeq(indent int) ([]any, error) {
+	result := []any{}
+	for p.pos < len(p.lines) {
+		line := &p.lines[p.pos]
+		if line.indent != indent || !isSeqItem(line.content) {
+			break
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(line.content, "-"), " ")
+		if rest == "" {
+			p.pos++
+			v, err := p.parseChild(indent, false)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, v)
+			continue
+		}
+		// Treat the rest of the line as the first line of a nested node.
+		line.indent += len(line.content) - len(rest)
+		line.content = rest
+		v, err := p.parseNode(line.indent)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+// parseChild parses the value of a sequence item or mapping key which was
+// not on the same line.  Sequences are allowed at the same indentation as
+// the parent mapping key.
+func (p *yamlParser) parseChild(indent int, inMap bool) (any, error) {
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+	next := p.lines[p.pos]
+	if next.indent > indent ||
+		inMap && next.indent == indent && isSeqItem(next.content) {
+		return p.parseNode(next.indent)
+	}
+	return nil, nil
+}
+
+func (p *yamlParser) parseMap(indent int) (map[string]any, error) {
+	result := make(map[string]any)
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent != indent || isSeqItem(line.content) {
+			break
+		}
+		key, value, ok := splitYamlKey(line.content)
+		if !ok {
+			return nil, p.errorf("expected a mapping key in %q", line.content)
+		}
+		k, err := parseYamlScalar(key)
+		if err != nil {
+			return nil, err
+		}
+		p.pos++
+		var v any
+		if value == "" {
+			v, err = p.parseChild(indent, true)
+		} else if isBlockScalar(value) {
+			v = p.parseBlockScalar(indent, value[0] == '>')
+		} else {
+			v, err = parseYamlScalar(value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ks, _ := k.(string)
+		result[ks] = v
+	}
+	return result, nil
+}
+
+func isBlockScalar(value string) bool {
+	switch value {
+	case "|", "|-", "|+", ">", ">-", ">+":
+		return true
+	}
+	return false
+}
+
+// parseBlockScalar reads the lines of a literal or folded block scalar.
+func (p *yamlParser) parseBlockScalar(indent int, folded bool) string {
+	var lines []string
+	for p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+		lines = append(lines, p.lines[p.pos].content)
+		p.pos++
+	}
+	if folded {
+		return strings.Join(lines, " ") + "\n"
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// splitYamlKey splits a `key: value` line.
+func splitYamlKey(content string) (key, value string, ok bool) {
+	start := 0
+	if content[0] == '"' || content[0] == '\'' {
+		end := strings.IndexByte(content[1:], content[0])
+		if end < 0 {
+			return "", "", false
+		}
+		start = end + 2
+	} else if content[0] == '[' || content[0] == '{' {
+		return "", "", false
+	}
+	i := strings.Index(content[start:], ": ")
+	if i < 0 {
+		if strings.HasSuffix(content, ":") {
+			return content[:len(content)-1], "", true
+		}
+		return "", "", false
+	}
+	i += start
+	return strings.TrimSpace(content[:i]), strings.TrimSpace(content[i+2:]), true
+}
+
+func parseYamlScalar(s string) (any, error) {
+	switch {
+	case s == "" || s == "~" || s == "null":
+		return nil, nil
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return nil, fmt.Errorf("unterminated string %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case s[0] == '"':
+		return strconv.Unquote(s)
+	case s[0] == '[':
+		if s[len(s)-1] != ']' {
+			return nil, fmt.Errorf("unsupported flow sequence %s", s)
+		}
+		result := []any{}
+		for _, item := range splitFlow(s[1 : len(s)-1]) {
+			v, err := parseYamlScalar(item)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, v)
+		}
+		return result, nil
+	case s[0] == '{':
+		if s[len(s)-1] != '}' {
+			return nil, fmt.Errorf("unsupported flow mapping %s", s)
+		}
+		result := make(map[string]any)
+		for _, item := range splitFlow(s[1 : len(s)-1]) {
+			k, v, _ := strings.Cut(item, ":")
+			key, err := parseYamlScalar(strings.TrimSpace(k))
+			if err != nil {
+				return nil, err
+			}
+			value, err := parseYamlScalar(strings.TrimSpace(v))
+			if err != nil {
+				return nil, err
+			}
+			ks, _ := key.(string)
+			result[ks] = value
+		}
+		return result, nil
+	}
+	return s, nil
+}
+
+// splitFlow splits the comma-separated items of a flow collection.  Nested
+// flow collections are not supported.
+func splitFlow(s string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == ',':
+			items = append(items, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(s[start:]); last != "" {
+		items = append(items, last)
+	}
+	return items
+}
+
+// yamlString returns the value as a string, if it is one.
+func yamlString(v any) string {
+	s, _ := v.(string)
+	return s
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYaml(t *testing.T) {
+	doc, err := parseYaml(strings.NewReader(`# comment
+name: test  # trailing comment
+channels:
+- conda-forge
+- 'bioconda'
+dependencies:
+  - python >=3.9
+  - pip:
+    - requests==2.31
+empty: {}
+flow: [a, "b c"]
+nested:
+  key: "value # not a comment"
+  other:
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]any{
+		"name":     "test",
+		"channels": []any{"conda-forge", "bioconda"},
+		"dependencies": []any{
+			"python >=3.9",
+			map[string]any{"pip": []any{"requests==2.31"}},
+		},
+		"empty": map[string]any{},
+		"flow":  []any{"a", "b c"},
+		"nested": map[string]any{
+			"key":   "value # not a comment",
+			"other": nil,
+		},
+	}
+	if !reflect.DeepEqual(doc, expect) {
+		t.Errorf("unexpected result %#v", doc)
+	}
+}
@@ -106,8 +106,7 @@ func (pkg *Package) depsRule(includeDeps, excludeDeps []string, condaRepo string
 		List: []build.Expr{
 			buildutil.StrAttr("name", "conda_deps"),
 			buildutil.Attr("deps", &deps),
-			buildutil.Attr("visibility", buildutil.ListExpr(
-				buildutil.StrExpr(condaRepo+"//:__pkg__"))),
+			buildutil.Attr("visibility", pkg.condaVis(0, condaRepo)),
 		},
 	}
 }
@@ -321,8 +320,8 @@ func (pkg *Package) isPython38() bool {
 	return true
 }
 
-func condaVis(len int, condaRepo string) build.Expr {
-	if len == 0 {
+func (pkg *Package) condaVis(len int, condaRepo string) build.Expr {
+	if len == 0 && !pkg.Shared {
 		return buildutil.ListExpr(buildutil.StrExpr(condaRepo + "//:__pkg__"))
 	} else {
 		return buildutil.PublicVis()
@@ -505,7 +504,7 @@ func (pkg *Package) fileGroups(ccInclude []string, condaRepo string) []build.Exp
 		X: &build.Ident{Name: "conda_files"},
 		List: []build.Expr{
 			buildutil.StrAttr("name", "files"),
-			buildutil.Attr("visibility", condaVis(0, condaRepo)),
+			buildutil.Attr("visibility", pkg.condaVis(0, condaRepo)),
 		},
 	}
 	result[0] = filesRule
@@ -23,6 +23,10 @@ type Package struct {
 	License      licensing.LicenseInfo
 	linkPython   bool
 	isExecutable bool
+
+	// Shared is true if the package is used by more than one conda
+	// environment repository, so its targets must be visible to all of them.
+	Shared bool
 }
 
 // Returns the name of the package.
@@ -31,7 +31,10 @@ type LicenseInfo struct {
 	// pURL metadata
 	Qualifiers PurlQualifiers
 	Name       string
-	about      aboutJson
+	// If set, LoadConda will not download the license from the license
+	// URL in about.json when the package does not include license files.
+	Offline bool
+	about   aboutJson
 }
 
 type License struct {
@@ -153,7 +156,7 @@ func (info *LicenseInfo) LoadConda(ctx context.Context, dir string) error {
 	if q, ok := info.Qualifiers.(*CondaPackageQualifiers); ok && q != nil && q.Channel == "" {
 		q.Channel = info.about.Channel()
 	}
-	if len(info.about.LicenseFiles) == 0 && info.about.LicenseUrl != "" {
+	if len(info.about.LicenseFiles) == 0 && info.about.LicenseUrl != "" && !info.Offline {
 		ctx, cancel := context.WithTimeout(ctx, time.Second*30)
 		defer cancel()
 		req, err := http.NewRequestWithContext(ctx, http.MethodGet, info.about.LicenseUrl, nil)
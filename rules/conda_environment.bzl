@@ -4,6 +4,7 @@ This file defines the repository rule for assembling a conda environment.
 
 load("@bazel_skylib//lib:sets.bzl", "sets")
 load("@bazel_skylib//lib:versions.bzl", "versions")
+load(":util.bzl", "conda_platform")
 
 def _default_alias(pkg):
     """Automatically alias - to _
@@ -211,6 +212,10 @@ load(
     ])
 
 def _conda_environment_impl(ctx):
+    packages = ctx.attr.conda_packages
+    if ctx.attr.platform_packages:
+        platform = conda_platform(ctx, ctx.attr.platform)
+        packages = packages + ctx.attr.platform_packages.get(platform, [])
     ctx.file(
         "WORKSPACE",
         "workspace(name = '{name}')\n".format(name = ctx.name),
@@ -220,7 +225,7 @@ def _conda_environment_impl(ctx):
         "BUILD.bazel",
         _generate_build_content(
             py_version = ctx.attr.py_version,
-            packages = ctx.attr.conda_packages,
+            packages = packages,
             executables = ctx.attr.executable_packages,
             aliases = ctx.attr.aliases,
             name = ctx.attr.name,
@@ -249,6 +254,14 @@ conda_environment_repository = repository_rule(
         "aliases": attr.string_dict(
             doc = "A set of target aliases to add, mapping from alias to actual.",
         ),
+        "platform_packages": attr.string_list_dict(
+            doc = "Additional conda package repositories to include only " +
+                  "on some platforms, keyed by conda platform, e.g. `linux-64`.",
+        ),
+        "platform": attr.string(
+            doc = "The conda platform to use for `platform_packages`.  " +
+                  "If not set, it is determined from the host.",
+        ),
     },
     doc = "Assembles a collection of conda packages together into one place.",
     local = False,
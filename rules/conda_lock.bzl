@@ -0,0 +1,120 @@
+"""Defines a macro to create conda repositories from json lock data.
+
+This is used by the thin lock files written by `make_conda_spec -thin`,
+which embed the same data as is written to the `-lock_json` file.
+"""
+
+load(":conda_environment.bzl", "conda_environment_repository")
+load(":conda_package_repository.bzl", "conda_package_repository")
+
+def _repo_name(pkg_name):
+    return "conda_package_" + pkg_name.replace(".", "_").replace("-", "_")
+
+def _archive_type(pkg):
+    if pkg["url"].endswith(".conda"):
+        return "conda"
+    return "tar.bz2"
+
+def _same_archive(pkgs):
+    first = pkgs[0]
+    for pkg in pkgs[1:]:
+        if (pkg["dist_name"] != first["dist_name"] or
+            pkg["sha256"] != first["sha256"] or
+            pkg["base_urls"] != first["base_urls"]):
+            return False
+    return True
+
+def conda_lock_environment(
+        name,
+        lock,
+        extra_packages = [],
+        executable_packages = ["conda", "python"]):
+    """Creates the repositories for each package in the lock.
+
+    Args:
+        name: The name of the environment repository.
+        lock: The lock data, in the form written by `make_conda_spec -lock_json`.
+        extra_packages: Additional conda package repositories, declared
+            separately, to include in the environment.
+        executable_packages: The packages which have executable entry points.
+    """
+    platforms = lock["platforms"]
+    by_name = {}
+    for platform, pkgs in platforms.items():
+        for pkg in pkgs:
+            by_name.setdefault(pkg["name"], {})[platform] = pkg
+    known = {pkg_name: True for pkg_name in by_name.keys() + extra_packages}
+
+    conda_packages = list(extra_packages)
+    platform_packages = {}
+    py_version = 3
+    for pkg_name, per_platform in sorted(by_name.items()):
+        pkgs = per_platform.values()
+        exclude_deps = {}
+        for pkg in pkgs:
+            for dep in pkg["depends"]:
+                dep_name = dep.split(" ")[0]
+                if not dep_name.startswith("__") and dep_name not in known:
+                    exclude_deps[dep_name] = True
+        if len(per_platform) == len(platforms) and _same_archive(pkgs):
+            pkg = pkgs[0]
+            conda_package_repository(
+                name = _repo_name(pkg_name),
+                base_urls = pkg["base_urls"],
+                dist_name = pkg["dist_name"],
+                sha256 = pkg["sha256"],
+                archive_type = _archive_type(pkg),
+                md5 = pkg.get("md5", ""),
+                size = str(pkg["size"]) if pkg.get("size") else "",
+                exclude_deps = sorted(exclude_deps.keys()),
+                conda_repo = name,
+            )
+        else:
+            conda_package_repository(
+                name = _repo_name(pkg_name),
+                platform_base_urls = {
+                    p: pkg["base_urls"]
+                    for p, pkg in per_platform.items()
+                },
+                platform_dist_names = {
+                    p: pkg["dist_name"]
+                    for p, pkg in per_platform.items()
+                },
+                platform_sha256 = {
+                    p: pkg["sha256"]
+                    for p, pkg in per_platform.items()
+                },
+                platform_archive_types = {
+                    p: _archive_type(pkg)
+                    for p, pkg in per_platform.items()
+                },
+                platform_md5 = {
+                    p: pkg["md5"]
+                    for p, pkg in per_platform.items()
+                    if pkg.get("md5")
+                },
+                platform_size = {
+                    p: str(pkg["size"])
+                    for p, pkg in per_platform.items()
+                    if pkg.get("size")
+                },
+                exclude_deps = sorted(exclude_deps.keys()),
+                conda_repo = name,
+            )
+        if len(per_platform) == len(platforms):
+            conda_packages.append(pkg_name)
+        else:
+            for p in per_platform.keys():
+                platform_packages.setdefault(p, []).append(pkg_name)
+        if pkg_name == "python":
+            version = pkgs[0]["version"]
+            if version[0] >= "2" and version[0] <= "9":
+                py_version = int(version[0])
+    conda_environment_repository(
+        name = name,
+        conda_packages = sorted(conda_packages),
+        platform_packages = platform_packages,
+        executable_packages = executable_packages,
+        py_version = py_version,
+    )
+    native.register_toolchains("@{}//:python_toolchain".format(name))
@@ -8,6 +8,16 @@ invoked in the repository WORKSPACE file to make the @conda_env target.
 
 load(":util.bzl", "merge_runfiles")
 
+def _virtual_packages(ctx):
+    virtual_packages = dict(ctx.attr.virtual_packages)
+    if (ctx.attr.glibc_version and "__glibc" not in virtual_packages and
+        "glibc" not in virtual_packages):
+        virtual_packages["__glibc"] = ctx.attr.glibc_version
+    return ",".join([
+        "{}={}".format(k, v)
+        for k, v in sorted(virtual_packages.items())
+    ])
+
 def _conda_package_lock_generator_impl(ctx):
     ctx.actions.expand_template(
         template = ctx.file._generator_script,
@@ -15,14 +25,27 @@ def _conda_package_lock_generator_impl(ctx):
         substitutions = {
             "{conda}": ctx.executable._conda.short_path,
             "{generator}": ctx.executable._generator.short_path,
-            "{glibc_version}": ctx.attr.glibc_version,
             "{requirements}": ctx.file.requirements.short_path,
+            "{environments}": ",".join([
+                "{}={}".format(env, target.files.to_list()[0].short_path)
+                for target, env in ctx.attr.environments.items()
+            ]),
             "{build}": ctx.file.root.short_path,
             "{target}": ctx.attr.target,
             "{channels}": ",".join(ctx.attr.channels),
             "{extra}": ",".join(ctx.attr.extra_packages),
             "{exclude}": ",".join(ctx.attr.exclude),
-            "{architecture}": ctx.attr.architecture,
+            "{prune}": "true" if ctx.attr.prune else "false",
+            "{architecture}": ",".join(ctx.attr.architectures) or ctx.attr.architecture,
+            "{archive_format}": ctx.attr.archive_format,
+            "{mirrors}": ctx.file.mirrors.short_path if ctx.file.mirrors else "",
+            "{module_json}": ctx.attr.module_json,
+            "{lock_json}": ctx.attr.lock_json,
+            "{thin}": "true" if ctx.attr.thin else "false",
+            "{pip_aliases}": "true" if ctx.attr.pip_aliases else "false",
+            "{detect_executables}": "true" if ctx.attr.detect_executables else "false",
+            "{pypi_names}": ctx.file.pypi_names.short_path if ctx.file.pypi_names else "",
+            "{virtual_packages}": _virtual_packages(ctx),
         },
         is_executable = True,
     )
@@ -37,7 +60,7 @@ def _conda_package_lock_generator_impl(ctx):
             ctx.file.requirements,
             ctx.executable._generator,
             ctx.file.root,
-        ],
+        ] + ctx.files.mirrors + ctx.files.environments + ctx.files.pypi_names,
     )
     return [DefaultInfo(
         executable = ctx.outputs.executable,
@@ -49,7 +72,18 @@ _conda_package_lock_generator = rule(
     attrs = {
         "requirements": attr.label(
             allow_single_file = True,
-            doc = "The requirements.txt source file, formatted for `conda`.",
+            doc = "The requirements.txt source file, formatted for `conda`, " +
+                  "or a conda environment.yml file.",
+        ),
+        "environments": attr.label_keyed_string_dict(
+            allow_files = True,
+            doc = "Requirements files for additional environments to " +
+                  "manage in the same target file, mapped to the name of " +
+                  "each environment.  The environment named `dev` is " +
+                  "declared by a `conda_environment_dev` macro, which " +
+                  "creates the `@conda_env_dev` repository by default.  " +
+                  "Packages used by several environments must resolve to " +
+                  "the same build, and their repositories are declared once.",
         ),
         "target": attr.string(
             mandatory = True,
@@ -70,6 +104,11 @@ _conda_package_lock_generator = rule(
             allow_empty = True,
             doc = "Packages to omit from the generated package lock file.",
         ),
+        "prune": attr.bool(
+            doc = "Also omit packages which are not reachable from the " +
+                  "requirements through the dependency graph, such as " +
+                  "those only needed by an excluded package.",
+        ),
         "extra_packages": attr.string_list(
             doc =
                 """Extra packages to include.
@@ -80,7 +119,9 @@ have been declared with `new_conda_package_repository` rules.""",
             default = [],
         ),
         "glibc_version": attr.string(
-            doc = "The glibc version to tell `conda` to use when solving dependencies.",
+            doc = "The glibc version to tell `conda` to use when solving " +
+                  "dependencies.  This is a shorthand for `__glibc` in " +
+                  "`virtual_packages`, which takes precedence if it is set.",
             default = "2.17",
         ),
         "architecture": attr.string(
@@ -94,6 +135,75 @@ have been declared with `new_conda_package_repository` rules.""",
                 "linux-aarch64",
             ],
         ),
+        "architectures": attr.string_list(
+            doc = "A list of conda architectures for which to solve.  " +
+                  "If set, this overrides `architecture`, and the generated " +
+                  "lock file will contain packages for each platform.",
+        ),
+        "archive_format": attr.string(
+            doc = "The package archive format to lock: `conda` or " +
+                  "`tar.bz2` to require that format, or `prefer-conda` " +
+                  "to use `.conda` archives where they are available.  " +
+                  "By default, the archive chosen by the solver is used.",
+            values = ["", "conda", "tar.bz2", "prefer-conda"],
+        ),
+        "mirrors": attr.label(
+            allow_single_file = True,
+            doc = "A file mapping channel URLs to mirrors.  Each line has " +
+                  "a channel URL prefix followed by one or more mirror URL " +
+                  "prefixes, which are written, in order, to the " +
+                  "`base_urls` of each package.  To keep the channel " +
+                  "itself as a fallback, list it as the last mirror.",
+        ),
+        "module_json": attr.string(
+            doc = "If set, the name of a json file, next to the target " +
+                  "file, to which to also write the repositories for the " +
+                  "bzlmod module extension in `//rules:extensions.bzl`.",
+        ),
+        "lock_json": attr.string(
+            doc = "If set, the name of a json file, next to the target " +
+                  "file, to which to also write the locked packages, with " +
+                  "their versions, URLs, checksums and dependencies.",
+        ),
+        "thin": attr.bool(
+            doc = "Write the target file as a thin macro over the " +
+                  "embedded lock data, instead of declaring each package " +
+                  "repository.",
+        ),
+        "pip_aliases": attr.bool(
+            doc = "Add `aliases` from the PyPI distribution name of each " +
+                  "python package, such as `PyYAML` for `pyyaml`, where " +
+                  "it differs from the package name.  Names are read from " +
+                  "`pypi_names`, or else from the python metadata of " +
+                  "packages extracted in the conda package cache.  Names " +
+                  "which collide with other packages are reported and skipped.  " +
+                  "Added aliases are marked with a `# detected` comment, and " +
+                  "removed when their package is no longer in the environment.",
+        ),
+        "detect_executables": attr.bool(
+            doc = "Add packages which provide executables to the " +
+                  "`executable_packages` of the generated environment, " +
+                  "marked with a `# detected` comment.  A package is " +
+                  "executable if it declares an app or python entry point, " +
+                  "or has an executable in `bin/` named for the package, " +
+                  "according to its metadata in the conda package cache.  " +
+                  "Detected entries are removed when the package is gone or " +
+                  "no longer executable, while entries added by hand are " +
+                  "left untouched.",
+        ),
+        "pypi_names": attr.label(
+            allow_single_file = True,
+            doc = "A file mapping conda package names to PyPI distribution " +
+                  "names, for `pip_aliases`.  Each line has a conda package " +
+                  "name followed by one or more PyPI names.",
+        ),
+        "virtual_packages": attr.string_dict(
+            doc = "Versions of virtual packages, such as `__glibc` or " +
+                  "`__cuda`, to assume when solving, instead of those of " +
+                  "the host.  An empty version means the package is " +
+                  "absent.  The overrides are recorded in the generated " +
+                  "lock file.",
+        ),
         "_conda": attr.label(
             executable = True,
             cfg = "target",
@@ -124,6 +234,19 @@ def conda_package_lock(
         target = "conda_package_lock.bzl",
         glibc_version = "",
         build_file_name = "BUILD.bazel",
+        environments = {},
+        architecture = "linux-64",
+        architectures = [],
+        archive_format = "",
+        virtual_packages = {},
+        mirrors = None,
+        prune = False,
+        module_json = "",
+        lock_json = "",
+        thin = False,
+        pip_aliases = False,
+        pypi_names = None,
+        detect_executables = False,
         **kwargs):
     """Defines a build target for regenerating the conda package lock.
 
@@ -135,11 +258,20 @@ def conda_package_lock(
     to maintain the package lock, by running
     `bazel run //:generate_package_lock`.
 
+    Additional arguments are passed to make_conda_spec, so
+    `bazel run //:generate_package_lock -- -check` can be used in CI to verify
+    that the package lock is up to date without modifying it.
+    The faster `-check_inputs` only verifies that the lock records being
+    generated from the current requirements and other inputs, without solving.
+
     Args:
       name: The name of the generator target to be invoked with
             `bazel run`.
       requirements: The requirements.txt source file, formatted for
-                    `conda`.
+                    `conda`, or a conda environment.yml file.  If an
+                    environment file lists channels, they are used
+                    instead of `channels`, and the channels of any
+                    `channel::package` dependencies are added.
       target: The name of the output file, from which the
               `WORKSPACE` can load and call the
               `conda_environment` method.
@@ -149,7 +281,68 @@ def conda_package_lock(
       exclude: Packages to omit from the generated package lock file.
       extra_packages: Additional conda_package repository targets to include.
       glibc_version (str): The glibc version to tell `conda` to use when solving
-                           dependencies.
+                           dependencies.  This is a shorthand for `__glibc`
+                           in `virtual_packages`, which takes precedence if
+                           it is set.  If empty, `__glibc` is not
+                           overridden.
+      environments: Requirements files for additional environments to manage
+                    in the same target file, mapped to the name of each
+                    environment.  The environment named `dev` is declared by
+                    a `conda_environment_dev` macro, which creates the
+                    `@conda_env_dev` repository by default.  Packages used by
+                    several environments must resolve to the same build, and
+                    their repositories are declared once.
+      architecture: The conda architecture to use for package solving.
+      architectures: A list of conda architectures for which to solve.  If
+                     set, this overrides `architecture`, and the generated
+                     lock file will contain packages for each platform.
+      archive_format: The package archive format to lock: `conda` or
+                      `tar.bz2` to require that format, or `prefer-conda` to
+                      use `.conda` archives where they are available.  By
+                      default, the archive chosen by the solver is used.
+      virtual_packages: Versions of virtual packages, such as `__glibc` or
+                        `__cuda`, to assume when solving, instead of those
+                        of the host.  An empty version means the package is
+                        absent.  The overrides are recorded in the generated
+                        lock file.
+      mirrors: A file mapping channel URLs to mirrors.  Each line has a
+               channel URL prefix followed by one or more mirror URL
+               prefixes, which are written, in order, to the `base_urls` of
+               each package.  To keep the channel itself as a fallback, list
+               it as the last mirror.
+      prune: Also omit packages which are not reachable from the
+             requirements through the dependency graph, such as those only
+             needed by an excluded package.
+      module_json: If set, the name of a json file, next to the target file,
+                   to which to also write the repositories for the bzlmod
+                   module extension in `//rules:extensions.bzl`.
+      lock_json: If set, the name of a json file, next to the target file,
+                 to which to also write the locked packages, with their
+                 versions, URLs, checksums and dependencies.
+      thin: Write the target file as a thin macro over the embedded lock
+            data, instead of declaring each package repository.
+      pip_aliases: Add `aliases` from the PyPI distribution name of each
+                   python package, such as `PyYAML` for `pyyaml`, where it
+                   differs from the package name.  Names are read from
+                   `pypi_names`, or else from the python metadata of packages
+                   extracted in the conda package cache.  Names which collide
+                   with other packages are reported and skipped.  Added
+                   aliases are marked with a `# detected` comment, and
+                   removed when their package is no longer in the
+                   environment.
+      pypi_names: A file mapping conda package names to PyPI distribution
+                  names, for `pip_aliases`.  Each line has a conda package
+                  name followed by one or more PyPI names.
+      detect_executables: Add packages which provide executables to the
+                          `executable_packages` of the generated
+                          environment, marked with a `# detected` comment.
+                          A package is executable if it declares an app or
+                          python entry point, or has an executable in `bin/`
+                          named for the package, according to its metadata
+                          in the conda package cache.  Detected entries are
+                          removed when the package is gone or no longer
+                          executable, while entries added by hand are left
+                          untouched.
       **kwargs: additional arguments to the rule, e.g. `visibility`.
     """
     _conda_package_lock_generator(
@@ -162,5 +355,18 @@ def conda_package_lock(
         root = build_file_name,
         tags = ["no-sandbox"],
         target = target,
+        environments = environments,
+        architecture = architecture,
+        architectures = architectures,
+        archive_format = archive_format,
+        virtual_packages = virtual_packages,
+        mirrors = mirrors,
+        prune = prune,
+        module_json = module_json,
+        lock_json = lock_json,
+        thin = thin,
+        pip_aliases = pip_aliases,
+        pypi_names = pypi_names,
+        detect_executables = detect_executables,
         **kwargs
     )
@@ -10,6 +10,7 @@ load(
     "update_attrs",
     "use_netrc",
 )
+load(":util.bzl", "conda_platform")
 
 def _is_empty(ctx):
     """Returns true if the metadata indicates that this is an empty archive."""
@@ -27,14 +28,35 @@ def _conda_package_repository_impl(ctx):
     generator = ctx.path(ctx.attr._generator)
     dest = ctx.path("")
 
+    dist_name = ctx.attr.dist_name
+    sha256 = ctx.attr.sha256
+    md5 = ctx.attr.md5
+    size = ctx.attr.size
+    archive_type = ctx.attr.archive_type
     if not ctx.attr.base_urls:
         base_urls = [ctx.attr.base_url]
     else:
         base_urls = ctx.attr.base_urls
+    if ctx.attr.platform_dist_names:
+        platform = conda_platform(ctx, ctx.attr.platform)
+        if platform not in ctx.attr.platform_dist_names:
+            fail(
+                "No package for platform " + platform,
+                attr = "platform_dist_names",
+            )
+        dist_name = ctx.attr.platform_dist_names[platform]
+        sha256 = ctx.attr.platform_sha256.get(platform, "")
+        md5 = ctx.attr.platform_md5.get(platform, "")
+        size = ctx.attr.platform_size.get(platform, "")
+        archive_type = ctx.attr.platform_archive_types.get(
+            platform,
+            archive_type,
+        )
+        base_urls = ctx.attr.platform_base_urls.get(platform, base_urls)
 
     url = [
-        "{}/{}.{}".format(url, ctx.attr.dist_name, ctx.attr.archive_type)
-        for url in ctx.attr.base_urls
+        "{}/{}.{}".format(url, dist_name, archive_type)
+        for url in base_urls
     ]
     if not url:
         fail("At least one URL must be provided.", attr = "base_urls")
@@ -51,27 +73,45 @@ def _conda_package_repository_impl(ctx):
         executable = False,
     )
 
-    if ctx.attr.archive_type == "conda":
-        download_info = ctx.download_and_extract(
-            url = url,
-            sha256 = ctx.attr.sha256,
-            auth = auth,
-            type = "zip",
+    # The archive is downloaded and extracted separately, so that its md5
+    # and size can be checked.  A .conda archive is a zip file.
+    archive = "{}.{}".format(
+        dist_name,
+        "zip" if archive_type == "conda" else archive_type,
+    )
+    download_info = ctx.download(
+        url = url,
+        output = archive,
+        sha256 = sha256,
+        auth = auth,
+    )
+    if md5 or size:
+        ctx.report_progress("Verifying archive...")
+        verify = ctx.execute(
+            [
+                generator,
+                "-archive",
+                archive,
+                "-md5",
+                md5,
+                "-size",
+                size or "0",
+            ],
+            quiet = True,
         )
+        if verify.return_code != 0:
+            fail("Downloaded archive does not match the lock: " + verify.stderr)
+    ctx.extract(archive)
+    ctx.delete(archive)
+    if archive_type == "conda":
         ctx.delete("metadata.json")
-        ctx.extract("info-{}.tar.zst".format(ctx.attr.dist_name))
-        ctx.delete("info-{}.tar.zst".format(ctx.attr.dist_name))
+        ctx.extract("info-{}.tar.zst".format(dist_name))
+        ctx.delete("info-{}.tar.zst".format(dist_name))
 
         # Do not attempt to untar empty archives.
         if not _is_empty(ctx):
-            ctx.extract("pkg-{}.tar.zst".format(ctx.attr.dist_name))
-        ctx.delete("pkg-{}.tar.zst".format(ctx.attr.dist_name))
-    else:
-        download_info = ctx.download_and_extract(
-            url = url,
-            sha256 = ctx.attr.sha256,
-            auth = auth,
-        )
+            ctx.extract("pkg-{}.tar.zst".format(dist_name))
+        ctx.delete("pkg-{}.tar.zst".format(dist_name))
     patch(ctx)
     i = base_urls[0].rfind("/")
     if i > 0:
@@ -90,7 +130,7 @@ def _conda_package_repository_impl(ctx):
             "-dir",
             dest,
             "-distname",
-            ctx.attr.dist_name,
+            dist_name,
             "-licenses",
             " ".join(ctx.attr.licenses),
             "-license_file",
@@ -106,14 +146,18 @@ def _conda_package_repository_impl(ctx):
             "-url",
             url[0],
             "-type",
-            ctx.attr.archive_type,
+            archive_type,
             "-conda",
             ctx.attr.conda_repo,
+            "-shared={}".format("true" if ctx.attr.shared else "false"),
+            "-offline={}".format("true" if ctx.attr.offline else "false"),
         ] + ctx.attr.exclude,
         quiet = True,
     )
     if generate_build.return_code != 0:
         fail("Failed to generate BUILD file: " + generate_build.stderr)
+    if ctx.attr.platform_dist_names:
+        return None
     return update_attrs(ctx.attr, _conda_package_repository_attrs.keys(), {
         "sha256": download_info.sha256,
         "base_urls": base_urls,
@@ -141,6 +185,41 @@ _conda_package_repository_attrs = {
         doc = "The archive type (filename suffix) for the download.",
         default = "tar.bz2",
     ),
+    "md5": attr.string(
+        doc = "The md5 checksum of the archive, as recorded in the channel " +
+              "repodata.  If set, the download is verified against it, " +
+              "as well as against `sha256`.",
+    ),
+    "size": attr.string(
+        doc = "The size in bytes of the archive, as a decimal string, as " +
+              "recorded in the channel repodata.  If set, the download is " +
+              "verified against it.",
+    ),
+    "platform_base_urls": attr.string_list_dict(
+        doc = "Per-platform overrides for `base_urls`, keyed by conda " +
+              "platform, e.g. `linux-64`.",
+    ),
+    "platform_dist_names": attr.string_dict(
+        doc = "The `dist_name` for each conda platform.  If set, the " +
+              "package for the host platform is fetched, and it is an error " +
+              "if there is none.",
+    ),
+    "platform_sha256": attr.string_dict(
+        doc = "The `sha256` for each conda platform.",
+    ),
+    "platform_archive_types": attr.string_dict(
+        doc = "Per-platform overrides for `archive_type`.",
+    ),
+    "platform_md5": attr.string_dict(
+        doc = "The `md5` for each conda platform.",
+    ),
+    "platform_size": attr.string_dict(
+        doc = "The `size` for each conda platform, as a decimal string.",
+    ),
+    "platform": attr.string(
+        doc = "The conda platform to use for the `platform_*` attributes.  " +
+              "If not set, it is determined from the host.",
+    ),
     # These match the attributes for bazel's http_archive repository rule,
     # and share their implementation. See
     # https://github.com/bazelbuild/bazel/blob/2.0.0/tools/build_defs/repo/http.bzl
@@ -215,6 +294,16 @@ _conda_package_repository_attrs = {
               "to use when referring to dependencies.",
         default = "conda_env",
     ),
+    "offline": attr.bool(
+        doc = "If true, do not download the license text for packages " +
+              "whose metadata gives only a license URL.  Use this when " +
+              "fetching packages from a mirror on a network-isolated machine.",
+    ),
+    "shared": attr.bool(
+        doc = "Whether the package is used by more than one conda environment " +
+              "repository, in which case its targets are visible to all of them.  " +
+              "Dependencies are still referred to through `conda_repo`.",
+    ),
     # Tool dependencies
     "_generator": attr.label(
         default = Label("@com_github_10XGenomics_rules_conda_repository_helpers//:generate_conda_package_repo"),
@@ -0,0 +1,64 @@
+"""Defines a module extension to create conda repositories under bzlmod.
+
+The extension reads the json file written by `make_conda_spec -module_json`
+(or the `module_json` attribute of `conda_package_lock`), which declares the
+same repositories as the `conda_environment` macro in the `.bzl` lock file.
+
+In `MODULE.bazel`:
+```
+conda = use_extension(
+    "@com_github_10XGenomics_rules_conda//rules:extensions.bzl",
+    "conda",
+)
+conda.lock(lock = "//:conda_env.json")
+use_repo(conda, "conda_env")
+register_toolchains("@conda_env//:python_toolchain")
+```
+`make_conda_spec` prints the complete `use_repo` list when it writes the file.
+"""
+
+load(":conda_environment.bzl", "conda_environment_repository")
+load(":conda_package_repository.bzl", "conda_package_repository")
+
+def _conda_impl(module_ctx):
+    names = {}
+    for mod in module_ctx.modules:
+        for lock in mod.tags.lock:
+            data = json.decode(module_ctx.read(lock.lock))
+            name = data["name"]
+            if name in names:
+                fail("conda environment {} is declared by both {} and {}".format(
+                    name,
+                    names[name],
+                    lock.lock,
+                ))
+            names[name] = lock.lock
+            for pkg in data["packages"]:
+                attrs = dict(pkg)
+                if "patches" in attrs:
+                    attrs["patches"] = [
+                        lock.lock.relative(p)
+                        for p in attrs["patches"]
+                    ]
+                conda_package_repository(**attrs)
+            conda_environment_repository(
+                name = name,
+                **data["environment"]
+            )
+
+_lock = tag_class(
+    attrs = {
+        "lock": attr.label(
+            mandatory = True,
+            doc = "The json file written by `make_conda_spec -module_json`.",
+        ),
+    },
+    doc = "Creates the repositories for a locked conda environment.",
+)
+
+conda = module_extension(
+    implementation = _conda_impl,
+    tag_classes = {"lock": _lock},
+    doc = "Creates conda package and environment repositories from locks " +
+          "written by `make_conda_spec`.",
+)
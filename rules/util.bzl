@@ -89,3 +89,35 @@ def merge_pyinfo(
         ]),
         uses_shared_libraries = uses_shared_libraries,
     )
+
+def conda_platform(repository_ctx, override = ""):
+    """Get the conda platform (subdir) for the host.
+
+    Args:
+        repository_ctx: The repository rule context.
+        override: If set, return this value instead of detecting the platform.
+
+    Returns:
+        The conda platform name, e.g. `linux-64`.
+    """
+    if override:
+        return override
+    os_name = repository_ctx.os.name.lower()
+    arch = repository_ctx.os.arch.lower()
+    if os_name.startswith("linux"):
+        os_name = "linux"
+    elif os_name.startswith("mac os"):
+        os_name = "osx"
+    elif os_name.startswith("windows"):
+        os_name = "win"
+    else:
+        fail("Unsupported operating system " + os_name)
+    if arch in ("amd64", "x86_64"):
+        arch = "64"
+    elif arch in ("aarch64", "arm64"):
+        arch = "arm64" if os_name == "osx" else "aarch64"
+    elif arch in ("ppc64le",):
+        pass
+    else:
+        fail("Unsupported architecture " + arch)
+    return "{}-{}".format(os_name, arch)